@@ -0,0 +1,367 @@
+package go_kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A full backup is the image of the pages in use, an ordinary db file.
+//
+// An incremental backup holds the pages written after a given tx id:
+// header: magic(8) | page size(4) | since tx id(8) | tx id(8) | page nums(8)
+// records: page id(8) | page, ended by the page id endOfPages
+// trailer: crc32 of everything before it(4)
+
+var (
+	incrementalMagic = []byte("KVINCR01")
+	// ErrBackupInProgress is returned by CompactInPlace while a backup
+	// still reads the file.
+	ErrBackupInProgress = errors.New("backup in progress")
+	ErrInvalidBackup    = errors.New("invalid or corrupted backup")
+	// ErrBackupGap is returned when an incremental backup does not start
+	// at or before the tx id of the backup it is applied to.
+	ErrBackupGap = errors.New("incremental backup does not follow the base backup")
+)
+
+const (
+	incrementalHeaderSize = 36
+	endOfPages            = ^uint64(0)
+	// backupChunkPages is how many pages a backup copies per db lock, in
+	// between commits can go on.
+	backupChunkPages = 64
+)
+
+// BackupInfo describes a finished backup. The next incremental backup
+// starts from TxID.
+type BackupInfo struct {
+	SinceTxID uint64
+	TxID      uint64
+	PageNums  uint64
+	Pages     uint64 //pages written
+	Bytes     int64
+}
+
+// backup is the snapshot a running backup copies. Commit saves the
+// snapshot content of a page into saved before overwriting it, pages
+// below next are already copied and need no saving.
+type backup struct {
+	pageNums uint64
+	next     uint64
+	saved    map[uint64][]byte
+}
+
+// Backup writes a consistent full backup of db to w, which can be opened
+// as a db file itself. Writes go on while the backup runs.
+func (db *DB) Backup(w io.Writer) (BackupInfo, error) {
+	return db.backup(w, 0, false)
+}
+
+// IncrementalBackup writes the pages committed after sinceTxID to w,
+// ApplyIncrementalBackup brings a full backup forward with it.
+func (db *DB) IncrementalBackup(w io.Writer, sinceTxID uint64) (BackupInfo, error) {
+	return db.backup(w, sinceTxID, true)
+}
+
+// BackupTo writes a full backup to the file at path, replacing it
+// atomically once the backup is complete and synced.
+func (db *DB) BackupTo(path string) (BackupInfo, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	info, err := db.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+func (db *DB) backup(w io.Writer, sinceTxID uint64, incremental bool) (BackupInfo, error) {
+	b, info, err := db.addBackup(sinceTxID)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer db.removeBackup(b)
+	pageSize := db.PageSize
+
+	bw := bufio.NewWriter(w)
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(bw, checksum)
+	if incremental {
+		header := make([]byte, incrementalHeaderSize)
+		copy(header, incrementalMagic)
+		binary.BigEndian.PutUint32(header[8:12], uint32(pageSize))
+		binary.BigEndian.PutUint64(header[12:20], sinceTxID)
+		binary.BigEndian.PutUint64(header[20:28], info.TxID)
+		binary.BigEndian.PutUint64(header[28:36], info.PageNums)
+		_, err = out.Write(header)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	idBuf := make([]byte, 8)
+	for b.next < b.pageNums {
+		pages, err := db.backupChunk(b)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		for i, page := range pages {
+			id := b.next - uint64(len(pages)) + uint64(i)
+			if incremental {
+				if id != MetaPageID && PageTxID(page) <= sinceTxID {
+					continue
+				}
+				binary.BigEndian.PutUint64(idBuf, id)
+				_, err = out.Write(idBuf)
+				if err != nil {
+					return BackupInfo{}, err
+				}
+			}
+			_, err = out.Write(page)
+			if err != nil {
+				return BackupInfo{}, err
+			}
+			info.Pages++
+		}
+	}
+
+	if incremental {
+		binary.BigEndian.PutUint64(idBuf, endOfPages)
+		_, err = out.Write(idBuf)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		binary.BigEndian.PutUint32(idBuf, checksum.Sum32())
+		_, err = bw.Write(idBuf[:4])
+		if err != nil {
+			return BackupInfo{}, err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	info.Bytes = int64(info.Pages) * int64(pageSize)
+	if incremental {
+		info.Bytes = incrementalSize(info.Pages, pageSize)
+	}
+	return info, nil
+}
+
+// backupChunk copies the snapshot content of the next pages of b.
+func (db *DB) backupChunk(b *backup) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Pager == nil {
+		return nil, errors.New("db is not opened")
+	}
+
+	var pages [][]byte
+	for ; b.next < b.pageNums && len(pages) < backupChunkPages; b.next++ {
+		if page, hit := b.saved[b.next]; hit {
+			pages = append(pages, page)
+			delete(b.saved, b.next)
+			continue
+		}
+		page, err := db.Pager.ReadPage(b.next)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, append([]byte{}, page...))
+	}
+	return pages, nil
+}
+
+// preserveForBackups saves the pages Commit is about to overwrite for the
+// running backups that have not copied them yet. Called with db.mu held.
+func (db *DB) preserveForBackups(ids []uint64) error {
+	for _, b := range db.backups {
+		for _, id := range ids {
+			if id < b.next || id >= b.pageNums {
+				continue
+			}
+			if _, hit := b.saved[id]; hit {
+				continue
+			}
+			page, err := db.Pager.ReadPage(id)
+			if err != nil {
+				return err
+			}
+			b.saved[id] = append([]byte{}, page...)
+		}
+	}
+	return nil
+}
+
+// addBackup registers a backup of the last commit. A read only db keeps the
+// writer of another process, which does not preserve pages for it, from
+// committing until removeBackup.
+func (db *DB) addBackup(sinceTxID uint64) (*backup, BackupInfo, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Pager == nil {
+		return nil, BackupInfo{}, errors.New("db is not opened")
+	}
+	if db.failed {
+		return nil, BackupInfo{}, ErrCommitFailed
+	}
+	err := db.enterRead()
+	if err != nil {
+		return nil, BackupInfo{}, err
+	}
+	b := &backup{
+		pageNums: db.MetaPageNums,
+		saved:    make(map[uint64][]byte),
+	}
+	info := BackupInfo{
+		SinceTxID: sinceTxID,
+		TxID:      db.TxID,
+		PageNums:  db.MetaPageNums,
+	}
+	db.backups = append(db.backups, b)
+	return b, info, nil
+}
+
+func (db *DB) removeBackup(b *backup) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, running := range db.backups {
+		if running == b {
+			db.backups = append(db.backups[:i], db.backups[i+1:]...)
+			db.leaveRead()
+			return
+		}
+	}
+}
+
+// ApplyIncrementalBackup writes the pages of the incremental backup read
+// from r into the full backup file at path, which must not be open. The
+// checksum is verified before anything is written. Returns the info of
+// the applied incremental backup.
+func ApplyIncrementalBackup(path string, r io.Reader) (BackupInfo, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer file.Close()
+	pageSize, err := ReadPageSize(file)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if pageSize == 0 {
+		return BackupInfo{}, ErrInvalidFile
+	}
+	meta := make([]byte, pageSize)
+	_, err = file.ReadAt(meta, int64(MetaPageID)*int64(pageSize))
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	info, ids, pages, err := ReadIncrementalBackup(r)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if len(pages) > 0 && len(pages[0]) != pageSize {
+		return BackupInfo{}, ErrInvalidBackup
+	}
+	if baseTxID := MetaTxID(meta); info.SinceTxID > baseTxID || baseTxID > info.TxID {
+		return BackupInfo{}, ErrBackupGap
+	}
+
+	err = writePages(file, ids, pages)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	err = file.Truncate(int64(info.PageNums) * int64(pageSize))
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return info, file.Sync()
+}
+
+func writePages(file *os.File, ids []uint64, pages [][]byte) error {
+	for i, id := range ids {
+		_, err := file.WriteAt(pages[i], int64(id)*int64(len(pages[i])))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadIncrementalBackup reads and verifies an incremental backup.
+func ReadIncrementalBackup(r io.Reader) (BackupInfo, []uint64, [][]byte, error) {
+	br := bufio.NewReader(r)
+	checksum := crc32.NewIEEE()
+	in := io.TeeReader(br, checksum)
+
+	header := make([]byte, incrementalHeaderSize)
+	_, err := io.ReadFull(in, header)
+	if err != nil || !bytes.Equal(header[:8], incrementalMagic) {
+		return BackupInfo{}, nil, nil, ErrInvalidBackup
+	}
+	pageSize := int(binary.BigEndian.Uint32(header[8:12]))
+	if pageSize < MinPageSize || pageSize%MinPageSize != 0 {
+		return BackupInfo{}, nil, nil, ErrInvalidBackup
+	}
+	info := BackupInfo{
+		SinceTxID: binary.BigEndian.Uint64(header[12:20]),
+		TxID:      binary.BigEndian.Uint64(header[20:28]),
+		PageNums:  binary.BigEndian.Uint64(header[28:36]),
+	}
+
+	var ids []uint64
+	var pages [][]byte
+	idBuf := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(in, idBuf)
+		if err != nil {
+			return BackupInfo{}, nil, nil, ErrInvalidBackup
+		}
+		id := binary.BigEndian.Uint64(idBuf)
+		if id == endOfPages {
+			break
+		}
+		if id >= info.PageNums {
+			return BackupInfo{}, nil, nil, ErrInvalidBackup
+		}
+		page := make([]byte, pageSize)
+		_, err = io.ReadFull(in, page)
+		if err != nil {
+			return BackupInfo{}, nil, nil, ErrInvalidBackup
+		}
+		ids = append(ids, id)
+		pages = append(pages, page)
+	}
+
+	sum := checksum.Sum32()
+	_, err = io.ReadFull(br, idBuf[:4])
+	if err != nil || binary.BigEndian.Uint32(idBuf[:4]) != sum {
+		return BackupInfo{}, nil, nil, ErrInvalidBackup
+	}
+	info.Pages = uint64(len(pages))
+	info.Bytes = incrementalSize(info.Pages, pageSize)
+	return info, ids, pages, nil
+}
+
+func incrementalSize(pages uint64, pageSize int) int64 {
+	return incrementalHeaderSize + int64(pages)*int64(8+pageSize) + 8 + 4
+}
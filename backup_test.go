@@ -0,0 +1,156 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// hookWriter runs hook before its first write, while the backup is
+// between two chunks.
+type hookWriter struct {
+	io.Writer
+	hook func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	if w.hook != nil {
+		w.hook()
+		w.hook = nil
+	}
+	return w.Writer.Write(p)
+}
+
+func dumpDB(t *testing.T, db *DB) map[string]string {
+	kvs := make(map[string]string)
+	it, err := db.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for it.Next() {
+		kvs[it.Key()] = it.Value()
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	return kvs
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3000; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := dumpDB(t, db)
+
+	var buf bytes.Buffer
+	info, err := db.Backup(&hookWriter{Writer: &buf, hook: func() {
+		for i := 0; i < 3000; i += 2 {
+			err := db.Delete(strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 3000; i < 4000; i++ {
+			err := db.Put(strconv.Itoa(i), strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != info.Bytes || info.Bytes != int64(info.PageNums)*int64(db.PageSize) {
+		t.Fatalf("backup of %d bytes, info %+v", buf.Len(), info)
+	}
+	if info.PageNums <= backupChunkPages {
+		t.Fatal("backup of ", info.PageNums, " pages done before the writes")
+	}
+	if info.TxID >= db.TxID {
+		t.Fatal("backup tx id ", info.TxID, " not before the writes, db at ", db.TxID)
+	}
+
+	backupPath := filepath.Join(dir, "backup")
+	err = ioutil.WriteFile(backupPath, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(backupPath, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, restored, before)
+	restored.Close()
+
+	full, err := db.BackupTo(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 4000; i < 4500; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Delete("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	incremental, err := db.IncrementalBackup(&buf, full.TxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incremental.Pages == 0 || incremental.Pages >= incremental.PageNums || int64(buf.Len()) != incremental.Bytes {
+		t.Fatalf("incremental backup of %d bytes, info %+v", buf.Len(), incremental)
+	}
+
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[len(corrupted)/2]++
+	_, err = ApplyIncrementalBackup(backupPath, bytes.NewReader(corrupted))
+	if err != ErrInvalidBackup {
+		t.Fatal("expect ErrInvalidBackup, got ", err)
+	}
+	var later bytes.Buffer
+	_, err = db.IncrementalBackup(&later, db.TxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApplyIncrementalBackup(backupPath, &later)
+	if err != ErrBackupGap {
+		t.Fatal("expect ErrBackupGap, got ", err)
+	}
+
+	_, err = ApplyIncrementalBackup(backupPath, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err = Open(backupPath, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	checkContent(t, restored, dumpDB(t, db))
+	if restored.TxID != db.TxID {
+		t.Fatal("restored tx id ", restored.TxID, ", expect ", db.TxID)
+	}
+}
@@ -0,0 +1,100 @@
+package go_kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errTrySolo tells a Batch caller that its function failed inside the
+// group and has to be run again in a transaction of its own.
+var errTrySolo = errors.New("batch function failed, run it alone")
+
+// Batch runs fn in a write transaction shared with other concurrent Batch
+// calls, so that a group of callers pays for a single Commit and fsync.
+// If fn returns an error the shared transaction is rolled back and rerun
+// without it, fn itself is then retried alone and its error returned.
+// A panic in fn counts as a failure, the retry alone panics in the caller.
+// fn may therefore run more than once and must not have side effects
+// outside of tx.
+func (db *DB) Batch(fn func(*Tx) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if db.batch == nil {
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.Options.MaxBatchDelay, db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, batchCall{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.Options.MaxBatchSize {
+		go db.batch.trigger() //full, no need to wait for the timer
+		db.batch = nil
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = db.Update(fn)
+	}
+	return err
+}
+
+type batch struct {
+	db    *DB
+	timer *time.Timer
+	start sync.Once
+	calls []batchCall
+}
+
+type batchCall struct {
+	fn  func(*Tx) error
+	err chan<- error
+}
+
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+	for len(b.calls) > 0 {
+		failed := -1
+		err := b.db.Update(func(tx *Tx) error {
+			for i, call := range b.calls {
+				err := safelyCall(call.fn, tx)
+				if err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, call := range b.calls {
+				call.err <- err
+			}
+			return
+		}
+
+		b.calls[failed].err <- errTrySolo
+		b.calls = append(b.calls[:failed], b.calls[failed+1:]...)
+	}
+}
+
+// safelyCall turns a panic of fn into an error so one caller can not take
+// down the whole batch.
+func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic in batch function: %v", p)
+		}
+	}()
+	return fn(tx)
+}
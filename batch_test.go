@@ -0,0 +1,94 @@
+package go_kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var syncs int64
+	newPager := func(file *os.File, options *Options) (Pager, error) {
+		pager, err := NewFilePager(file, options)
+		return &syncCountPager{Pager: pager, syncs: &syncs}, err
+	}
+	db, err := Open(filepath.Join(dir, "db"), &Options{NewPager: newPager, MaxBatchSize: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	atomic.StoreInt64(&syncs, 0)
+
+	errFail := errors.New("fail")
+	var wg sync.WaitGroup
+	errs := make([]error, 200)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				if p := recover(); p != nil { //retried alone outside of the batch
+					errs[i] = fmt.Errorf("%v", p)
+				}
+			}()
+			errs[i] = db.Batch(func(tx *Tx) error {
+				err := tx.Put(strconv.Itoa(i), strconv.Itoa(i))
+				if err != nil {
+					return err
+				}
+				if i%7 == 0 {
+					return errFail
+				}
+				if i == 100 {
+					panic("batch panic")
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		value, getErr := db.Get(strconv.Itoa(i))
+		switch {
+		case i%7 == 0:
+			if err != errFail || getErr != ErrKeyNotFound {
+				t.Fatal("failed call ", i, " returned ", err, ", key read ", getErr)
+			}
+		case i == 100:
+			if err == nil || getErr != ErrKeyNotFound {
+				t.Fatal("panicking call returned ", err, ", key read ", getErr)
+			}
+		default:
+			if err != nil || getErr != nil || value != strconv.Itoa(i) {
+				t.Fatal("call ", i, " returned ", err, ", key read ", value, getErr)
+			}
+		}
+	}
+	// every commit syncs the journal, the db file and the cleared journal
+	if commits := atomic.LoadInt64(&syncs) / 3; commits > 20 {
+		t.Fatal("200 batch calls took ", commits, " commits")
+	}
+}
+
+type syncCountPager struct {
+	Pager
+	syncs *int64
+}
+
+func (p *syncCountPager) Sync() error {
+	atomic.AddInt64(p.syncs, 1)
+	return p.Pager.Sync()
+}
@@ -0,0 +1,310 @@
+package go_kvstore
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotEmpty = errors.New("db is not empty")
+	ErrUnsorted = errors.New("bulk load keys are not in increasing order")
+)
+
+// KVIterator is the input of BulkLoad, *Iterator satisfies it.
+type KVIterator interface {
+	Next() bool
+	Key() string
+	Value() string
+	Err() error
+}
+
+// BulkLoad fills an empty db with the pairs of it, which must come in
+// strictly increasing key order. The tree is built bottom-up with the
+// pages packed to Options.FillFactor, instead of splitting its way there
+// one Write at a time. Nothing is visible until the whole input is loaded.
+func (db *DB) BulkLoad(it KVIterator) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	_, err = db.bulkLoad(it)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// bulkLoad returns the number of pairs loaded, the caller holds a write
+// transaction.
+func (db *DB) bulkLoad(it KVIterator) (uint64, error) {
+	root, err := db.ViewRoot()
+	if err != nil {
+		return 0, err
+	}
+	if root != nil || db.CurrentPageNums != RootPageID+1 {
+		return 0, ErrNotEmpty
+	}
+
+	builder := newTreeBuilder(db)
+	pairs, withPairs := it.(interface{ Pair() KVPair }) //keeps the expiry of the pairs of an Iterator
+	for it.Next() {
+		pair := KVPair{Key: it.Key(), Value: it.Value()}
+		if withPairs {
+			pair = pairs.Pair()
+		}
+		err = builder.Add(pair)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = it.Err()
+	if err != nil {
+		return 0, err
+	}
+	return builder.count, builder.Finish()
+}
+
+// changeFlushSize is how many puts the builder buffers for the change log.
+const changeFlushSize = 1024
+
+// treeBuilder builds a tree bottom-up from pairs given in increasing key
+// order, writing every finished page straight to the pager. It only keeps
+// two nodes per level in memory.
+//
+// Nodes are filled to target keys, the pair arriving at a full node becomes
+// the separator to the next node one level up. The last node of a level
+// may end up with fewer than Degree-1 keys, so each level holds back its
+// previous node until the end and Finish merges the two or splits them
+// evenly.
+type treeBuilder struct {
+	db     *DB
+	target int
+	levels []*buildLevel
+	last   string
+	count  uint64
+
+	archiveIDs   []uint64 //written pages not yet in the log archive
+	archivePages [][]byte
+	changes      []Change //puts not yet in the change log
+}
+
+type buildLevel struct {
+	cur     *Node
+	prev    *Node //finished but not yet handed to the level above
+	prevSep KVPair
+	pushed  bool //whether a node was handed to the level above
+}
+
+// newTreeBuilder builds into db, which must be empty. Pages are written
+// from db.CurrentPageNums on, the root goes to RootPageID on Finish.
+func newTreeBuilder(db *DB) *treeBuilder {
+	target := int(db.Options.FillFactor * float64(2*db.Degree-1))
+	if target < db.Degree-1 {
+		target = db.Degree - 1
+	}
+	return &treeBuilder{
+		db:     db,
+		target: target,
+	}
+}
+
+func (b *treeBuilder) level(l int) *buildLevel {
+	for len(b.levels) <= l {
+		b.levels = append(b.levels, &buildLevel{cur: NewNode(len(b.levels) == 0)})
+	}
+	return b.levels[l]
+}
+
+func (b *treeBuilder) Add(pair KVPair) error {
+	err := checkPairSize(pair)
+	if err != nil {
+		return err
+	}
+	if b.count > 0 && pair.Key <= b.last {
+		return ErrUnsorted
+	}
+	b.last = pair.Key
+	b.count++
+	if b.db.watched(pair.Key) {
+		b.db.recordWatchEvent(ChangePut, pair.Key, pair.Value, "", false)
+	}
+	if b.db.changeLog != nil {
+		b.changes = append(b.changes, Change{Op: ChangePut, Key: pair.Key, Value: pair.Value})
+		if len(b.changes) >= changeFlushSize {
+			err := b.flushChanges()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return b.addKey(0, pair)
+}
+
+func (b *treeBuilder) addKey(l int, pair KVPair) error {
+	lvl := b.level(l)
+	if len(lvl.cur.Datas) < b.target {
+		lvl.cur.Datas = append(lvl.cur.Datas, pair)
+		return nil
+	}
+
+	if lvl.prev != nil {
+		err := b.release(l)
+		if err != nil {
+			return err
+		}
+	}
+	lvl.prev, lvl.prevSep = lvl.cur, pair
+	lvl.cur = NewNode(l == 0)
+	return nil
+}
+
+func (b *treeBuilder) addChild(l int, id uint64) {
+	lvl := b.level(l)
+	lvl.cur.Children = append(lvl.cur.Children, id)
+}
+
+// release writes the previous node of level l and hands it with its
+// separator to the level above.
+func (b *treeBuilder) release(l int) error {
+	lvl := b.levels[l]
+	id, err := b.writeNode(lvl.prev)
+	if err != nil {
+		return err
+	}
+	lvl.prev = nil
+	lvl.pushed = true
+	b.addChild(l+1, id)
+	return b.addKey(l+1, lvl.prevSep)
+}
+
+func (b *treeBuilder) writeNode(node *Node) (uint64, error) {
+	db := b.db
+	node.ID = db.CurrentPageNums
+	db.CurrentPageNums++
+	if db.CurrentPageNums > db.Pager.Size() {
+		err := db.Extend()
+		if err != nil {
+			return 0, err
+		}
+	}
+	page, err := TreeNodeToBytes(node, db.PageSize)
+	if err != nil {
+		return 0, err
+	}
+	StampPage(page, db.TxID+1) //committed by Finish
+	db.unjournaled = true
+	if db.archive != nil {
+		b.archiveIDs = append(b.archiveIDs, node.ID)
+		b.archivePages = append(b.archivePages, page)
+		if len(b.archiveIDs) >= backupChunkPages {
+			err = b.flushArchive()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return node.ID, db.Pager.WritePage(node.ID, page)
+}
+
+// flushArchive appends the pages written so far to the log archive, they
+// bypass the journal the archive is otherwise fed from.
+func (b *treeBuilder) flushArchive() error {
+	if len(b.archiveIDs) == 0 {
+		return nil
+	}
+	err := b.db.archive.Append(b.db.TxID+1, time.Now().UnixNano(), b.archiveIDs, b.archivePages)
+	b.archiveIDs, b.archivePages = nil, nil
+	return err
+}
+
+// flushChanges appends the puts so far to the change log, instead of
+// keeping all of them for Commit.
+func (b *treeBuilder) flushChanges() error {
+	if len(b.changes) == 0 {
+		return nil
+	}
+	err := b.db.changeLog.Append(b.db.TxID+1, b.changes)
+	b.changes = nil
+	return err
+}
+
+// Finish writes the remaining nodes and commits the root.
+func (b *treeBuilder) Finish() error {
+	b.level(0)
+	for l := 0; l < len(b.levels); l++ {
+		lvl := b.levels[l]
+		nodes, seps := b.lastNodes(lvl)
+		if l == len(b.levels)-1 && !lvl.pushed && len(nodes) == 1 {
+			nodes[0].ID = RootPageID
+			if b.db.archive != nil {
+				err := b.flushArchive()
+				if err != nil {
+					return err
+				}
+			}
+			if b.db.changeLog != nil {
+				err := b.flushChanges()
+				if err != nil {
+					return err
+				}
+				err = b.db.sync(b.db.changeLog)
+				if err != nil {
+					return err
+				}
+			}
+			err := b.db.sync(b.db.Pager) //the pages the root points to go first
+			if err != nil {
+				return err
+			}
+			err = b.db.WriteDirtyPage(RootPageID, nodes[0])
+			if err != nil {
+				return err
+			}
+			return b.db.Commit()
+		}
+
+		for i, node := range nodes {
+			if i > 0 {
+				err := b.addKey(l+1, seps[i-1])
+				if err != nil {
+					return err
+				}
+			}
+			id, err := b.writeNode(node)
+			if err != nil {
+				return err
+			}
+			b.addChild(l+1, id)
+		}
+		lvl.pushed = true
+	}
+	return nil
+}
+
+// lastNodes returns the nodes left in lvl, merging or evenly splitting the
+// previous and current node if the current one is too small.
+func (b *treeBuilder) lastNodes(lvl *buildLevel) ([]*Node, []KVPair) {
+	if lvl.prev == nil {
+		return []*Node{lvl.cur}, nil
+	}
+	if len(lvl.cur.Datas) >= b.db.Degree-1 {
+		return []*Node{lvl.prev, lvl.cur}, []KVPair{lvl.prevSep}
+	}
+
+	datas := append(append(lvl.prev.Datas, lvl.prevSep), lvl.cur.Datas...)
+	children := append(lvl.prev.Children, lvl.cur.Children...)
+	if len(datas) <= 2*b.db.Degree-1 {
+		merged := NewNode(lvl.cur.IsLeaf)
+		merged.Datas, merged.Children = datas, children
+		return []*Node{merged}, nil
+	}
+
+	mid := (len(datas) - 1) / 2
+	left, right := NewNode(lvl.cur.IsLeaf), NewNode(lvl.cur.IsLeaf)
+	left.Datas, right.Datas = datas[:mid], datas[mid+1:]
+	if !lvl.cur.IsLeaf {
+		left.Children, right.Children = children[:mid+1], children[mid+1:]
+	}
+	return []*Node{left, right}, []KVPair{datas[mid]}
+}
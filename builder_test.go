@@ -0,0 +1,189 @@
+package go_kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTreeBuilder(t *testing.T) {
+	for _, pageSize := range []int{1024, 4096} {
+		for _, fillFactor := range []float64{0.5, 0.9, 1} {
+			for n := 0; n < 1500; n += 37 {
+				options, _ := (&Options{PageSize: pageSize, FillFactor: fillFactor}).withDefaults()
+				db := &DB{}
+				db.initPager(NewMemPager(pageSize), nil, options)
+
+				builder := newTreeBuilder(db)
+				for i := 0; i < n; i++ {
+					err := builder.Add(KVPair{Key: fmt.Sprintf("%06d", i), Value: fmt.Sprint(i)})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := builder.Finish()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				BtreeValidTest(t, db)
+				it, err := db.Iterator()
+				if err != nil {
+					t.Fatal(err)
+				}
+				i := 0
+				for it.Next() {
+					if it.Key() != fmt.Sprintf("%06d", i) || it.Value() != fmt.Sprint(i) {
+						t.Fatal("built tree content error at ", i)
+					}
+					i++
+				}
+				it.Close()
+				if i != n {
+					t.Fatal("built tree holds ", i, " keys, expect ", n)
+				}
+			}
+		}
+	}
+}
+
+// BtreeValidTest checks the ordering and B-tree invariants: every node but
+// the root holds Degree-1 to 2*Degree-1 keys, internal nodes have one
+// child more than keys and all leaves are at the same depth.
+func BtreeValidTest(t *testing.T, db *DB) {
+	BtreeStructureTest(t, db)
+	root, err := db.ViewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == nil {
+		return
+	}
+	leafDepth := -1
+	var check func(node *Node, depth int)
+	check = func(node *Node, depth int) {
+		if len(node.Datas) > 2*db.Degree-1 || (node.ID != RootPageID && len(node.Datas) < db.Degree-1) {
+			t.Fatal("node ", node.ID, " holds ", len(node.Datas), " keys with degree ", db.Degree)
+		}
+		if node.IsLeaf {
+			if leafDepth != -1 && leafDepth != depth {
+				t.Fatal("leaves at depth ", leafDepth, " and ", depth)
+			}
+			leafDepth = depth
+			return
+		}
+		if len(node.Children) != len(node.Datas)+1 {
+			t.Fatal("node ", node.ID, " has ", len(node.Children), " children for ", len(node.Datas), " keys")
+		}
+		for _, id := range node.Children {
+			child, err := db.ViewNodeFromID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(child, depth+1)
+		}
+	}
+	check(root, 0)
+}
+
+type sliceIterator struct {
+	pairs []KVPair
+	index int
+}
+
+func (it *sliceIterator) Next() bool {
+	it.index++
+	return it.index <= len(it.pairs)
+}
+func (it *sliceIterator) Key() string   { return it.pairs[it.index-1].Key }
+func (it *sliceIterator) Value() string { return it.pairs[it.index-1].Value }
+func (it *sliceIterator) Err() error    { return nil }
+
+func sortedPairs(n int) []KVPair {
+	pairs := make([]KVPair, n)
+	for i := range pairs {
+		pairs[i] = KVPair{Key: fmt.Sprintf("%08d", i), Value: fmt.Sprint(i)}
+	}
+	return pairs
+}
+
+func TestBulkLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsorted := sortedPairs(100)
+	unsorted[50], unsorted[51] = unsorted[51], unsorted[50]
+	err = db.BulkLoad(&sliceIterator{pairs: unsorted})
+	if err != ErrUnsorted {
+		t.Fatal("expect ErrUnsorted, got ", err)
+	}
+	if _, err = db.Get(unsorted[0].Key); err != ErrKeyNotFound {
+		t.Fatal("failed bulk load left ", err)
+	}
+
+	pairs := sortedPairs(20000)
+	err = db.BulkLoad(&sliceIterator{pairs: pairs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BulkLoad(&sliceIterator{pairs: pairs})
+	if err != ErrNotEmpty {
+		t.Fatal("expect ErrNotEmpty, got ", err)
+	}
+	db.Close()
+
+	db, err = Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	BtreeValidTest(t, db)
+	for i := 0; i < len(pairs); i += 97 {
+		value, err := db.Get(pairs[i].Key)
+		if err != nil || value != pairs[i].Value {
+			t.Fatal("get ", pairs[i].Key, " returns ", value, err)
+		}
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	pairs := sortedPairs(100000)
+	for i := 0; i < b.N; i++ {
+		db := NewMemDB()
+		err := db.BulkLoad(&sliceIterator{pairs: pairs})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSortedPut(b *testing.B) {
+	pairs := sortedPairs(100000)
+	for i := 0; i < b.N; i++ {
+		db := NewMemDB()
+		tx, err := db.Begin(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, pair := range pairs {
+			err = tx.Put(pair.Key, pair.Value)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
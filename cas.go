@@ -0,0 +1,202 @@
+package go_kvstore
+
+import (
+	"errors"
+	"time"
+)
+
+// Conditional writes check the pair they replace in the same descent that
+// writes the new one, see insertNonFull, so a compare-and-swap costs what a
+// Put costs. Expired pairs count as absent.
+//
+// Every write stamps the pair with the tx id of its commit as its version,
+// GetWithVersion reads it and PutIfVersion and DeleteIfVersion only write
+// if it did not change since. The version is kept in the key slot, keys
+// longer than MaxVersionedKeySize have none.
+
+var (
+	// ErrKeyTooLong is returned for keys longer than the key slot, and by
+	// the version and history calls for keys longer than
+	// MaxVersionedKeySize.
+	ErrKeyTooLong = errors.New("key too long")
+	// errConditionFailed stops a conditional write, the calls report it
+	// as false.
+	errConditionFailed = errors.New("write condition failed")
+)
+
+const (
+	// versionFlag marks a key length followed by a version, see
+	// TreeNodeToBytes.
+	versionFlag = 0x8000
+	// MaxVersionedKeySize is the longest key with a version, the rest of
+	// the key slot holds it.
+	MaxVersionedKeySize = maxKeySize - 8
+)
+
+// CompareAndSwap sets key to new if its value is old, it reports whether
+// it did.
+func (db *DB) CompareAndSwap(key, old, new string) (bool, error) {
+	return db.conditional(func(tx *Tx) (bool, error) {
+		return tx.CompareAndSwap(key, old, new)
+	})
+}
+
+// PutIfAbsent writes key if it does not exist, it reports whether it did.
+func (db *DB) PutIfAbsent(key, value string) (bool, error) {
+	return db.conditional(func(tx *Tx) (bool, error) {
+		return tx.PutIfAbsent(key, value)
+	})
+}
+
+// DeleteIfEquals deletes key if its value is value, it reports whether it
+// did.
+func (db *DB) DeleteIfEquals(key, value string) (bool, error) {
+	return db.conditional(func(tx *Tx) (bool, error) {
+		return tx.DeleteIfEquals(key, value)
+	})
+}
+
+// PutIfVersion writes key if its version is version, 0 for a key that
+// does not exist. It reports whether it did.
+func (db *DB) PutIfVersion(key, value string, version uint64) (bool, error) {
+	return db.conditional(func(tx *Tx) (bool, error) {
+		return tx.PutIfVersion(key, value, version)
+	})
+}
+
+// DeleteIfVersion deletes key if its version is version, it reports
+// whether it did.
+func (db *DB) DeleteIfVersion(key string, version uint64) (bool, error) {
+	return db.conditional(func(tx *Tx) (bool, error) {
+		return tx.DeleteIfVersion(key, version)
+	})
+}
+
+// GetWithVersion returns the value of key and its version.
+func (db *DB) GetWithVersion(key string) (string, uint64, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	return tx.GetWithVersion(key)
+}
+
+// conditional runs fn in a write transaction, committed if its condition
+// held.
+func (db *DB) conditional(fn func(tx *Tx) (bool, error)) (bool, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	ok, err := fn(tx)
+	if err != nil || !ok {
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tx *Tx) GetWithVersion(key string) (string, uint64, error) {
+	if tx.closed {
+		return "", 0, ErrTxClosed
+	}
+	pair, err := tx.db.readPair(key)
+	if err == nil && pair.expired(time.Now().UnixNano()) {
+		err = ErrKeyNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return pair.Value, pair.Version, nil
+}
+
+func (tx *Tx) CompareAndSwap(key, old, new string) (bool, error) {
+	return tx.putIf(key, new, func(pair KVPair, found bool) bool {
+		return found && pair.Value == old
+	})
+}
+
+func (tx *Tx) PutIfAbsent(key, value string) (bool, error) {
+	return tx.putIf(key, value, func(pair KVPair, found bool) bool {
+		return !found
+	})
+}
+
+func (tx *Tx) DeleteIfEquals(key, value string) (bool, error) {
+	return tx.deleteIf(key, func(pair KVPair) bool {
+		return pair.Value == value
+	})
+}
+
+func (tx *Tx) PutIfVersion(key, value string, version uint64) (bool, error) {
+	if len(key) > MaxVersionedKeySize {
+		return false, ErrKeyTooLong
+	}
+	return tx.putIf(key, value, func(pair KVPair, found bool) bool {
+		if version == 0 {
+			return !found
+		}
+		return found && pair.Version == version
+	})
+}
+
+func (tx *Tx) DeleteIfVersion(key string, version uint64) (bool, error) {
+	if len(key) > MaxVersionedKeySize {
+		return false, ErrKeyTooLong
+	}
+	return tx.deleteIf(key, func(pair KVPair) bool {
+		return pair.Version == version
+	})
+}
+
+// putIf writes key if check passes on the pair it replaces, found is false
+// if there is none.
+func (tx *Tx) putIf(key, value string, check func(pair KVPair, found bool) bool) (bool, error) {
+	if tx.closed {
+		return false, ErrTxClosed
+	}
+	if !tx.writable {
+		return false, ErrTxNotWritable
+	}
+	now := time.Now().UnixNano()
+	err := tx.db.writePair(KVPair{Key: key, Value: value}, func(pair *KVPair, old KVPair, found bool) error {
+		if found && old.expired(now) {
+			old, found = KVPair{}, false
+		}
+		if !check(old, found) {
+			return errConditionFailed
+		}
+		return nil
+	})
+	if err == errConditionFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteIf deletes key if it exists and check passes on its pair.
+func (tx *Tx) deleteIf(key string, check func(pair KVPair) bool) (bool, error) {
+	if tx.closed {
+		return false, ErrTxClosed
+	}
+	if !tx.writable {
+		return false, ErrTxNotWritable
+	}
+	now := time.Now().UnixNano()
+	err := tx.db.removeIf(key, func(pair KVPair) error {
+		if pair.expired(now) || !check(pair) {
+			return errConditionFailed
+		}
+		return nil
+	})
+	if err == ErrKeyNotFound || err == errConditionFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
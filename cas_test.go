@@ -0,0 +1,234 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cas")
+	options := &Options{PageSize: 1024}
+
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//enough keys for the conditions to be checked in internal nodes and
+	//across splits
+	expect := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := strconv.Itoa(i)
+		ok, err := db.PutIfAbsent(key, "a"+key)
+		if err != nil || !ok {
+			t.Fatal("put if absent returned ", ok, err)
+		}
+		expect[key] = "a" + key
+	}
+	for i := 0; i < 300; i++ {
+		key := strconv.Itoa(i)
+		ok, err := db.PutIfAbsent(key, "b")
+		if err != nil || ok {
+			t.Fatal("put if absent overwrote ", key, " ", err)
+		}
+		ok, err = db.CompareAndSwap(key, "b", "c")
+		if err != nil || ok {
+			t.Fatal("swapped a different value of ", key, " ", err)
+		}
+		if i%2 == 0 {
+			ok, err = db.CompareAndSwap(key, "a"+key, "c"+key)
+			if err != nil || !ok {
+				t.Fatal("compare and swap returned ", ok, err)
+			}
+			expect[key] = "c" + key
+		}
+	}
+	checkContent(t, db, expect)
+	ok, err := db.CompareAndSwap("missing", "", "x")
+	if err != nil || ok {
+		t.Fatal("swapped a missing key ", err)
+	}
+	ok, err = db.DeleteIfEquals("1", "c1")
+	if err != nil || ok {
+		t.Fatal("deleted a different value ", err)
+	}
+	ok, err = db.DeleteIfEquals("1", "a1")
+	if err != nil || !ok {
+		t.Fatal("delete if equals returned ", ok, err)
+	}
+	delete(expect, "1")
+	ok, err = db.DeleteIfEquals("1", "a1")
+	if err != nil || ok {
+		t.Fatal("deleted a missing key ", err)
+	}
+	checkContent(t, db, expect)
+	//a failed condition leaves the tree whole after the merges on the
+	//way down, in internal nodes and at the root
+	for i := 100; i < 300; i++ {
+		key := strconv.Itoa(i)
+		ok, err = db.DeleteIfEquals(key, "x")
+		if err != nil || ok {
+			t.Fatal("deleted a different value of ", key, " ", err)
+		}
+		if i%3 == 0 {
+			ok, err = db.DeleteIfEquals(key, expect[key])
+			if err != nil || !ok {
+				t.Fatal("delete if equals of ", key, " returned ", ok, err)
+			}
+			delete(expect, key)
+		}
+	}
+	checkContent(t, db, expect)
+
+	//every commit gives the pairs it writes a new version
+	_, version, err := db.GetWithVersion("2")
+	if err != nil || version == 0 {
+		t.Fatal("get with version returned ", version, err)
+	}
+	ok, err = db.PutIfVersion("2", "d", version+1)
+	if err != nil || ok {
+		t.Fatal("put with a wrong version ", err)
+	}
+	ok, err = db.PutIfVersion("2", "d", version)
+	if err != nil || !ok {
+		t.Fatal("put if version returned ", ok, err)
+	}
+	_, newVersion, err := db.GetWithVersion("2")
+	if err != nil || newVersion <= version {
+		t.Fatal("version did not change ", newVersion, err)
+	}
+	ok, err = db.PutIfVersion("2", "e", version)
+	if err != nil || ok {
+		t.Fatal("put with a stale version ", err)
+	}
+	ok, err = db.PutIfVersion("new", "value", 0)
+	if err != nil || !ok {
+		t.Fatal("put if version 0 returned ", ok, err)
+	}
+	ok, err = db.DeleteIfVersion("2", version)
+	if err != nil || ok {
+		t.Fatal("deleted with a stale version ", err)
+	}
+	ok, err = db.DeleteIfVersion("2", newVersion)
+	if err != nil || !ok {
+		t.Fatal("delete if version returned ", ok, err)
+	}
+	long := strings.Repeat("k", MaxVersionedKeySize+1)
+	err = db.Put(long, "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, err = db.GetWithVersion(long)
+	if err != nil || version != 0 {
+		t.Fatal("long key has version ", version, err)
+	}
+	if _, err = db.PutIfVersion(long, "value", 0); err != ErrKeyTooLong {
+		t.Fatal("version condition on a long key returned ", err)
+	}
+	delete(expect, "2")
+	expect["new"] = "value"
+	expect[long] = "value"
+
+	//expired pairs count as absent
+	err = db.PutWithTTL("ttl", "old", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	ok, err = db.CompareAndSwap("ttl", "old", "x")
+	if err != nil || ok {
+		t.Fatal("swapped an expired value ", err)
+	}
+	ok, err = db.PutIfAbsent("ttl", "new")
+	if err != nil || !ok {
+		t.Fatal("put if absent over an expired key returned ", ok, err)
+	}
+	expect["ttl"] = "new"
+
+	//in a transaction a failed condition leaves the other writes alone
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put("tx", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = tx.PutIfAbsent("0", "x")
+	if err != nil || ok {
+		t.Fatal("put if absent in a tx returned ", ok, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect["tx"] = "value"
+
+	//versions survive a compaction and a reopen
+	_, version, err = db.GetWithVersion("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContent(t, db, expect)
+	_, reopened, err := db.GetWithVersion("new")
+	if err != nil || reopened != version {
+		t.Fatal("version after reopen ", reopened, " expect ", version, err)
+	}
+
+	//concurrent increments through compare and swap lose no update
+	err = db.Put("counter", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 25; {
+				value, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count, _ := strconv.Atoi(value)
+				ok, err := db.CompareAndSwap("counter", value, strconv.Itoa(count+1))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	value, err := db.Get("counter")
+	if err != nil || value != "100" {
+		t.Fatal("counter is ", value, err)
+	}
+}
@@ -0,0 +1,389 @@
+package go_kvstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The change log keeps the Put and Delete calls of every commit in commit
+// order, for Subscribe to follow. It is written before the journal, so a
+// commit that survives a crash always has its changes logged. Records of
+// a commit that did not make it are cut off on the next open.
+//
+// record: tx id(8) | payload length(4) | payload | crc32 of the record(4)
+// payload: changes of op(1) | key length(2) | key | value length(2) | value
+//
+// BulkLoad writes the puts of its single commit in several records ahead
+// of the commit, they are only followed once the commit is done.
+//
+// Once the log holds more than twice Options.ChangeLogRetention bytes, a
+// commit rewrites it without its oldest commits. The new file starts with
+// a record without changes carrying the tx id of the last commit dropped.
+// Offsets into the log count the bytes dropped since the open, so a
+// follower goes on after a trim, or ends if its next record was dropped.
+
+var (
+	ErrChangeLogDisabled = errors.New("change log is not enabled, see Options.ChangeLog")
+	// ErrChangesTrimmed is returned by Subscribe for a commit whose
+	// changes were already dropped from the log.
+	ErrChangesTrimmed = errors.New("changes already trimmed from the change log")
+)
+
+const changeRecordHeaderSize = 12
+
+type ChangeOp byte
+
+const (
+	ChangePut ChangeOp = iota + 1
+	ChangeDelete
+)
+
+// Change is a committed Put or Delete. Value is empty for deletes.
+type Change struct {
+	TxID  uint64
+	Op    ChangeOp
+	Key   string
+	Value string
+}
+
+type changeLog struct {
+	fileName string
+
+	mu            sync.RWMutex //guards the fields below, writes to file come from the writer alone
+	file          *os.File
+	base          int64 //offset of the first byte of file
+	start         int64 //offset of the first record that can be followed
+	size          int64 //offset of the end of file
+	committedSize int64 //offset of the end of the last commit
+	index         []changeIndexEntry
+	trimmedTo     uint64        //tx id of the last commit dropped from the log
+	committed     uint64        //tx id of the last commit whose changes can be followed
+	notify        chan struct{} //closed and replaced on every commit
+	closed        bool
+}
+
+// changeIndexEntry is the offset of the first record of a commit.
+type changeIndexEntry struct {
+	txID   uint64
+	offset int64
+}
+
+// openChangeLog opens the change log of fileName and drops the records
+// beyond txID, the last commit of the db.
+func openChangeLog(fileName string, txID uint64) (*changeLog, error) {
+	file, err := os.OpenFile(fileName+"-changes", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &changeLog{
+		fileName:  fileName + "-changes",
+		file:      file,
+		committed: txID,
+		notify:    make(chan struct{}),
+	}
+	for {
+		rec, next, err := l.readRecord(l.size)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if rec == nil || rec.txID > txID {
+			break
+		}
+		if len(rec.changes) == 0 { //left by a trim
+			l.trimmedTo = rec.txID
+			l.start = next
+		} else {
+			l.addIndex(rec.txID, l.size)
+		}
+		l.size = next
+	}
+	err = file.Truncate(l.size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.committedSize = l.size
+	return l, nil
+}
+
+func (l *changeLog) addIndex(txID uint64, offset int64) {
+	if len(l.index) == 0 || l.index[len(l.index)-1].txID != txID {
+		l.index = append(l.index, changeIndexEntry{txID: txID, offset: offset})
+	}
+}
+
+func (l *changeLog) Append(txID uint64, changes []Change) error {
+	record := encodeChangeRecord(txID, changes)
+	_, err := l.file.WriteAt(record, l.size-l.base)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.addIndex(txID, l.size)
+	l.size += int64(len(record))
+	l.mu.Unlock()
+	return nil
+}
+
+func encodeChangeRecord(txID uint64, changes []Change) []byte {
+	payloadSize := 0
+	for _, change := range changes {
+		payloadSize += 5 + len(change.Key) + len(change.Value)
+	}
+	record := make([]byte, changeRecordHeaderSize+payloadSize+4)
+	binary.BigEndian.PutUint64(record[0:8], txID)
+	binary.BigEndian.PutUint32(record[8:12], uint32(payloadSize))
+	ptr := changeRecordHeaderSize
+	for _, change := range changes {
+		record[ptr] = byte(change.Op)
+		binary.BigEndian.PutUint16(record[ptr+1:], uint16(len(change.Key)))
+		ptr += 3
+		ptr += copy(record[ptr:], change.Key)
+		binary.BigEndian.PutUint16(record[ptr:], uint16(len(change.Value)))
+		ptr += 2
+		ptr += copy(record[ptr:], change.Value)
+	}
+	binary.BigEndian.PutUint32(record[ptr:], crc32.ChecksumIEEE(record[:ptr]))
+	return record
+}
+
+// Truncate drops the records of a failed commit.
+func (l *changeLog) Truncate(size int64) error {
+	l.mu.Lock()
+	l.size = size
+	for len(l.index) > 0 && l.index[len(l.index)-1].offset >= size {
+		l.index = l.index[:len(l.index)-1]
+	}
+	l.mu.Unlock()
+	return l.file.Truncate(size - l.base)
+}
+
+// trim drops the oldest commits once the log holds more than twice
+// retention bytes, keeping the commits of the last retention bytes or
+// more. Called by the writer after a commit.
+func (l *changeLog) trim(retention int64) error {
+	if retention < 0 || l.size-l.start <= 2*retention {
+		return nil
+	}
+	i := sort.Search(len(l.index), func(i int) bool {
+		return l.index[i].offset > l.size-retention
+	}) - 1
+	if i <= 0 {
+		return nil
+	}
+	keep := l.index[i].offset
+	marker := encodeChangeRecord(l.index[i-1].txID, nil)
+
+	tmpName := l.fileName + ".trim"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(marker)
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(l.file, keep-l.base, l.size-keep))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, l.fileName)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = tmp
+	l.base = keep - int64(len(marker))
+	l.start = keep
+	l.trimmedTo = l.index[i-1].txID
+	l.index = append([]changeIndexEntry(nil), l.index[i:]...)
+	l.mu.Unlock()
+	return old.Close()
+}
+
+func (l *changeLog) Sync() error {
+	return l.file.Sync()
+}
+
+// publish makes the changes up to txID visible to the followers.
+func (l *changeLog) publish(txID uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.committed = txID
+	l.committedSize = l.size
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// state returns the last followable commit and a channel closed on the
+// next one.
+func (l *changeLog) state() (uint64, <-chan struct{}, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.committed, l.notify, l.closed
+}
+
+// seek returns the offset of the first record of the first commit from
+// fromTxID on.
+func (l *changeLog) seek(fromTxID uint64) (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.trimmedTo > 0 && fromTxID <= l.trimmedTo {
+		return 0, ErrChangesTrimmed
+	}
+	i := sort.Search(len(l.index), func(i int) bool {
+		return l.index[i].txID >= fromTxID
+	})
+	if i == len(l.index) {
+		return l.committedSize, nil
+	}
+	return l.index[i].offset, nil
+}
+
+func (l *changeLog) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.mu.Unlock()
+	return l.file.Close()
+}
+
+type changeRecord struct {
+	txID    uint64
+	changes []Change
+}
+
+// next returns the record at offset for a follower, errChangesTrimmed
+// if it was dropped.
+func (l *changeLog) next(offset int64) (*changeRecord, int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if offset < l.start {
+		return nil, offset, ErrChangesTrimmed
+	}
+	return l.readRecord(offset)
+}
+
+// readRecord returns the record at offset and the offset of the next one,
+// nil if there is no complete record there.
+func (l *changeLog) readRecord(offset int64) (*changeRecord, int64, error) {
+	header := make([]byte, changeRecordHeaderSize)
+	_, err := l.file.ReadAt(header, offset-l.base)
+	if err == io.EOF {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	payloadSize := int(binary.BigEndian.Uint32(header[8:12]))
+	body := make([]byte, payloadSize+4)
+	_, err = l.file.ReadAt(body, offset-l.base+changeRecordHeaderSize)
+	if err == io.EOF {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header)
+	checksum.Write(body[:payloadSize])
+	if checksum.Sum32() != binary.BigEndian.Uint32(body[payloadSize:]) {
+		return nil, offset, nil
+	}
+
+	rec := &changeRecord{txID: binary.BigEndian.Uint64(header[0:8])}
+	payload := body[:payloadSize]
+	for len(payload) > 0 {
+		change := Change{TxID: rec.txID, Op: ChangeOp(payload[0])}
+		keyLen := int(binary.BigEndian.Uint16(payload[1:3]))
+		change.Key = string(payload[3 : 3+keyLen])
+		payload = payload[3+keyLen:]
+		valueLen := int(binary.BigEndian.Uint16(payload[0:2]))
+		change.Value = string(payload[2 : 2+valueLen])
+		payload = payload[2+valueLen:]
+		rec.changes = append(rec.changes, change)
+	}
+	return rec, offset + changeRecordHeaderSize + int64(payloadSize) + 4, nil
+}
+
+// recordChange remembers a Put or Delete for the next Commit.
+func (db *DB) recordChange(op ChangeOp, key, value string) {
+	if db.changeLog != nil {
+		db.pendingChanges = append(db.pendingChanges, Change{Op: op, Key: key, Value: value})
+	}
+}
+
+// Subscribe follows the committed changes from the commit fromTxID on,
+// see SubscribeContext.
+func (db *DB) Subscribe(fromTxID uint64) (<-chan Change, error) {
+	return db.SubscribeContext(context.Background(), fromTxID)
+}
+
+// SubscribeContext returns a channel of the changes of every commit from
+// fromTxID on, in commit order. Consumers resume after a restart by
+// subscribing from the tx id after the last change they handled. The
+// channel is closed when ctx is done or the db is closed, a slow consumer
+// does not hold up commits. It is also closed if the consumer falls so far
+// behind that its next changes are trimmed, a new Subscribe from there
+// returns ErrChangesTrimmed.
+func (db *DB) SubscribeContext(ctx context.Context, fromTxID uint64) (<-chan Change, error) {
+	if db.changeLog == nil {
+		return nil, ErrChangeLogDisabled
+	}
+	offset, err := db.changeLog.seek(fromTxID)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Change)
+	go db.changeLog.follow(ctx, offset, fromTxID, ch)
+	return ch, nil
+}
+
+func (l *changeLog) follow(ctx context.Context, offset int64, fromTxID uint64, ch chan<- Change) {
+	defer close(ch)
+	for {
+		committed, notify, closed := l.state()
+		if closed {
+			return
+		}
+		for {
+			rec, next, err := l.next(offset)
+			if err == ErrChangesTrimmed {
+				return
+			}
+			if err != nil || rec == nil || rec.txID > committed {
+				break
+			}
+			offset = next
+			if rec.txID < fromTxID {
+				continue
+			}
+			for _, change := range rec.changes {
+				select {
+				case ch <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package go_kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan Change, n int) []Change {
+	var changes []Change
+	for len(changes) < n {
+		select {
+		case change, ok := <-ch:
+			if !ok {
+				t.Fatal("change stream closed after ", len(changes), " changes")
+			}
+			changes = append(changes, change)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout after ", len(changes), " changes")
+		}
+	}
+	return changes
+}
+
+func TestSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	_, err = NewMemDB().Subscribe(0)
+	if err != ErrChangeLogDisabled {
+		t.Fatal("expect ErrChangeLogDisabled, got ", err)
+	}
+
+	db, err := Open(fileName, &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BulkLoad(&sliceIterator{pairs: sortedPairs(3000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	live, err := db.SubscribeContext(ctx, db.TxID+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Put("a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Put("rolled", "back")
+	tx.Rollback()
+	err = db.Update(func(tx *Tx) error {
+		err := tx.Put("b", "2")
+		if err != nil {
+			return err
+		}
+		return tx.Delete("a")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Delete("missing") != ErrKeyNotFound {
+		t.Fatal("delete of a missing key succeeded")
+	}
+
+	expect := []Change{
+		{TxID: 2, Op: ChangePut, Key: "a", Value: "1"},
+		{TxID: 3, Op: ChangePut, Key: "b", Value: "2"},
+		{TxID: 3, Op: ChangeDelete, Key: "a"},
+	}
+	changes := receive(t, live, len(expect))
+	for i := range expect {
+		if changes[i] != expect[i] {
+			t.Fatalf("change %d is %+v, expect %+v", i, changes[i], expect[i])
+		}
+	}
+	cancel()
+	for range live { //closed once the context is done
+	}
+
+	all, err := db.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = receive(t, all, 3000+len(expect))
+	for i, pair := range sortedPairs(3000) {
+		if changes[i] != (Change{TxID: 1, Op: ChangePut, Key: pair.Key, Value: pair.Value}) {
+			t.Fatalf("bulk load change %d is %+v", i, changes[i])
+		}
+	}
+	db.Close()
+	if _, ok := <-all; ok {
+		t.Fatal("change stream still open after Close")
+	}
+
+	// a commit cut off by a crash after writing its changes is dropped
+	file, err := os.OpenFile(fileName+"-changes", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := &changeLog{file: file}
+	orphan.size, _ = file.Seek(0, 2)
+	orphan.Append(4, []Change{{Op: ChangePut, Key: "lost"}})
+	file.Close()
+
+	db, err = Open(fileName, &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		err = db.Put("after"+strconv.Itoa(i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resumed, err := db.Subscribe(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range receive(t, resumed, 10) {
+		if change.TxID != uint64(4+i) || change.Key != "after"+strconv.Itoa(i) {
+			t.Fatalf("resumed change %d is %+v", i, change)
+		}
+	}
+}
+
+func TestSubscribeFailedCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	//the commit fails while writing its journal, after its changes are logged
+	injector := NewFaultInjector(0)
+	db := &DB{}
+	err = db.InitWithOptions(fileName, &Options{ChangeLog: true, NewPager: injector.Wrap(NewFilePager)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("kept", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txID := db.TxID
+	injector.FailAfter(1)
+	if db.Put("lost", "1") != ErrInjectedFault {
+		t.Fatal("commit did not fail")
+	}
+	if db.Put("after", "1") != ErrCommitFailed {
+		t.Fatal("db committed after a failed commit")
+	}
+	injector.Crash()
+	db.Close()
+
+	db, err = Open(fileName, &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.TxID != txID {
+		t.Fatal("failed commit survived the reopen")
+	}
+	err = db.Put("next", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := db.Subscribe(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := receive(t, ch, 2)
+	if changes[0].Key != "kept" || changes[1] != (Change{TxID: txID + 1, Op: ChangePut, Key: "next", Value: "2"}) {
+		t.Fatal("changes after the failed commit are ", changes)
+	}
+}
+
+func TestChangeLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, &Options{ChangeLog: true, ChangeLogRetention: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stalled, err := db.SubscribeContext(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := db.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := string(make([]byte, 50))
+	for i := 0; i < 200; i++ {
+		err = db.Put("k"+strconv.Itoa(i), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change := receive(t, live, 1)[0]
+		if change.Key != "k"+strconv.Itoa(i) {
+			t.Fatal("live change ", i, " is ", change)
+		}
+	}
+	info, err := os.Stat(fileName + "-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2000+100 {
+		t.Fatal("change log holds ", info.Size(), " bytes")
+	}
+	received := 0
+	for range stalled { //its next changes were trimmed, closed
+		received++
+	}
+	if received >= 200 {
+		t.Fatal("stalled subscriber got all changes")
+	}
+	_, err = db.Subscribe(1)
+	if err != ErrChangesTrimmed {
+		t.Fatal("expect ErrChangesTrimmed, got ", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(fileName, &Options{ChangeLog: true, ChangeLogRetention: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Subscribe(1)
+	if err != ErrChangesTrimmed {
+		t.Fatal("trim forgotten on reopen, got ", err)
+	}
+	ch, err := db.Subscribe(190)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range receive(t, ch, 11) {
+		if change.TxID != uint64(190+i) || change.Key != "k"+strconv.Itoa(189+i) {
+			t.Fatal("change ", i, " after reopen is ", change)
+		}
+	}
+}
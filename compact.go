@@ -0,0 +1,190 @@
+package go_kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// errFileReplaced is returned by initFile when the db file was renamed
+// over, by CompactInPlace, while waiting for its lock.
+var errFileReplaced = errors.New("db file was replaced")
+
+// CompactStats describes a finished compaction, sizes are in bytes.
+type CompactStats struct {
+	Pairs     uint64
+	SrcSize   int64
+	DstSize   int64
+	Reclaimed int64
+}
+
+// Compact writes the content of db into a new file at dstPath, with the
+// pages packed to Options.FillFactor and no dead pages. db stays usable,
+// writers wait until the copy is done.
+func (db *DB) Compact(dstPath string) (CompactStats, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return CompactStats{}, err
+	}
+	defer tx.Rollback()
+
+	return db.compactTo(tx, dstPath)
+}
+
+// CompactInPlace compacts db into a temporary file and renames it over the
+// db file. Other processes blocked on the lock of the old file reopen the
+// new one once they get it.
+//
+// The commit of the new file is not in the log archive, so Restore from a
+// backup taken before CompactInPlace stops there with ErrBackupGap. Take a
+// new full backup once it is done.
+func (db *DB) CompactInPlace() (CompactStats, error) {
+	tx, err := db.beginExclusive() //the file is swapped under the other readers
+	if err != nil {
+		return CompactStats{}, err
+	}
+	defer tx.Rollback()
+	if db.File == nil {
+		return CompactStats{}, errors.New("in-memory db can not be compacted in place")
+	}
+	if db.Options.ReadOnly {
+		return CompactStats{}, ErrReadOnly
+	}
+	if len(db.backups) > 0 { //page ids change meaning with the new file
+		return CompactStats{}, ErrBackupInProgress
+	}
+
+	tmpPath := db.FileName + ".compact"
+	err = removeFiles(tmpPath, tmpPath+"-journal", LockFileName(tmpPath)) //left by a crashed compaction
+	if err != nil {
+		return CompactStats{}, err
+	}
+	stats, err := db.compactTo(tx, tmpPath)
+	if err != nil {
+		removeFiles(tmpPath, tmpPath+"-journal")
+		return stats, err
+	}
+	err = db.swapFile(tmpPath)
+	if err != nil {
+		removeFiles(tmpPath, tmpPath+"-journal")
+		return stats, err
+	}
+	return stats, os.Remove(tmpPath + "-journal")
+}
+
+// compactTo bulk loads the pairs seen by tx into a new db at dstPath and
+// truncates the file to the pages in use.
+func (db *DB) compactTo(tx *Tx, dstPath string) (CompactStats, error) {
+	options := *db.Options
+	options.ReadOnly = false
+	options.LockTimeout = -1
+	options.InitialMmapSize = 0
+	options.LogArchiveDir = "" //the archive belongs to the source
+	options.ChangeLog = false  //so does the change log
+	options.ExpirySweepInterval = -1
+	dst, err := Open(dstPath, &options)
+	if err != nil {
+		return CompactStats{}, err
+	}
+	dst.TxID = db.TxID //the compacted file goes on with the next commit
+	it, err := tx.Iterator()
+	if err != nil {
+		dst.Close()
+		return CompactStats{}, err
+	}
+	defer it.Close()
+	it.withHistory = true
+	dstTx, err := dst.Begin(true)
+	if err != nil {
+		dst.Close()
+		return CompactStats{}, err
+	}
+	pairs, err := dst.bulkLoad(it)
+	if err != nil {
+		dstTx.Rollback()
+	} else {
+		err = dstTx.Commit()
+	}
+	pageNums := dst.MetaPageNums
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	stats := CompactStats{
+		Pairs:   pairs,
+		SrcSize: int64(db.Pager.Size()) * int64(db.PageSize),
+		DstSize: int64(pageNums) * int64(db.PageSize),
+	}
+	stats.Reclaimed = stats.SrcSize - stats.DstSize
+	return stats, os.Truncate(dstPath, stats.DstSize)
+}
+
+// swapFile renames path over the db file and reopens the pager on it. The
+// new file is complete before the rename, read only dbs of other processes
+// move to it in their next transaction. The journal, and with it the lock
+// of the writer, is clean outside of Commit and is kept. The directory is
+// synced last, a commit on the new file must not come back as the old
+// one after a crash.
+func (db *DB) swapFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, db.FileName)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = db.Pager.Close()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	db.File.Close()
+	db.File = file
+	pager, err := db.Options.NewPager(file, db.Options)
+	if err != nil {
+		return err
+	}
+	err = db.initPager(pager, db.Journal, db.Options)
+	if err != nil {
+		return err
+	}
+	if db.sweepStop != nil { //the new file may hold other expiring keys
+		db.expiries = nil
+		db.expiryScanPending = true
+	}
+	if db.onCommit != nil { //every page moved, no delta describes that
+		db.onCommit(db.TxID, nil, nil, false)
+	}
+	return syncFile(filepath.Dir(db.FileName)) //makes the rename durable
+}
+
+// fileReplaced reports whether db.File is no longer the file at
+// db.FileName.
+func (db *DB) fileReplaced() (bool, error) {
+	opened, err := db.File.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(db.FileName)
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(opened, current), nil
+}
+
+func removeFiles(paths ...string) error {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sparseDB fills a db with n keys and deletes all but every tenth.
+func sparseDB(t *testing.T, db *DB, n int) map[string]string {
+	kept := make(map[string]string)
+	for i := 0; i < n; i++ {
+		err := db.Put(strconv.Itoa(i), strconv.Itoa(i*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			kept[strconv.Itoa(i)] = strconv.Itoa(i * i)
+			continue
+		}
+		err := db.Delete(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kept
+}
+
+func checkContent(t *testing.T, db *DB, kvs map[string]string) {
+	BtreeValidTest(t, db)
+	it, err := db.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for it.Next() {
+		if kvs[it.Key()] != it.Value() {
+			t.Fatal("unexpected pair ", it.Key(), " ", it.Value())
+		}
+		count++
+	}
+	if count != len(kvs) {
+		t.Fatal("db holds ", count, " pairs, expect ", len(kvs))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db"), &Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvs := sparseDB(t, db, 5000)
+
+	dstPath := filepath.Join(dir, "compacted")
+	stats, err := db.Compact(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Pairs != uint64(len(kvs)) || stats.Reclaimed <= 0 || stats.Reclaimed != stats.SrcSize-stats.DstSize {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != stats.DstSize {
+		t.Fatal("compacted file has ", info.Size(), " bytes, stats report ", stats.DstSize)
+	}
+
+	dst, err := Open(dstPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.PageSize != 1024 {
+		t.Fatal("compacted page size ", dst.PageSize)
+	}
+	checkContent(t, dst, kvs)
+	err = dst.Put("new", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs["new"] = "value"
+	checkContent(t, dst, kvs)
+	dst.Close()
+
+	_, err = db.Compact(dstPath)
+	if err != ErrNotEmpty {
+		t.Fatal("expect ErrNotEmpty, got ", err)
+	}
+}
+
+func TestCompactInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := sparseDB(t, db, 3000)
+
+	// blocked on the lock of the old file, must end up on the new one
+	opened := make(chan *DB)
+	go func() {
+		other, err := Open(fileName, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- other
+	}()
+	time.Sleep(2 * lockRetryInterval)
+
+	stats, err := db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Reclaimed <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	checkContent(t, db, kvs)
+	for i := 0; i < 100; i++ {
+		err = db.Put("after"+strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kvs["after"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	checkContent(t, db, kvs)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fileName + ".compact"); !os.IsNotExist(err) {
+		t.Fatal("temporary file left behind")
+	}
+
+	other := <-opened
+	if other == nil {
+		return
+	}
+	checkContent(t, other, kvs)
+	other.Close()
+}
@@ -0,0 +1,246 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCrashDuringCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	baseName := filepath.Join(dir, "base")
+	crashName := filepath.Join(dir, "crash")
+
+	before := make(map[string]string)
+	db := &DB{}
+	err = db.Init(baseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 400; i++ {
+		key := strconv.Itoa(i)
+		before[key] = key
+		err = db.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := make(map[string]string)
+	for key, val := range before {
+		after[key] = val
+	}
+	for i := 400; i < 700; i++ {
+		after[strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	for i := 0; i < 400; i += 5 {
+		after[strconv.Itoa(i)] = "updated"
+	}
+	for i := 0; i < 400; i += 7 {
+		delete(after, strconv.Itoa(i))
+	}
+
+	for n := 0; ; n++ {
+		for seed := int64(0); seed < 3; seed++ {
+			CopyFile(t, baseName, crashName)
+			CopyFile(t, baseName+"-journal", crashName+"-journal")
+
+			injector := NewFaultInjector(int64(n)*3 + seed)
+			db = &DB{}
+			err = db.InitWithPager(crashName, injector.Wrap(NewFilePager))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, err := db.Begin(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key := range before {
+				if _, ok := after[key]; !ok {
+					err = tx.Delete(key)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for key, val := range after {
+				if before[key] != val {
+					err = tx.Put(key, val)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			injector.FailAfter(n)
+			commitErr := tx.Commit()
+			if commitErr != nil && commitErr != ErrInjectedFault {
+				t.Fatal(commitErr)
+			}
+			err = injector.Crash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			db = &DB{}
+			err = db.Init(crashName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			BtreeStructureTest(t, db)
+			content := ReadAll(t, db)
+			if !EqualContent(content, after) && (commitErr == nil || !EqualContent(content, before)) {
+				t.Fatal("inconsistent db after crash at operation ", n, " seed ", seed)
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if commitErr == nil {
+				return
+			}
+		}
+	}
+}
+
+// TestFailedCommit checks that a db stops at a commit that failed part
+// way, and that the next open finds either side of it.
+func TestFailedCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	baseName := filepath.Join(dir, "base")
+	failName := filepath.Join(dir, "fail")
+
+	before := make(map[string]string)
+	db := &DB{}
+	err = db.Init(baseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i)
+		before[key] = key
+		err = db.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := make(map[string]string)
+	for key := range before {
+		after[key] = "updated"
+	}
+
+	for n := 0; ; n++ {
+		CopyFile(t, baseName, failName)
+		CopyFile(t, baseName+"-journal", failName+"-journal")
+		injector := NewFaultInjector(int64(n))
+		db = &DB{}
+		err = db.InitWithPager(failName, injector.Wrap(NewFilePager))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range after {
+			err = tx.Put(key, val)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		injector.FailAfter(n)
+		commitErr := tx.Commit()
+		if commitErr == nil {
+			db.Close()
+			return
+		}
+		tx, err = db.Begin(false)
+		if err == nil { //failed before writing anything
+			tx.Rollback()
+			if !EqualContent(ReadAll(t, db), before) {
+				t.Fatal("db changed by a failed commit at operation ", n)
+			}
+		} else if err != ErrCommitFailed {
+			t.Fatal("begin after a failed commit returned ", err)
+		}
+		db.Close() //the pages not synced yet are written back
+
+		db = &DB{}
+		err = db.Init(failName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		BtreeStructureTest(t, db)
+		content := ReadAll(t, db)
+		if !EqualContent(content, after) && !EqualContent(content, before) {
+			t.Fatal("inconsistent db after a failed commit at operation ", n)
+		}
+		err = db.Put("next", "commit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func CopyFile(t *testing.T, src, dst string) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dst, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ReadAll(t *testing.T, store Store) map[string]string {
+	it, err := store.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	content := make(map[string]string)
+	for it.Next() {
+		content[it.Key()] = it.Value()
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	return content
+}
+
+func EqualContent(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if bVal, ok := b[key]; !ok || bVal != val {
+			return false
+		}
+	}
+	return true
+}
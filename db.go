@@ -1,51 +1,383 @@
 package go_kvstore
 
 import (
+	"context"
 	"errors"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
+	// PageSize is the default page size of new files.
 	PageSize = 4096
+	// lockRetryInterval is how often a blocked Open retries the file lock.
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrReadOnly = errors.New("db is opened read only")
+	// ErrLocked is returned when another process holds the file lock and
+	// the open was not willing to wait.
+	ErrLocked = errors.New("db file is locked by another process")
+	// ErrTimeout is returned when the file lock is still held by another
+	// process once the lock timeout passed.
+	ErrTimeout = errors.New("timeout waiting for the file lock")
+	// ErrCommitFailed is returned by Begin once a Commit failed after it
+	// started writing its journal. The file may be half written, the next
+	// open completes the commit from the journal or drops it.
+	ErrCommitFailed = errors.New("a commit failed part way, reopen the db")
 )
 
 type DB struct {
 	CurrentPageNums uint64
-	FileName        string
-	File            *os.File
-	DirtyPageMap    map[uint64]*DirtyPage
-	MmapContent     []byte
+	MetaPageNums    uint64 //page nums recorded by the last Commit
+	TxID            uint64 //tx id of the last Commit
+	// AppliedIndex is the last raft log entry applied, committed with it.
+	AppliedIndex uint64
+	FileName     string
+	File         *os.File
+	PageCache    *PageCache
+	Pager        Pager
+	JournalFile  *os.File
+	Journal      Pager
+	Options      *Options
+	PageSize     int
+	Degree       int
+
+	mu      sync.RWMutex //shared by read transactions
+	batchMu sync.Mutex
+	batch   *batch
+	backups []*backup
+	archive *logArchive
+
+	changeLog      *changeLog
+	pendingChanges []Change //changes of the running write transaction
+
+	watchers      []*watcher
+	pendingEvents []WatchEvent //events of the running write transaction
+
+	// onCommit is called after every commit with the pages it wrote,
+	// complete is false if pages were written outside of the journal.
+	onCommit    func(txID uint64, ids []uint64, pages [][]byte, complete bool)
+	unjournaled bool //BulkLoad wrote pages straight to the pager
+	replica     bool //only written by a Follower
+	failed      bool //a Commit failed part way, see ErrCommitFailed
+
+	readMu  sync.Mutex
+	readers int //read transactions of a read only db, holding the shared file lock
+
+	expiries          expiryHeap //keys written with a TTL, for the sweeper
+	expiryScanPending bool       //the tree was not scanned for expiring keys yet
+	sweepStop         chan struct{}
+	sweepDone         sync.WaitGroup
+	// expire deletes expired pairs for the sweeper of a db written by a
+	// RaftNode, through its log.
+	expire func(entries []expiryEntry) (int, error)
+}
+
+// Open opens or creates the db file at path, options may be nil for the
+// defaults.
+func Open(path string, options *Options) (*DB, error) {
+	return OpenContext(context.Background(), path, options)
+}
+
+// OpenContext is Open giving up waiting for the file lock once ctx is done.
+func OpenContext(ctx context.Context, path string, options *Options) (*DB, error) {
+	db := &DB{}
+	err := db.initContext(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 func (db *DB) Init(fileName string) error {
+	return db.InitWithOptions(fileName, nil)
+}
 
-	err := db.Open(fileName, os.O_RDWR)
+// InitWithPager is Init with the pages of the file accessed through the
+// pager built by newPager, e.g. NewFilePager for pread/pwrite.
+func (db *DB) InitWithPager(fileName string, newPager func(*os.File, *Options) (Pager, error)) error {
+	return db.InitWithOptions(fileName, &Options{NewPager: newPager})
+}
+
+func (db *DB) InitWithOptions(fileName string, options *Options) error {
+	return db.initContext(context.Background(), fileName, options)
+}
+
+func (db *DB) initContext(ctx context.Context, fileName string, options *Options) error {
+	options, err := options.withDefaults()
 	if err != nil {
 		return err
 	}
 
-	err = db.FileLock(syscall.LOCK_EX, 100)
+	flag, how := os.O_RDWR|os.O_CREATE, syscall.LOCK_EX
+	if options.ReadOnly { //readers share the lock with each other
+		flag, how = os.O_RDONLY, syscall.LOCK_SH
+	}
+	for {
+		err = db.Open(fileName, flag)
+		if err != nil {
+			return err
+		}
+		err = db.initFile(ctx, options, how)
+		if err != errFileReplaced {
+			break
+		}
+		db.release() //compacted in place while we waited, open the new file
+	}
+	if err == nil && !options.ReadOnly {
+		err = WriteLockHolder(fileName)
+	}
+	if err == nil { //taken again by every commit and read transaction
+		err = db.FileUnLock()
+	}
 	if err != nil {
+		db.release()
 		return err
 	}
-	db.DirtyPageMap = make(map[uint64]*DirtyPage)
-	mmapContent, firstCreate, err := MMap(db.File, syscall.PROT_WRITE|syscall.PROT_READ)
+	if !options.ReadOnly && options.ExpirySweepInterval > 0 {
+		db.startSweeper(options.ExpirySweepInterval)
+	}
+	return nil
+}
+
+// release closes what a failed open set up.
+func (db *DB) release() {
+	if db.changeLog != nil {
+		db.changeLog.Close()
+		db.changeLog = nil
+	}
+	if db.archive != nil {
+		db.archive.Close()
+		db.archive = nil
+	}
+	if db.Journal != nil {
+		db.Journal.Close()
+		db.Journal = nil
+	}
+	if db.JournalFile != nil {
+		db.JournalFile.Close()
+		db.JournalFile = nil
+	}
+	if db.Pager != nil {
+		db.Pager.Close()
+		db.Pager = nil
+	}
+	db.File.Close()
+}
+
+// The db file is locked shared by the read transactions of read only dbs
+// and exclusively while a commit writes it, or an open sets it up. Writers
+// exclude each other with the lock of the journal, which they hold while
+// the db is open, so readers can open and read between the commits of a
+// running writer.
+
+func (db *DB) initFile(ctx context.Context, options *Options, how int) error {
+	if !options.ReadOnly {
+		err := db.lockWriter(ctx, options)
+		if err != nil {
+			return err
+		}
+	}
+	err := db.FileLockContext(ctx, how, options.LockTimeout)
+	if err == ErrLocked || err == ErrTimeout {
+		return lockedError(db.FileName, err)
+	}
 	if err != nil {
 		return err
 	}
-	db.MmapContent = mmapContent
+	replaced, err := db.fileReplaced()
+	if err != nil {
+		return err
+	}
+	if replaced {
+		return errFileReplaced
+	}
 
-	if firstCreate {
-		db.CurrentPageNums = 0
-	} else {
-		db.CurrentPageNums = uint64(len(db.MmapContent) / PageSize)
+	pageSize, err := ReadPageSize(db.File)
+	if err == ErrInvalidFile {
+		legacy, legacyErr := isLegacyFile(db.File)
+		if legacyErr != nil {
+			return legacyErr
+		}
+		if legacy && options.ReadOnly {
+			return ErrLegacyFile
+		}
+		if legacy {
+			return db.upgradeLegacyFile(options)
+		}
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+	if pageSize != 0 { //the file header wins over the options
+		options.PageSize = pageSize
+	} else if options.ReadOnly {
+		return ErrInvalidFile
+	}
+	pager, err := options.NewPager(db.File, options)
+	if err != nil {
+		return err
+	}
+	if options.ReadOnly {
+		ids, pages, err := db.hotJournal(options)
+		if err != nil {
+			pager.Close()
+			return err
+		}
+		if ids != nil {
+			pager = NewOverlayPager(pager, ids, pages)
+		}
+		return db.initPager(pager, nil, options)
+	}
+
+	journalOptions := *options
+	journalOptions.InitialMmapSize = 0
+	journal, err := options.NewPager(db.JournalFile, &journalOptions)
+	if err != nil {
+		pager.Close()
+		return err
+	}
+	recoveredIDs, recoveredPages, err := ReadJournal(journal) //recovered by initPager
+	if err != nil {
+		pager.Close()
+		journal.Close()
+		return err
+	}
+	err = db.initPager(pager, journal, options)
+	if err != nil {
+		return err
+	}
+	if db.Degree != DegreeForPageSize(db.PageSize) {
+		return db.upgradeUntrailedFile()
+	}
+	if options.LogArchiveDir != "" {
+		db.archive, err = openLogArchive(options.LogArchiveDir, options.PageSize, options.LogSegmentSize)
+		if err != nil {
+			return err
+		}
+		if recoveredIDs != nil {
+			err = db.archive.appendRecovered(recoveredIDs, recoveredPages)
+			if err == nil {
+				err = db.sync(db.archive)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if options.ChangeLog {
+		db.changeLog, err = openChangeLog(db.FileName, db.TxID)
+	}
+	return err
+}
+
+// lockWriter opens the journal and takes its lock for the lifetime of db.
+func (db *DB) lockWriter(ctx context.Context, options *Options) error {
+	file, err := os.OpenFile(db.FileName+"-journal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	db.JournalFile = file
+	err = flockContext(ctx, file, syscall.LOCK_EX, options.LockTimeout)
+	if err == ErrLocked || err == ErrTimeout {
+		return lockedError(db.FileName, err)
+	}
+	return err
+}
+
+// hotJournal returns the pages of a complete journal left by a crashed
+// writer. Read only dbs lay them over the file, the file itself is
+// repaired by the next writable open.
+func (db *DB) hotJournal(options *Options) ([]uint64, [][]byte, error) {
+	journalFile, err := os.Open(db.FileName + "-journal")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer journalFile.Close()
+
+	journal, err := NewFilePager(journalFile, options) //mostly just the header is read
+	if err != nil {
+		return nil, nil, err
+	}
+	defer journal.Close()
+	return ReadJournal(journal)
+}
+
+// initPager sets up the db on top of pager, replaying the journal first if
+// the last Commit did not finish. journal is nil for in-memory and read
+// only dbs.
+func (db *DB) initPager(pager, journal Pager, options *Options) error {
+	db.Pager = pager
+	db.Journal = journal
+	db.Options = options
+	db.PageSize = options.PageSize
+	db.Degree = DegreeForPageSize(options.PageSize)
+	db.PageCache = NewPageCache(options.CachePages)
+
+	if journal != nil {
+		err := RecoverJournal(journal, pager)
+		if err != nil {
+			return err
+		}
+	}
+
+	blank := pager.Size() == 0
+	if !blank {
+		meta, err := pager.ReadPage(MetaPageID)
+		if err != nil {
+			return err
+		}
+		blank = isBlankMeta(meta)
+	}
+	if blank { //first create, write the meta page and reserve the root page
+		err := pager.Allocate(RootPageID + 1)
+		if err != nil {
+			return err
+		}
+		err = pager.WritePage(MetaPageID, MetaPage(db.PageSize, RootPageID+1, 0, 0, 0))
+		if err != nil {
+			return err
+		}
+		err = pager.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.readMeta()
+}
+
+// readMeta loads the fields kept in the meta page.
+func (db *DB) readMeta() error {
+	meta, err := db.Pager.ReadPage(MetaPageID)
+	if err != nil {
+		return err
+	}
+	db.MetaPageNums, err = MetaPageNums(meta)
+	if err != nil {
+		return err
+	}
+	if db.MetaPageNums == 0 {
+		db.MetaPageNums = db.Pager.Size()
+	}
+	db.CurrentPageNums = db.MetaPageNums
+	db.TxID = MetaTxID(meta)
+	db.AppliedIndex = MetaAppliedIndex(meta)
+	db.Degree = DegreeForPageSize(db.PageSize)
+	if db.TxID == 0 {
+		db.Degree, err = db.untrailedDegree()
+	}
+	return err
 }
 func (db *DB) Open(fileName string, flag int) error {
-	file, err := os.OpenFile(fileName, flag|os.O_CREATE, 0644)
+	file, err := os.OpenFile(fileName, flag, 0644)
 	if err != nil {
 		return err
 	}
@@ -53,19 +385,50 @@ func (db *DB) Open(fileName string, flag int) error {
 	db.FileName = fileName
 	return nil
 }
-func (db *DB) FileLock(how int, timeout int) error {
+
+// FileLock takes the flock, see FileLockContext for timeout.
+func (db *DB) FileLock(how int, timeout time.Duration) error {
+	return db.FileLockContext(context.Background(), how, timeout)
+}
+
+// FileLockContext takes the flock, retrying while another process holds
+// it. A timeout of 0 waits until ctx is done, a negative one does not wait
+// and returns ErrLocked.
+func (db *DB) FileLockContext(ctx context.Context, how int, timeout time.Duration) error {
+	return flockContext(ctx, db.File, how, timeout)
+}
+
+func flockContext(ctx context.Context, file *os.File, how int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
 	for {
-		err := syscall.Flock(int(db.File.Fd()), how|syscall.LOCK_NB)
-		if err != nil {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
 			return nil
-		} else {
-			if err == syscall.EAGAIN {
-				time.Sleep(time.Millisecond * time.Duration(timeout))
-				continue
-			} else {
-				return err
+		}
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		if timeout < 0 {
+			return ErrLocked
+		}
+
+		wait := lockRetryInterval
+		if timeout > 0 {
+			remain := time.Until(deadline)
+			if remain <= 0 {
+				return ErrTimeout
+			}
+			if remain < wait {
+				wait = remain
 			}
 		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
 }
 func (db *DB) FileUnLock() error {
@@ -76,10 +439,44 @@ func (db *DB) FileUnLock() error {
 	return nil
 }
 func (db *DB) Close() error {
-	err := syscall.Munmap(db.MmapContent)
+	db.stopSweeper()
+	db.closeWatchers()
+	err := db.Pager.Close()
 	if err != nil {
 		return err
 	}
+	db.Pager = nil
+	if db.File == nil { //in-memory db
+		return nil
+	}
+	if !db.Options.ReadOnly { //still holding the journal lock, the sidecar is ours
+		err = RemoveLockHolder(db.FileName)
+		if err != nil {
+			return err
+		}
+	}
+	if db.Journal != nil {
+		err = db.Journal.Close()
+		if err != nil {
+			return err
+		}
+		err = db.JournalFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if db.archive != nil {
+		err = db.archive.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if db.changeLog != nil {
+		err = db.changeLog.Close()
+		if err != nil {
+			return err
+		}
+	}
 	err = db.File.Close()
 	if err != nil {
 		return err
@@ -100,66 +497,96 @@ func (db *DB) ProcessTransaction(fileName, key string) (string, error) {
 	return value, nil
 }
 func (db *DB) Read(key string) (string, error) {
-
-	root, err := db.GetRoot()
+	pair, err := db.readPair(key)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	value, err := Search(db, root, key)
+	if pair.expired(time.Now().UnixNano()) {
+		return "", ErrKeyNotFound
+	}
+	return pair.Value, nil
+}
 
+// readPair returns the pair of key, expired or not.
+func (db *DB) readPair(key string) (KVPair, error) {
+	root, err := db.ViewRoot()
 	if err != nil {
-		return "", err
+		return KVPair{}, err
 	}
-	return value, nil
+	if root == nil {
+		return KVPair{}, ErrKeyNotFound
+	}
+	return SearchPair(db, root, key)
 }
 
 func (db *DB) GetRoot() (*Node, error) {
-	return db.ReadNodeFromID(0)
+	return db.ReadNodeFromID(RootPageID)
 }
-func (db *DB) ReadNodeFromID(id uint64) (*Node, error) {
-
-	bytesFromRoot, hit := db.DirtyPageLookUp(id)
-	if !hit {
-		if int((id+1)*PageSize) > len(db.MmapContent) {
-			return nil, errors.New("key not exsist, node id too large")
-		}
-		node, err := DiskRead(int(id), db.MmapContent)
 
-		if err != nil {
-			return nil, err
-		}
-		if node == nil {
-			return nil, nil
-		}
+func (db *DB) ViewRoot() (*Node, error) {
+	return db.ViewNodeFromID(RootPageID)
+}
 
-		bytesFromRoot, err = TreeNodeToBytes(node)
-		if err != nil {
-			return nil, err
-		}
-		dirtyPage := &DirtyPage{
-			Content: bytesFromRoot,
-			IsDirty: false,
-		}
-		db.DirtyPageMap[id] = dirtyPage
+// ReadNodeFromID returns a copy of the node in page id that the caller may
+// modify and write back with WriteDirtyPage.
+func (db *DB) ReadNodeFromID(id uint64) (*Node, error) {
+	node, err := db.ViewNodeFromID(id)
+	if err != nil || node == nil {
+		return nil, err
 	}
+	return node.Clone(), nil
+}
 
-	node, err := BytesToTreeNode(bytesFromRoot)
+// ViewNodeFromID returns the cached node of page id without copying it, for
+// read only paths. The node must not be modified.
+func (db *DB) ViewNodeFromID(id uint64) (*Node, error) {
+	node, hit := db.DirtyPageLookUp(id)
+	if hit {
+		return node, nil
+	}
+	if id >= db.Pager.Size() {
+		return nil, errors.New("key not exsist, node id too large")
+	}
+	page, err := db.Pager.ReadPage(id)
 	if err != nil {
 		return nil, err
 	}
-
+	node, err = decodeNode(page, db.Degree)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, nil
+	}
+	db.PageCache.PutClean(id, node)
 	return node, nil
 }
 
-func (db *DB) DirtyPageLookUp(id uint64) ([]byte, bool) {
-	if content, hit := db.DirtyPageMap[id]; hit {
-		return content.Content, true
-	} else {
-		return []byte{}, false
-	}
+func (db *DB) DirtyPageLookUp(id uint64) (*Node, bool) {
+	return db.PageCache.Get(id)
+}
+
+func (db *DB) CacheStats() CacheStats {
+	return db.PageCache.Stats()
 }
 
 func (db *DB) Write(key, value string) error {
+	return db.WritePair(KVPair{Key: key, Value: value})
+}
+
+// WritePair is Write storing the whole pair, its expiry included. The
+// version is set by the write.
+func (db *DB) WritePair(pair KVPair) error {
+	return db.writePair(pair, nil)
+}
+
+// writePair writes pair if cond, checked in the same descent, passes.
+// cond may rewrite the pair from the one it replaces.
+func (db *DB) writePair(pair KVPair, cond insertCond) error {
+	pair.Version = 0
+	if len(pair.Key) <= MaxVersionedKeySize {
+		pair.Version = db.TxID + 1 //the commit of the running transaction
+	}
 	root, err := db.GetRoot()
 	if err != nil {
 		return err
@@ -167,75 +594,309 @@ func (db *DB) Write(key, value string) error {
 	btree := NewTree()
 	btree.Root = root
 
-	btree.Insert(db, key, value)
+	var old KVPair
+	var replaced bool
+	err = btree.insert(db, pair, func(written *KVPair, stored KVPair, found bool) error {
+		if cond != nil {
+			err := cond(written, stored, found)
+			if err != nil {
+				return err
+			}
+		}
+		err := checkPairSize(*written)
+		if err != nil {
+			return err
+		}
+		pair, old, replaced = *written, stored, found //note the merged and the replaced pair on the way
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if replaced && db.keepsHistory(pair.Key) {
+		err = db.keepRevision(old, pair.Version, false)
+		if err != nil {
+			return err
+		}
+	}
+	db.recordChange(ChangePut, pair.Key, pair.Value)
+	if db.watched(pair.Key) {
+		hadPrev := replaced && !old.expired(time.Now().UnixNano())
+		if !hadPrev {
+			old.Value = ""
+		}
+		db.recordWatchEvent(ChangePut, pair.Key, pair.Value, old.Value, hadPrev)
+	}
+	db.trackExpiry(pair)
 	return nil
 }
 
-func (db *DB) WriteDirtyPage(id uint64, node *Node) error {
-	bytesFromNode, err := TreeNodeToBytes(node)
+// checkPairSize returns ErrKeyTooLong or ErrValueTooLong if pair does not
+// fit a data slot, see TreeNodeToBytes.
+func checkPairSize(pair KVPair) error {
+	if len(pair.Key) > maxKeySize && !pair.history {
+		return ErrKeyTooLong
+	}
+	limit := maxValueSize
+	if pair.ExpiresAt != 0 {
+		limit = MaxExpiringValueSize
+	}
+	if len(pair.Value) > limit {
+		return ErrValueTooLong
+	}
+	return nil
+}
+
+// Remove deletes key, an expired key is reported as ErrKeyNotFound and
+// left to the sweeper.
+func (db *DB) Remove(key string) error {
+	pair, err := db.readPair(key)
+	if err != nil {
+		return err
+	}
+	if pair.expired(time.Now().UnixNano()) {
+		return ErrKeyNotFound
+	}
+	return db.removePair(pair)
+}
+
+// removePair deletes the key of pair, the pair currently stored.
+func (db *DB) removePair(pair KVPair) error {
+	return db.removeIf(pair.Key, nil)
+}
+
+// removeIf deletes key if cond passes on its pair, checked in the descent
+// that deletes it.
+func (db *DB) removeIf(key string, cond deleteCond) error {
+	root, err := db.GetRoot()
 	if err != nil {
 		return err
 	}
+	btree := &BTree{Root: root}
 
-	if _, hit := db.DirtyPageMap[id]; hit {
-		db.DirtyPageMap[id].IsDirty = true
-		db.DirtyPageMap[id].Content = make([]byte, PageSize)
-		copy(db.DirtyPageMap[id].Content, bytesFromNode)
-	} else {
-		dirtyPage := &DirtyPage{
-			IsDirty: true,
-			Content: make([]byte, PageSize),
+	var pair KVPair
+	err = btree.delete(db, key, func(stored KVPair) error {
+		if cond != nil {
+			err := cond(stored)
+			if err != nil {
+				return err
+			}
+		}
+		pair = stored
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if db.keepsHistory(pair.Key) {
+		err = db.keepRevision(pair, db.TxID+1, true)
+		if err != nil {
+			return err
 		}
-		copy(dirtyPage.Content, bytesFromNode)
-		db.DirtyPageMap[id] = dirtyPage
 	}
+	db.recordChange(ChangeDelete, pair.Key, "")
+	if db.watched(pair.Key) {
+		db.recordWatchEvent(ChangeDelete, pair.Key, "", pair.Value, true)
+	}
+	return nil
+}
+
+// WriteDirtyPage stores a copy of node as page id until the next Commit
+// encodes it.
+func (db *DB) WriteDirtyPage(id uint64, node *Node) error {
+	db.PageCache.PutDirty(id, node.Clone())
 	return nil
 }
 func (db *DB) Commit() error {
-	if int(PageSize*db.CurrentPageNums) > len(db.MmapContent) {
+	if db.CurrentPageNums > db.Pager.Size() {
 		err := db.Extend()
 		if err != nil {
 			return err
 		}
 	}
-	for id, page := range db.DirtyPageMap {
-		if page.IsDirty {
-			copy(db.MmapContent[id*PageSize:id*PageSize+PageSize], page.Content)
+	ids, nodes := db.PageCache.Dirty()
+	if len(ids) == 0 && db.CurrentPageNums == db.MetaPageNums {
+		return nil
+	}
+	txID := db.TxID + 1
+	pages := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		page, err := TreeNodeToBytes(node, db.PageSize)
+		if err != nil {
+			return err
 		}
+		StampPage(page, txID)
+		pages[i] = page
 	}
-	return nil
-}
+	ids = append(ids, MetaPageID)
+	commitTime := time.Now().UnixNano()
+	pages = append(pages, MetaPage(db.PageSize, db.CurrentPageNums, txID, commitTime, db.AppliedIndex))
 
-func (db *DB) Extend() error {
-	err := db.File.Close()
+	if db.changeLog != nil && len(db.pendingChanges) > 0 {
+		err := db.changeLog.Append(txID, db.pendingChanges)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.changeLog)
+		if err != nil {
+			return err
+		}
+	}
+	err := db.writeCommit(txID, commitTime, ids, pages)
 	if err != nil {
+		db.failed = true
 		return err
 	}
 
-	err = db.Open(db.FileName, os.O_RDWR)
+	db.PageCache.MarkClean()
+	db.MetaPageNums = db.CurrentPageNums
+	db.TxID = txID
+	if db.changeLog != nil {
+		db.pendingChanges = nil
+		db.changeLog.publish(txID)
+		db.changeLog.trim(db.Options.ChangeLogRetention) //the commit is done, a failed trim leaves the log whole
+	}
+	if len(db.pendingEvents) > 0 {
+		db.publishWatchEvents(txID)
+	}
+	if db.onCommit != nil {
+		db.onCommit(txID, ids, pages, !db.unjournaled)
+	}
+	db.unjournaled = false
+	return nil
+}
+
+// writeCommit writes the pages of commit txID through the journal. Once it
+// started the commit may survive a failure in the journal or in the file,
+// the caller then stops using the db until it is reopened.
+func (db *DB) writeCommit(txID uint64, commitTime int64, ids []uint64, pages [][]byte) error {
+	err := db.lockForCommit()
 	if err != nil {
 		return err
 	}
-
-	err = syscall.Ftruncate(int(db.File.Fd()), int64(PageSize*db.CurrentPageNums))
+	defer db.unlockForCommit()
+	if db.Journal != nil {
+		err := WriteJournal(db.Journal, ids, pages)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.Journal)
+		if err != nil {
+			return err
+		}
+	}
+	if db.archive != nil {
+		err := db.archive.Append(txID, commitTime, ids, pages)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.archive)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.preserveForBackups(ids)
 	if err != nil {
 		return err
 	}
-
-	mmapContent, _, err := MMap(db.File, syscall.PROT_WRITE|syscall.PROT_READ)
+	for i, id := range ids {
+		err := db.Pager.WritePage(id, pages[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = db.sync(db.Pager)
 	if err != nil {
 		return err
 	}
-	db.MmapContent = mmapContent
+	if db.Journal != nil {
+		err = ClearJournal(db.Journal)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.Journal)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// lockForCommit waits for the read transactions of other processes to end
+// and keeps new ones out until unlockForCommit, while the file is written.
+// A commit failing in between leaves a journal the readers lay over it.
+func (db *DB) lockForCommit() error {
+	if db.File == nil {
+		return nil
+	}
+	return syscall.Flock(int(db.File.Fd()), syscall.LOCK_EX)
+}
+
+func (db *DB) unlockForCommit() {
+	if db.File != nil {
+		db.FileUnLock()
+	}
+}
+
+func (db *DB) sync(f interface{ Sync() error }) error {
+	if db.Options.SyncPolicy == SyncNever {
+		return nil
+	}
+	return f.Sync()
+}
+
+// Sync flushes the db file and the journal, for dbs opened with SyncNever.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Journal != nil {
+		err := db.Journal.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return db.Pager.Sync()
+}
+
+// releaseRetired unmaps what the pager kept for pages read before it grew,
+// called with db.mu held exclusively so no read transaction still has one.
+// A failure only keeps the memory mapped until Close.
+func (db *DB) releaseRetired() {
+	if pager, ok := db.Pager.(retiringPager); ok {
+		pager.ReleaseRetired()
+	}
+}
+
+// Extend grows the file to hold CurrentPageNums pages, preallocating by
+// doubling the file up to maxGrowStep and by maxGrowStep afterwards.
+func (db *DB) Extend() error {
+	size := GrowSize(int64(db.Pager.Size())*int64(db.PageSize), int64(db.CurrentPageNums)*int64(db.PageSize))
+	return db.Pager.Allocate(uint64(size / int64(db.PageSize)))
+}
+
+const maxGrowStep = 1 << 30
+
+// GrowSize returns the size to grow current to so that it holds needed
+// bytes.
+func GrowSize(current, needed int64) int64 {
+	size := current
+	if size == 0 {
+		size = needed
+	}
+	for size < needed {
+		if size < maxGrowStep {
+			size *= 2
+		} else {
+			size += maxGrowStep
+		}
+	}
+	return size
+}
 func (db *DB) Clear() error {
 	err := db.Close()
 	if err != nil {
 		return err
 	}
-	for id, _ := range db.DirtyPageMap {
-		delete(db.DirtyPageMap, id)
-	}
+	db.PageCache.Clear()
 	return nil
 }
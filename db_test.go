@@ -1,6 +1,8 @@
 package go_kvstore
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -134,6 +136,27 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestTranverseCopies(t *testing.T) {
+	db := NewMemDB()
+	err := db.Put("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := db.ViewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvpairs, err := Tranverse(db, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvpairs[0].Value = "changed"
+	val, err := db.Get("key")
+	if err != nil || val != "value" {
+		t.Fatal("cached leaf changed through Tranverse ", val, err)
+	}
+}
+
 func BtreeStructureTest(t *testing.T, db *DB) {
 	root, err := db.GetRoot()
 	if err != nil {
@@ -150,3 +173,73 @@ func BtreeStructureTest(t *testing.T, db *DB) {
 		}
 	}
 }
+
+func BenchmarkRead(b *testing.B) {
+	db := NewMemDB()
+	for i := 0; i < 10000; i++ {
+		err := db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := db.Read(strconv.Itoa(i % 10000))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadUncached(b *testing.B) {
+	db := NewMemDB()
+	for i := 0; i < 10000; i++ {
+		err := db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.PageCache = NewPageCache(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := db.Read(strconv.Itoa(i % 10000))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestOverwriteSplitKey overwrites keys that move up into the parent when
+// the descent splits the full child holding them.
+func TestOverwriteSplitKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "split"), &Options{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expect := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		expect[fmt.Sprintf("%03d", i)] = "old"
+		err = db.Put(fmt.Sprintf("%03d", i), "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//every full child on the way is split, some on the key itself
+		for key := range expect {
+			err = db.Put(key, "new"+strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect[key] = "new" + strconv.Itoa(i)
+		}
+	}
+	checkContent(t, db, expect)
+}
@@ -1,6 +1,158 @@
 package go_kvstore
 
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	DefaultCachePages = 1024
+)
+
 type DirtyPage struct {
-	Content []byte
+	Node    *Node
 	IsDirty bool
+
+	element *list.Element //position in the lru list, nil while dirty
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// PageCache holds the decoded nodes of the pages read since they were last
+// evicted and of every page written since the last Commit. Dirty pages are pinned, clean pages
+// are evicted least recently used first once there are more than capacity
+// of them. Read transactions share it, so it is locked on its own.
+type PageCache struct {
+	mu       sync.Mutex
+	capacity int
+	pages    map[uint64]*DirtyPage
+	lru      *list.List //ids of clean pages, most recently used at front
+	stats    CacheStats
+}
+
+func NewPageCache(capacity int) *PageCache {
+	return &PageCache{
+		capacity: capacity,
+		pages:    make(map[uint64]*DirtyPage),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the cached node, it is shared and must not be modified.
+func (c *PageCache) Get(id uint64) (*Node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, hit := c.pages[id]
+	if !hit {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	if page.element != nil {
+		c.lru.MoveToFront(page.element)
+	}
+	return page.Node, true
+}
+
+// PutClean caches a node read from the pager.
+func (c *PageCache) PutClean(id uint64, node *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, hit := c.pages[id]; hit {
+		return
+	}
+	page := &DirtyPage{Node: node}
+	page.element = c.lru.PushFront(id)
+	c.pages[id] = page
+	c.evict()
+}
+
+// PutDirty stores a written node and pins it until MarkClean or
+// DiscardDirty.
+func (c *PageCache) PutDirty(id uint64, node *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, hit := c.pages[id]
+	if !hit {
+		page = &DirtyPage{}
+		c.pages[id] = page
+	}
+	if page.element != nil {
+		c.lru.Remove(page.element)
+		page.element = nil
+	}
+	page.Node = node
+	page.IsDirty = true
+}
+
+// Dirty returns the ids and nodes of the dirty pages.
+func (c *PageCache) Dirty() ([]uint64, []*Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]uint64, 0)
+	nodes := make([]*Node, 0)
+	for id, page := range c.pages {
+		if page.IsDirty {
+			ids = append(ids, id)
+			nodes = append(nodes, page.Node)
+		}
+	}
+	return ids, nodes
+}
+
+// MarkClean unpins the dirty pages once they are committed.
+func (c *PageCache) MarkClean() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, page := range c.pages {
+		if page.IsDirty {
+			page.IsDirty = false
+			page.element = c.lru.PushFront(id)
+		}
+	}
+	c.evict()
+}
+
+// DiscardDirty drops every dirty page, so the next read goes back to the
+// committed content.
+func (c *PageCache) DiscardDirty() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, page := range c.pages {
+		if page.IsDirty {
+			delete(c.pages, id)
+		}
+	}
+}
+
+func (c *PageCache) evict() {
+	for c.lru.Len() > c.capacity {
+		element := c.lru.Back()
+		c.lru.Remove(element)
+		delete(c.pages, element.Value.(uint64))
+		c.stats.Evictions++
+	}
+}
+
+func (c *PageCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = make(map[uint64]*DirtyPage)
+	c.lru.Init()
+}
+
+func (c *PageCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pages)
+}
+
+func (c *PageCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
 }
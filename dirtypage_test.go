@@ -0,0 +1,63 @@
+package go_kvstore
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPageCacheEviction(t *testing.T) {
+	cache := NewPageCache(2)
+	cache.PutClean(1, &Node{ID: 1})
+	cache.PutClean(2, &Node{ID: 2})
+	cache.Get(1)
+	cache.PutClean(3, &Node{ID: 3}) //evicts 2, the least recently used
+
+	if _, hit := cache.Get(2); hit {
+		t.Fatal("least recently used page not evicted")
+	}
+	if _, hit := cache.Get(1); !hit {
+		t.Fatal("recently used page evicted")
+	}
+
+	for id := uint64(10); id < 20; id++ {
+		cache.PutDirty(id, &Node{ID: id})
+	}
+	cache.PutClean(4, &Node{ID: 4})
+	for id := uint64(10); id < 20; id++ {
+		if _, hit := cache.Get(id); !hit {
+			t.Fatal("dirty page evicted ", id)
+		}
+	}
+
+	cache.MarkClean()
+	if cache.Len() != 2 {
+		t.Fatal("cache holds ", cache.Len(), " pages after commit, expect 2")
+	}
+	stats := cache.Stats()
+	if stats.Hits != 12 || stats.Misses != 1 || stats.Evictions != 12 {
+		t.Fatal("unexpected stats ", stats)
+	}
+}
+
+func TestSmallCacheDB(t *testing.T) {
+	db := NewMemDB()
+	db.PageCache = NewPageCache(4)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.PageCache.Len() > 4 {
+			t.Fatal("cache grows to ", db.PageCache.Len(), " pages")
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(strconv.Itoa(i))
+		if err != nil || val != strconv.Itoa(i) {
+			t.Fatal("read error ", i, err)
+		}
+	}
+	if db.CacheStats().Evictions == 0 {
+		t.Fatal("no eviction with a 4 page cache")
+	}
+}
@@ -4,10 +4,23 @@ import (
 	"encoding/binary"
 )
 
+const (
+	// maxKeySize is the size of the key area of a data slot, see
+	// TreeNodeToBytes.
+	maxKeySize = 30
+	// maxValueSize is the size of the value area of a data slot.
+	maxValueSize = 100
+	slotSize     = 2 + maxKeySize + 2 + maxValueSize
+	// nodeFieldsSize is the used, id, data count and is leaf fields of a
+	// page, childSize a child page id.
+	nodeFieldsSize = 1 + 8 + 8 + 1
+	childSize      = 8
+)
+
 func DiskRead(id int, buf []byte) (*Node, error) {
 	//
-	offset := id * 4096
-	diskNode := buf[offset : offset+4096]
+	offset := id * PageSize
+	diskNode := buf[offset : offset+PageSize]
 	node, err := BytesToTreeNode(diskNode)
 	if err != nil {
 		return nil, err
@@ -17,19 +30,40 @@ func DiskRead(id int, buf []byte) (*Node, error) {
 	//lock and mmap
 }
 func DiskWrite(id int, buf []byte, node *Node) error {
-	offset := id * 4096
+	offset := id * PageSize
 
-	modifiedContent, err := TreeNodeToBytes(node)
+	modifiedContent, err := TreeNodeToBytes(node, PageSize)
 	if err != nil {
 		return err
 	}
 
-	copy(buf[offset:offset+4096], modifiedContent)
+	copy(buf[offset:offset+PageSize], modifiedContent)
 
 	return nil
 }
-func TreeNodeToBytes(node *Node) ([]byte, error) {
-	retBytes := make([]byte, 4096)
+
+// TreeNodeToBytes encodes node into a page.
+//
+// page: used(1) | id(8) | data count(8) | 2*degree-1 data slots | is leaf(1) | children(8 each) | ... | tx id(8)
+// data slot: key length(2) | key(30) | value length(2) | value(100)
+//
+// The tx id trailer is stamped by Commit. The top bits of the lengths are
+// flags:
+//   - versionFlag on the key length: the key is at most MaxVersionedKeySize
+//     long, the last 8 bytes of the key area hold the version.
+//   - historyFlag on the key length: the slot is a kept revision, see
+//     historyKey, its version is the revision.
+//   - expiryFlag on the value length: the value is at most
+//     MaxExpiringValueSize long, the last 8 bytes of the value area hold
+//     the expiry.
+func TreeNodeToBytes(node *Node, pageSize int) ([]byte, error) {
+	return encodeNode(node, pageSize, DegreeForPageSize(pageSize))
+}
+
+// encodeNode is TreeNodeToBytes for a file with its own degree, see
+// decodeNode.
+func encodeNode(node *Node, pageSize, degree int) ([]byte, error) {
+	retBytes := make([]byte, pageSize)
 	bufPtr := 0
 	retBytes[bufPtr] = 0x1
 	bufPtr++
@@ -39,22 +73,36 @@ func TreeNodeToBytes(node *Node) ([]byte, error) {
 	binary.BigEndian.PutUint64(retBytes[bufPtr:bufPtr+8], dataLen)
 	bufPtr += 8
 	for i := 0; i < int(dataLen); i++ {
-		keyLen := uint16(len(node.Datas[i].Key))
+		key, version := node.Datas[i].Key, node.Datas[i].Version
+		var flags uint16
+		if node.Datas[i].history {
+			key, version = splitHistoryKey(key)
+			flags = historyFlag
+		}
+		keyLen := uint16(len(key)) | flags
+		if version != 0 {
+			keyLen |= versionFlag
+			binary.BigEndian.PutUint64(retBytes[bufPtr+2+MaxVersionedKeySize:bufPtr+2+maxKeySize], version)
+		}
 		binary.BigEndian.PutUint16(retBytes[bufPtr:bufPtr+2], keyLen)
 		bufPtr += 2
 
-		copy(retBytes[bufPtr:bufPtr+len(node.Datas[i].Key)], []byte(node.Datas[i].Key))
-		bufPtr += 30
+		copy(retBytes[bufPtr:bufPtr+len(key)], []byte(key))
+		bufPtr += maxKeySize
 
 		valueLen := uint16(len(node.Datas[i].Value))
+		if node.Datas[i].ExpiresAt != 0 {
+			valueLen |= expiryFlag
+			binary.BigEndian.PutUint64(retBytes[bufPtr+2+MaxExpiringValueSize:bufPtr+2+maxValueSize], uint64(node.Datas[i].ExpiresAt))
+		}
 		binary.BigEndian.PutUint16(retBytes[bufPtr:bufPtr+2], valueLen)
 		bufPtr += 2
 
 		copy(retBytes[bufPtr:bufPtr+len(node.Datas[i].Value)], []byte(node.Datas[i].Value))
-		bufPtr += 100
+		bufPtr += maxValueSize
 	}
 
-	bufPtr += ((2*MinimumDegree - 1 - int(dataLen)) * 134) //28 data spaces
+	bufPtr += ((2*degree - 1 - int(dataLen)) * slotSize) //skip the unused data slots
 	if !node.IsLeaf {
 		retBytes[bufPtr] = 0x0
 		bufPtr++
@@ -69,7 +117,16 @@ func TreeNodeToBytes(node *Node) ([]byte, error) {
 	}
 	return retBytes, nil
 }
+
+// BytesToTreeNode decodes a page written by TreeNodeToBytes, the degree
+// follows from the page length.
 func BytesToTreeNode(buf []byte) (*Node, error) {
+	return decodeNode(buf, DegreeForPageSize(len(buf)))
+}
+
+// decodeNode is BytesToTreeNode for a page of a file with its own degree,
+// see untrailedDegree.
+func decodeNode(buf []byte, degree int) (*Node, error) {
 	node := &Node{}
 	bufPtr := 0
 	if buf[bufPtr] == 0x0 { //empty node
@@ -85,23 +142,39 @@ func BytesToTreeNode(buf []byte) (*Node, error) {
 	bufPtr += 8
 
 	for i := 0; i < int(dataLen); i++ {
-		keyLen := int(binary.BigEndian.Uint16(buf[bufPtr : bufPtr+2])) //keyLen should not be more then 30,do this check at write
-
+		keyLen := int(binary.BigEndian.Uint16(buf[bufPtr : bufPtr+2])) //at most maxKeySize, checked by writePair
 		bufPtr += 2
+		var version uint64
+		if keyLen&versionFlag != 0 {
+			version = binary.BigEndian.Uint64(buf[bufPtr+MaxVersionedKeySize : bufPtr+maxKeySize])
+		}
+		history := keyLen&historyFlag != 0
+		keyLen &^= versionFlag | historyFlag
 
 		key := string(buf[bufPtr : bufPtr+keyLen])
-		bufPtr += 30
-		valueLen := int(binary.BigEndian.Uint16(buf[bufPtr : bufPtr+2])) ////keyLen should not be more then 30,do this check at write
+		if history {
+			key = historyKey(key, version)
+		}
+		bufPtr += maxKeySize
+		valueLen := int(binary.BigEndian.Uint16(buf[bufPtr : bufPtr+2])) //at most maxValueSize, checked by writePair
 		bufPtr += 2
+		var expiresAt int64
+		if valueLen&expiryFlag != 0 {
+			valueLen &^= expiryFlag
+			expiresAt = int64(binary.BigEndian.Uint64(buf[bufPtr+MaxExpiringValueSize : bufPtr+maxValueSize]))
+		}
 		val := string(buf[bufPtr : bufPtr+valueLen])
-		bufPtr += 100
+		bufPtr += maxValueSize
 		keyValuePair := KVPair{
-			Key:   key,
-			Value: val,
+			Key:       key,
+			Value:     val,
+			ExpiresAt: expiresAt,
+			Version:   version,
+			history:   history,
 		}
 		node.Datas[i] = keyValuePair
 	}
-	bufPtr += (2*MinimumDegree - 1 - dataLen) * 134 //28 data spaces
+	bufPtr += (2*degree - 1 - dataLen) * slotSize //skip the unused data slots
 
 	isLeaf := (buf[bufPtr] != 0x0)
 	node.IsLeaf = isLeaf
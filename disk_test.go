@@ -17,7 +17,7 @@ func TestNodeToBytesRoundTrip(t *testing.T) {
 	}
 	node1.Datas = []KVPair{kvpair1, kvpair2}
 	node1.Children = []uint64{2, 3, 4}
-	nodeBytes, err := TreeNodeToBytes(node1)
+	nodeBytes, err := TreeNodeToBytes(node1, PageSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,184 @@
+package go_kvstore
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+var ErrInjectedFault = errors.New("injected I/O fault")
+
+// FaultInjector drives the FaultPagers of one db, the db file and its
+// journal share the operation count and crash together. It is meant for
+// crash recovery tests.
+type FaultInjector struct {
+	rand      *rand.Rand
+	ops       int
+	failAfter int
+	crashed   bool
+	pagers    []*FaultPager
+}
+
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{
+		rand:      rand.New(rand.NewSource(seed)),
+		failAfter: -1,
+	}
+}
+
+// Wrap returns a pager constructor for InitWithPager whose pagers go
+// through the injector.
+func (fi *FaultInjector) Wrap(newPager func(*os.File, *Options) (Pager, error)) func(*os.File, *Options) (Pager, error) {
+	return func(file *os.File, options *Options) (Pager, error) {
+		pager, err := newPager(file, options)
+		if err != nil {
+			return nil, err
+		}
+		faultPager := &FaultPager{
+			pager:    pager,
+			injector: fi,
+			unsynced: make(map[uint64][]byte),
+		}
+		fi.pagers = append(fi.pagers, faultPager)
+		return faultPager, nil
+	}
+}
+
+// FailAfter lets the next n I/O operations succeed and fails all the
+// following ones with ErrInjectedFault.
+func (fi *FaultInjector) FailAfter(n int) {
+	fi.failAfter = fi.ops + n
+}
+
+func (fi *FaultInjector) op() error {
+	if fi.crashed || (fi.failAfter >= 0 && fi.ops >= fi.failAfter) {
+		return ErrInjectedFault
+	}
+	fi.ops++
+	return nil
+}
+
+// Crash simulates a power loss. Every page written since the last Sync is
+// either dropped, fully written or torn at a random byte offset. All
+// operations fail afterwards, the files can then be reopened to check
+// recovery.
+func (fi *FaultInjector) Crash() error {
+	fi.crashed = true
+	for _, p := range fi.pagers {
+		ids := make([]uint64, 0, len(p.unsynced))
+		for id := range p.unsynced {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for _, id := range ids {
+			content := p.unsynced[id]
+			switch fi.rand.Intn(3) {
+			case 0: //dropped
+				continue
+			case 1: //torn
+				old, err := p.pager.ReadPage(id)
+				if err != nil {
+					return err
+				}
+				torn := append([]byte{}, old...)
+				offset := 1 + fi.rand.Intn(p.PageSize()-1)
+				copy(torn[:offset], content[:offset])
+				content = torn
+			}
+			err := p.pager.WritePage(id, content)
+			if err != nil {
+				return err
+			}
+		}
+		p.unsynced = make(map[uint64][]byte)
+		err := p.pager.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FaultPager keeps written pages in memory until Sync, the wrapped pager
+// only ever holds what would survive a crash.
+type FaultPager struct {
+	pager    Pager
+	injector *FaultInjector
+	unsynced map[uint64][]byte
+}
+
+func (p *FaultPager) ReadPage(id uint64) ([]byte, error) {
+	err := p.injector.op()
+	if err != nil {
+		return nil, err
+	}
+	if content, hit := p.unsynced[id]; hit {
+		return content, nil
+	}
+	return p.pager.ReadPage(id)
+}
+
+func (p *FaultPager) WritePage(id uint64, content []byte) error {
+	err := p.injector.op()
+	if err != nil {
+		return err
+	}
+	if id >= p.pager.Size() {
+		return ErrPageOutOfRange
+	}
+	p.unsynced[id] = append([]byte{}, content[:p.PageSize()]...)
+	return nil
+}
+
+func (p *FaultPager) Allocate(pageNums uint64) error {
+	err := p.injector.op()
+	if err != nil {
+		return err
+	}
+	return p.pager.Allocate(pageNums)
+}
+
+func (p *FaultPager) Sync() error {
+	err := p.injector.op()
+	if err != nil {
+		return err
+	}
+	err = p.flush()
+	if err != nil {
+		return err
+	}
+	return p.pager.Sync()
+}
+
+func (p *FaultPager) flush() error {
+	for id, content := range p.unsynced {
+		err := p.pager.WritePage(id, content)
+		if err != nil {
+			return err
+		}
+		delete(p.unsynced, id)
+	}
+	return nil
+}
+
+func (p *FaultPager) Size() uint64 {
+	return p.pager.Size()
+}
+
+func (p *FaultPager) PageSize() int {
+	return p.pager.PageSize()
+}
+
+// Close writes back the unsynced pages like the OS eventually would,
+// unless the injector crashed.
+func (p *FaultPager) Close() error {
+	if !p.injector.crashed {
+		err := p.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return p.pager.Close()
+}
@@ -0,0 +1,338 @@
+package go_kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// With Options.HistoryVersions set, a write that replaces or deletes a
+// versioned pair keeps the old pair as a revision of its key, the version
+// being the revision. A delete also keeps a revision marking it. The
+// revisions live in the tree under hidden keys, see historyKey, so they are
+// written, rolled back and compacted with the commit that made them.
+
+var ErrRevisionCompacted = errors.New("revision is older than the kept history")
+
+const (
+	// historyFlag marks a key length of a kept revision, see
+	// TreeNodeToBytes.
+	historyFlag = 0x4000
+	// historyKeySize is longer than the key slot, so the hidden keys can
+	// not clash with the stored ones.
+	historyKeySize = 1 + MaxVersionedKeySize + 1 + 8
+	// deletedRevision is the ExpiresAt of the revision of a delete, the
+	// revisions do not expire otherwise.
+	deletedRevision = -1
+)
+
+// Revision is a value key had from the commit Revision on.
+type Revision struct {
+	Revision uint64
+	Value    string
+	Deleted  bool
+}
+
+// historyKey is 0xff | key padded to MaxVersionedKeySize | key length(1) |
+// revision(8), the revisions of a key sort together and by revision. The
+// pairs of revisions are told from the others by KVPair.history, which is
+// kept as historyFlag, not by their keys.
+func historyKey(key string, revision uint64) string {
+	buf := make([]byte, historyKeySize)
+	buf[0] = 0xff
+	copy(buf[1:], key)
+	buf[1+MaxVersionedKeySize] = byte(len(key))
+	binary.BigEndian.PutUint64(buf[historyKeySize-8:], revision)
+	return string(buf)
+}
+
+// splitHistoryKey returns the key and the revision of a historyKey.
+func splitHistoryKey(key string) (string, uint64) {
+	n := int(key[1+MaxVersionedKeySize])
+	return key[1 : 1+n], binary.BigEndian.Uint64([]byte(key[historyKeySize-8:]))
+}
+
+// History returns the kept revisions of key, oldest first, the current
+// value last.
+func (db *DB) History(key string) ([]Revision, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return tx.History(key)
+}
+
+// GetAt returns the value key had right after the commit with tx id
+// revision. ErrRevisionCompacted is returned if that revision is no longer
+// kept.
+func (db *DB) GetAt(key string, revision uint64) (string, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	return tx.GetAt(key, revision)
+}
+
+func (tx *Tx) History(key string) ([]Revision, error) {
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	revisions, _, err := tx.db.revisions(key)
+	if err == nil && len(revisions) == 0 {
+		err = ErrKeyNotFound
+	}
+	return revisions, err
+}
+
+func (tx *Tx) GetAt(key string, revision uint64) (string, error) {
+	if tx.closed {
+		return "", ErrTxClosed
+	}
+	revisions, kept, err := tx.db.revisions(key)
+	if err != nil {
+		return "", err
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].Revision <= revision {
+			if revisions[i].Deleted {
+				return "", ErrKeyNotFound
+			}
+			return revisions[i].Value, nil
+		}
+	}
+	if kept > 0 && kept >= tx.db.Options.HistoryVersions { //older ones were dropped
+		return "", ErrRevisionCompacted
+	}
+	return "", ErrKeyNotFound
+}
+
+// revisions returns the revisions of key and how many of them are kept
+// ones, the current pair is not.
+func (db *DB) revisions(key string) ([]Revision, int, error) {
+	if len(key) > MaxVersionedKeySize {
+		return nil, 0, ErrKeyTooLong
+	}
+	kept, err := db.keptRevisions(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	current, err := db.readPair(key)
+	if err == ErrKeyNotFound || err == nil && current.expired(time.Now().UnixNano()) {
+		current, err = KVPair{}, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var revisions []Revision
+	for _, pair := range kept {
+		if current.Version != 0 && pair.Version >= current.Version { //a delete rewritten in the same commit
+			break
+		}
+		revisions = append(revisions, Revision{
+			Revision: pair.Version,
+			Value:    pair.Value,
+			Deleted:  pair.ExpiresAt == deletedRevision,
+		})
+	}
+	n := len(revisions)
+	if current.Version != 0 {
+		revisions = append(revisions, Revision{Revision: current.Version, Value: current.Value})
+	}
+	return revisions, n, nil
+}
+
+// keptRevisions returns the pairs kept for key, oldest first.
+func (db *DB) keptRevisions(key string) ([]KVPair, error) {
+	root, err := db.ViewRoot()
+	if err != nil || root == nil {
+		return nil, err
+	}
+	pairs, err := rangePairs(db, root, historyKey(key, 0), historyKey(key, math.MaxUint64), nil)
+	if err != nil {
+		return nil, err
+	}
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if pair.history { //a stored key may sort among them
+			kept = append(kept, pair)
+		}
+	}
+	return kept, nil
+}
+
+// pairKey returns the key pair belongs to, the stored one for a kept
+// revision.
+func pairKey(pair KVPair) string {
+	if pair.history {
+		key, _ := splitHistoryKey(pair.Key)
+		return key
+	}
+	return pair.Key
+}
+
+// keyPairs returns the kept revisions of key, oldest first, and its stored
+// pair, expired or not, last. installKey copies them to another db.
+func (db *DB) keyPairs(key string) ([]KVPair, error) {
+	var pairs []KVPair
+	if len(key) <= MaxVersionedKeySize {
+		kept, err := db.keptRevisions(key)
+		if err != nil {
+			return nil, err
+		}
+		pairs = kept
+	}
+	pair, err := db.readPair(key)
+	if err == nil {
+		pairs = append(pairs, pair)
+	} else if err != ErrKeyNotFound {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// installKey makes pairs, read from another db by keyPairs, the stored pair
+// and kept revisions of key, with their versions. The tx id is raised to
+// the newest version, so the next write of key gets a newer one. It returns
+// by how many bytes the stored pairs of db grew.
+func (db *DB) installKey(key string, pairs []KVPair) (int64, error) {
+	old, err := db.keyPairs(key)
+	if err != nil {
+		return 0, err
+	}
+	var delta int64
+	var prev *KVPair
+	for i, pair := range old {
+		root, err := db.GetRoot()
+		if err != nil {
+			return 0, err
+		}
+		err = (&BTree{Root: root}).Delete(db, pair.Key)
+		if err != nil {
+			return 0, err
+		}
+		if !pair.history {
+			delta -= int64(len(pair.Key) + len(pair.Value))
+			prev = &old[i]
+		}
+	}
+	var current *KVPair
+	for i, pair := range pairs {
+		if pair.Version > db.TxID {
+			db.TxID = pair.Version
+		}
+		root, err := db.GetRoot()
+		if err != nil {
+			return 0, err
+		}
+		err = (&BTree{Root: root}).insert(db, pair, nil)
+		if err != nil {
+			return 0, err
+		}
+		if !pair.history {
+			delta += int64(len(pair.Key) + len(pair.Value))
+			current = &pairs[i]
+			db.trackExpiry(pair)
+		}
+	}
+
+	if current != nil {
+		db.recordChange(ChangePut, key, current.Value)
+		if db.watched(key) {
+			hadPrev := prev != nil && !prev.expired(time.Now().UnixNano())
+			var prevValue string
+			if hadPrev {
+				prevValue = prev.Value
+			}
+			db.recordWatchEvent(ChangePut, key, current.Value, prevValue, hadPrev)
+		}
+	} else if prev != nil {
+		db.recordChange(ChangeDelete, key, "")
+		if db.watched(key) {
+			db.recordWatchEvent(ChangeDelete, key, "", prev.Value, true)
+		}
+	}
+	return delta, nil
+}
+
+// readKeyPairs is keyPairs in a transaction of its own.
+func readKeyPairs(db *DB, key string) ([]KVPair, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.db.keyPairs(key)
+}
+
+// keepsHistory reports whether writes of key keep its revisions.
+func (db *DB) keepsHistory(key string) bool {
+	return db.Options.HistoryVersions > 0 && len(key) <= MaxVersionedKeySize
+}
+
+// keepRevision keeps old, the pair replaced by the write of revision, and
+// a revision marking the delete if deleted. The oldest revisions beyond
+// Options.HistoryVersions are dropped.
+func (db *DB) keepRevision(old KVPair, revision uint64, deleted bool) error {
+	var pairs []KVPair
+	if old.Version != 0 && old.Version < revision { //not written by the same commit
+		pairs = append(pairs, KVPair{Key: historyKey(old.Key, old.Version), Value: old.Value, Version: old.Version, history: true})
+	}
+	if deleted {
+		pairs = append(pairs, KVPair{Key: historyKey(old.Key, revision), Version: revision, ExpiresAt: deletedRevision, history: true})
+	}
+	for _, pair := range pairs {
+		root, err := db.GetRoot()
+		if err != nil {
+			return err
+		}
+		btree := &BTree{Root: root}
+		err = btree.insert(db, pair, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	kept, err := db.keptRevisions(old.Key)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(kept)-db.Options.HistoryVersions; i++ {
+		root, err := db.GetRoot()
+		if err != nil {
+			return err
+		}
+		btree := &BTree{Root: root}
+		err = btree.Delete(db, kept[i].Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangePairs appends the pairs below node with from <= key <= to, in key
+// order.
+func rangePairs(db *DB, node *Node, from, to string, pairs []KVPair) ([]KVPair, error) {
+	for i := 0; i <= len(node.Datas); i++ {
+		if !node.IsLeaf && (i == 0 || node.Datas[i-1].Key < to) && (i == len(node.Datas) || node.Datas[i].Key > from) {
+			child, err := db.ViewNodeFromID(node.Children[i])
+			if err != nil {
+				return nil, err
+			}
+			pairs, err = rangePairs(db, child, from, to, pairs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i < len(node.Datas) && node.Datas[i].Key >= from && node.Datas[i].Key <= to {
+			pairs = append(pairs, node.Datas[i])
+		}
+	}
+	return pairs, nil
+}
@@ -0,0 +1,358 @@
+package go_kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+	options := &Options{PageSize: 1024, HistoryVersions: 3}
+
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//other keys around the history entries split the tree
+	expect := map[string]string{}
+	for i := 0; i < 200; i++ {
+		key := "k" + strconv.Itoa(i)
+		err = db.Put(key, "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = "v"
+	}
+	var revisions []uint64
+	for i := 0; i < 5; i++ {
+		err = db.Put("config", "value "+strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, db.TxID)
+	}
+	err = db.Delete("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := db.TxID
+	err = db.Put("config", "value 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions = append(revisions, db.TxID)
+	expect["config"] = "value 5"
+
+	history, err := db.History("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHistory := []Revision{
+		{Revision: revisions[3], Value: "value 3"},
+		{Revision: revisions[4], Value: "value 4"},
+		{Revision: deleted, Deleted: true},
+		{Revision: revisions[5], Value: "value 5"},
+	}
+	if len(history) != len(expectHistory) {
+		t.Fatal("history is ", history)
+	}
+	for i := range history {
+		if history[i] != expectHistory[i] {
+			t.Fatal("history is ", history)
+		}
+	}
+
+	checkAt := func(revision uint64, value string, expectErr error) {
+		t.Helper()
+		got, err := db.GetAt("config", revision)
+		if err != expectErr || got != value {
+			t.Fatal("get at ", revision, " returned ", got, err)
+		}
+	}
+	checkAt(revisions[0], "", ErrRevisionCompacted)
+	checkAt(revisions[3], "value 3", nil)
+	checkAt(revisions[4], "value 4", nil)
+	checkAt(deleted, "", ErrKeyNotFound)
+	checkAt(revisions[5]+10, "value 5", nil)
+	if _, err = db.GetAt("k1", 1); err != ErrKeyNotFound {
+		t.Fatal("get at before the first write returned ", err)
+	}
+	if _, err = db.History(strings.Repeat("k", MaxVersionedKeySize+1)); err != ErrKeyTooLong {
+		t.Fatal("history of a long key returned ", err)
+	}
+
+	//stored keys are not taken for revisions, also where they sort among
+	//them, and keys longer than the key slot are refused
+	if db.Put(strings.Repeat("z", historyKeySize), "v") != ErrKeyTooLong {
+		t.Fatal("stored a key longer than the key slot")
+	}
+	lookalike := historyKey("config", 1<<20)[:maxKeySize]
+	err = db.Put(lookalike, "stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect[lookalike] = "stored"
+	history, err = db.History("config")
+	if err != nil || len(history) != len(expectHistory) {
+		t.Fatal("history with a key among the revisions is ", history, err)
+	}
+	checkContent(t, db, expect)
+
+	//a rolled back write keeps no revision
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put("config", "rolled back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//two writes in one commit are one revision
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"first", "second"} {
+		err = tx.Put("config", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect["config"] = "second"
+	history, err = db.History("config")
+	if err != nil || len(history) != 4 || history[2].Revision != revisions[5] || history[3].Value != "second" {
+		t.Fatal("history is ", history, err)
+	}
+
+	//the revisions are hidden from iterators and survive a compaction and
+	//a reopen
+	checkContent(t, db, expect)
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContent(t, db, expect)
+	reopened, err := db.History("config")
+	if err != nil || len(reopened) != len(history) {
+		t.Fatal("history after reopen is ", reopened, err)
+	}
+	for i := range history {
+		if reopened[i] != history[i] {
+			t.Fatal("history after reopen is ", reopened)
+		}
+	}
+	checkAt(revisions[4], "value 4", nil)
+}
+
+// histories returns the history of each key, the db holding a key is given
+// by shard.
+func histories(t *testing.T, keys []string, shard func(key string) *DB) map[string][]Revision {
+	t.Helper()
+	histories := make(map[string][]Revision)
+	for _, key := range keys {
+		history, err := shard(key).History(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories[key] = history
+	}
+	return histories
+}
+
+func checkHistories(t *testing.T, expect map[string][]Revision, shard func(key string) *DB) {
+	t.Helper()
+	for key, history := range expect {
+		got, err := shard(key).History(key)
+		if err != nil || len(got) != len(history) {
+			t.Fatal("history of ", key, " is ", got, err, " not ", history)
+		}
+		for i := range history {
+			if got[i] != history[i] {
+				t.Fatal("history of ", key, " is ", got, " not ", history)
+			}
+		}
+		value, err := shard(key).GetAt(key, history[0].Revision)
+		if err != nil || value != history[0].Value {
+			t.Fatal("get at ", history[0].Revision, " of ", key, " returned ", value, err)
+		}
+	}
+}
+
+// writeHistories writes keys, rewrites every tenth and deletes some, and
+// returns the keys with kept revisions.
+func writeHistories(t *testing.T, n int, put func(key, value string) error, del func(key string) error) []string {
+	t.Helper()
+	var keys []string
+	for i := 0; i < n; i++ {
+		err := put(fmt.Sprintf("%05d", i), "v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		key := fmt.Sprintf("%05d", i)
+		err := put(key, "v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 5; i < n; i += 50 {
+		key := fmt.Sprintf("%05d", i)
+		err := del(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestRangedHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RangeOptions{
+		Options:       &Options{PageSize: 1024, HistoryVersions: 3},
+		SplitSize:     8 << 10,
+		CheckInterval: time.Hour,
+	}
+	s, err := OpenRanged(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	keys := writeHistories(t, 1500, s.Put, s.Delete)
+	expect := histories(t, keys, s.Shard)
+
+	//a split keeps the revisions of the keys in the new shards
+	err = s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Shards()) < 2 {
+		t.Fatal("no split, shards are ", s.Shards())
+	}
+	checkRanges(t, s)
+	checkHistories(t, expect, s.Shard)
+	for i, db := range s.shards {
+		size, err := dataSize(db)
+		if err != nil || size != s.sizes[i] {
+			t.Fatal("shard ", i, " holds ", size, " bytes, counted ", s.sizes[i], err)
+		}
+	}
+	//the next write gets a newer version than the copied ones
+	err = s.Put("00010", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := expect["00010"][len(expect["00010"])-1].Revision
+	history, err := s.Shard("00010").History("00010")
+	if err != nil || len(history) != 3 || history[2].Revision <= last {
+		t.Fatal("history after the split is ", history, err)
+	}
+
+	//a merge keeps them too
+	shards := len(s.Shards())
+	for i := 20; i < 1500; i++ {
+		err = s.Delete(fmt.Sprintf("%05d", i))
+		if err != nil && err != ErrKeyNotFound {
+			t.Fatal(err)
+		}
+	}
+	expect = histories(t, keys, s.Shard)
+	for i := 0; i < shards; i++ {
+		err = s.Rebalance()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Shards()) >= shards {
+		t.Fatal("no merge, shards are ", s.Shards())
+	}
+	checkRanges(t, s)
+	checkHistories(t, expect, s.Shard)
+}
+
+func TestShardedHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSharded(dir, 2, &Options{HistoryVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	keys := writeHistories(t, 600, s.Put, s.Delete)
+	expect := histories(t, keys, s.Shard)
+
+	//the moved keys take their revisions along
+	err = s.AddShard("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, expect, s.Shard)
+	err = s.RemoveShard("shard-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistories(t, expect, s.Shard)
+	for i, db := range s.shards {
+		it, err := db.Iterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		it.withHistory = true
+		for it.Next() {
+			if s.ring.owner(pairKey(it.Pair())) != i {
+				t.Fatal("revision of ", pairKey(it.Pair()), " left in shard ", s.names[i])
+			}
+		}
+		it.Close()
+	}
+
+	//the next write gets a newer version than the copied ones
+	err = s.Put("00010", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := expect["00010"][len(expect["00010"])-1].Revision
+	history, err := s.Shard("00010").History("00010")
+	if err != nil || len(history) != 3 || history[2].Revision <= last {
+		t.Fatal("history after the migration is ", history, err)
+	}
+}
@@ -0,0 +1,130 @@
+package go_kvstore
+
+import (
+	"time"
+)
+
+// Iterator walks the tree in key order. It keeps the path from the root to
+// the current position, frame.index is the next key of frame.node to return.
+type Iterator struct {
+	tx    *Tx
+	ownTx bool
+	stack []iterFrame
+	pair  KVPair
+	err   error
+	now   int64 //expired pairs are skipped unless withExpired
+	// withExpired also returns the expired pairs, for the sweeper.
+	withExpired bool
+	// withHistory also returns the kept revisions, for compaction.
+	withHistory bool
+}
+
+type iterFrame struct {
+	node  *Node
+	index int
+}
+
+func NewIterator(tx *Tx) (*Iterator, error) {
+	it := &Iterator{tx: tx, now: time.Now().UnixNano()}
+	root, err := tx.db.ViewRoot()
+	if err != nil {
+		return nil, err
+	}
+	if root != nil {
+		err = it.descend(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// descend pushes node and the leftmost path below it.
+func (it *Iterator) descend(node *Node) error {
+	it.stack = append(it.stack, iterFrame{node: node})
+	for !node.IsLeaf {
+		child, err := it.tx.db.ViewNodeFromID(node.Children[0])
+		if err != nil {
+			return err
+		}
+		node = child
+		it.stack = append(it.stack, iterFrame{node: node})
+	}
+	return nil
+}
+
+// Seek positions the iterator so that the following Next returns the
+// first key greater than or equal to key.
+func (it *Iterator) Seek(key string) {
+	it.stack = it.stack[:0]
+	it.err = nil
+	node, err := it.tx.db.ViewRoot()
+	for err == nil && node != nil {
+		index := SearchForChildIndex(node, key)
+		it.stack = append(it.stack, iterFrame{node: node, index: index})
+		if node.IsLeaf || (index < len(node.Datas) && node.Datas[index].Key == key) {
+			return
+		}
+		node, err = it.tx.db.ViewNodeFromID(node.Children[index])
+	}
+	it.err = err
+}
+
+func (it *Iterator) Next() bool {
+	for len(it.stack) > 0 && it.err == nil {
+		top := &it.stack[len(it.stack)-1]
+		if top.index >= len(top.node.Datas) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		it.pair = top.node.Datas[top.index]
+		top.index++
+		if !top.node.IsLeaf {
+			child, err := it.tx.db.ViewNodeFromID(top.node.Children[top.index])
+			if err != nil {
+				it.err = err
+				return false
+			}
+			err = it.descend(child)
+			if err != nil {
+				it.err = err
+				return false
+			}
+		}
+		if it.pair.history {
+			if !it.withHistory {
+				continue
+			}
+		} else if it.pair.expired(it.now) && !it.withExpired {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.pair.Key
+}
+
+func (it *Iterator) Value() string {
+	return it.pair.Value
+}
+
+// Pair returns the current pair with its expiry.
+func (it *Iterator) Pair() KVPair {
+	return it.pair
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close ends the transaction the iterator was opened in by DB.Iterator.
+// Iterators from Tx.Iterator end with their transaction.
+func (it *Iterator) Close() error {
+	if it.ownTx && !it.tx.closed {
+		return it.tx.Rollback()
+	}
+	return nil
+}
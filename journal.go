@@ -0,0 +1,182 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// The journal makes Commit atomic. Dirty pages are first written to the
+// journal and synced by Commit, only then copied to their place in the db file. A
+// crash in the middle of the copy is repaired by replaying the journal on
+// the next open, a crash before the journal is complete leaves the db file
+// untouched.
+//
+// layout: header page | page id pages | page contents
+// header: magic(8) | page count(8) | crc32 of count, ids and contents(4)
+
+var journalMagic = []byte("KVJRNL01")
+
+func journalIDPages(count, pageSize int) uint64 {
+	idsPerPage := pageSize / 8
+	return uint64((count + idsPerPage - 1) / idsPerPage)
+}
+
+func WriteJournal(journal Pager, ids []uint64, pages [][]byte) error {
+	pageSize := journal.PageSize()
+	idsPerPage := pageSize / 8
+	idPages := journalIDPages(len(ids), pageSize)
+	err := journal.Allocate(1 + idPages + uint64(len(ids)))
+	if err != nil {
+		return err
+	}
+
+	checksum := crc32.NewIEEE()
+	header := make([]byte, pageSize)
+	copy(header, journalMagic)
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(ids)))
+	checksum.Write(header[8:16])
+
+	idPage := make([]byte, pageSize)
+	for i, id := range ids {
+		binary.BigEndian.PutUint64(idPage[i%idsPerPage*8:], id)
+		if i%idsPerPage == idsPerPage-1 || i == len(ids)-1 {
+			checksum.Write(idPage)
+			err = journal.WritePage(1+uint64(i/idsPerPage), idPage)
+			if err != nil {
+				return err
+			}
+			idPage = make([]byte, pageSize)
+		}
+	}
+	for i, page := range pages {
+		checksum.Write(page)
+		err = journal.WritePage(1+idPages+uint64(i), page)
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(header[16:20], checksum.Sum32())
+	return journal.WritePage(0, header)
+}
+
+// ClearJournal invalidates the journal once its pages are synced in the db
+// file.
+func ClearJournal(journal Pager) error {
+	return journal.WritePage(0, make([]byte, journal.PageSize()))
+}
+
+// ReadJournal returns the pages of a complete journal, nil if the journal
+// is empty or incomplete.
+func ReadJournal(journal Pager) ([]uint64, [][]byte, error) {
+	if journal.Size() == 0 {
+		return nil, nil, nil
+	}
+	header, err := journal.ReadPage(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:8], journalMagic) {
+		return nil, nil, nil
+	}
+	count := binary.BigEndian.Uint64(header[8:16])
+	idsPerPage := uint64(journal.PageSize() / 8)
+	idPages := journalIDPages(int(count), journal.PageSize())
+	if 1+idPages+count > journal.Size() {
+		return nil, nil, nil
+	}
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[8:16])
+	ids := make([]uint64, 0, count)
+	for i := uint64(0); i < idPages; i++ {
+		idPage, err := journal.ReadPage(1 + i)
+		if err != nil {
+			return nil, nil, err
+		}
+		checksum.Write(idPage)
+		for j := uint64(0); j < idsPerPage && uint64(len(ids)) < count; j++ {
+			ids = append(ids, binary.BigEndian.Uint64(idPage[j*8:]))
+		}
+	}
+	pages := make([][]byte, count)
+	for i := range pages {
+		page, err := journal.ReadPage(1 + idPages + uint64(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		pages[i] = append([]byte{}, page...)
+		checksum.Write(pages[i])
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[16:20]) {
+		return nil, nil, nil
+	}
+	return ids, pages, nil
+}
+
+// RecoverJournal copies the pages of a complete journal into pager. An
+// incomplete or empty journal is ignored.
+func RecoverJournal(journal, pager Pager) error {
+	ids, pages, err := ReadJournal(journal)
+	if err != nil || ids == nil {
+		return err
+	}
+
+	for i, id := range ids {
+		err = pager.Allocate(id + 1)
+		if err != nil {
+			return err
+		}
+		err = pager.WritePage(id, pages[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = pager.Sync()
+	if err != nil {
+		return err
+	}
+	err = ClearJournal(journal)
+	if err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// overlayPager serves the pages of a complete journal over the db file.
+// Read only opens use it since they can not repair the file themselves.
+type overlayPager struct {
+	Pager
+	pages map[uint64][]byte
+	size  uint64
+}
+
+func NewOverlayPager(pager Pager, ids []uint64, pages [][]byte) Pager {
+	p := &overlayPager{
+		Pager: pager,
+		pages: make(map[uint64][]byte),
+		size:  pager.Size(),
+	}
+	for i, id := range ids {
+		p.pages[id] = pages[i]
+		if id+1 > p.size {
+			p.size = id + 1
+		}
+	}
+	return p
+}
+
+func (p *overlayPager) ReadPage(id uint64) ([]byte, error) {
+	if page, hit := p.pages[id]; hit {
+		return page, nil
+	}
+	if id >= p.Pager.Size() && id < p.size { //allocated by the journaled commit
+		return make([]byte, p.PageSize()), nil
+	}
+	return p.Pager.ReadPage(id)
+}
+
+func (p *overlayPager) Size() uint64 {
+	return p.size
+}
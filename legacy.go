@@ -0,0 +1,205 @@
+package go_kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Files written before the meta page have no header, 4096 byte pages and
+// the root in page 0. A writable open rewrites such a file once into the
+// current format, bulk loading its pairs into a new file renamed over it
+// like CompactInPlace does. Read only opens can not, they return
+// ErrLegacyFile.
+
+var ErrLegacyFile = errors.New("db file has the format of an older version, open it writable once to upgrade it")
+
+const legacyPageSize = 4096
+
+// isLegacyFile reports whether file starts with the root node of a file
+// written before the meta page.
+func isLegacyFile(file *os.File) (bool, error) {
+	size, err := GetFileSize(file)
+	if err != nil {
+		return false, err
+	}
+	if size == 0 || size%legacyPageSize != 0 {
+		return false, nil
+	}
+	header := make([]byte, 9)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return false, err
+	}
+	return header[0] == 0x1 && binary.BigEndian.Uint64(header[1:9]) == 0, nil //used, id 0
+}
+
+// upgradeLegacyFile writes the pairs of the legacy file of db into a new
+// file and renames it over, errFileReplaced tells the caller to open it.
+// db holds the lock of the legacy file.
+func (db *DB) upgradeLegacyFile(options *Options) error {
+	return db.upgradeFile(func(tmpPath string) error {
+		dstOptions := *options
+		dstOptions.LockTimeout = -1
+		dstOptions.InitialMmapSize = 0
+		dstOptions.LogArchiveDir = ""
+		dstOptions.ChangeLog = false
+		dstOptions.ExpirySweepInterval = -1
+		dst, err := Open(tmpPath, &dstOptions)
+		if err != nil {
+			return err
+		}
+		err = dst.BulkLoad(&legacyIterator{file: db.File})
+		closeErr := dst.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// Files written between the meta page and the page trailer have a tx id of
+// 0 and, for some page sizes, nodes of a larger degree than the current
+// one. Read only opens read them with that degree, a writable open
+// rewrites them once like a legacy file.
+
+// untrailedDegree returns the degree of the nodes of the file of db, whose
+// meta page has a tx id of 0. A file that does not hold a tree yet gets
+// the current degree.
+func (db *DB) untrailedDegree() (int, error) {
+	degree := DegreeForPageSize(db.PageSize)
+	if untrailedDegreeForPageSize(db.PageSize) == degree || db.Pager.Size() <= RootPageID {
+		return degree, nil
+	}
+	root, err := db.Pager.ReadPage(RootPageID)
+	if err != nil {
+		return 0, err
+	}
+	if root[0] != 0x1 { //unused, the first commit writes it with the current degree
+		return degree, nil
+	}
+	return untrailedDegreeForPageSize(db.PageSize), nil
+}
+
+// upgradeUntrailedFile rewrites the file of db, opened with the degree of
+// untrailedDegree, with the current degree.
+func (db *DB) upgradeUntrailedFile() error {
+	return db.upgradeFile(func(tmpPath string) error {
+		tx, err := db.beginExclusive()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		_, err = db.compactTo(tx, tmpPath)
+		return err
+	})
+}
+
+// upgradeFile fills a new file with write and renames it over the file of
+// db, errFileReplaced tells the caller to open it.
+func (db *DB) upgradeFile(write func(tmpPath string) error) error {
+	tmpPath := db.FileName + ".upgrade"
+	err := removeFiles(tmpPath, tmpPath+"-journal", LockFileName(tmpPath)) //left by a crashed upgrade
+	if err != nil {
+		return err
+	}
+	err = write(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, db.FileName)
+	}
+	if err != nil {
+		removeFiles(tmpPath, tmpPath+"-journal")
+		return err
+	}
+	err = syncFile(filepath.Dir(db.FileName)) //makes the rename durable before the reopened db commits
+	if err != nil {
+		return err
+	}
+	err = os.Remove(tmpPath + "-journal")
+	if err != nil {
+		return err
+	}
+	return errFileReplaced
+}
+
+// legacyIterator walks the tree of a legacy file in key order, like
+// Iterator does the current one.
+type legacyIterator struct {
+	file    *os.File
+	stack   []iterFrame
+	started bool
+	emitted bool
+	pair    KVPair
+	err     error
+}
+
+func (it *legacyIterator) node(id uint64) (*Node, error) {
+	page := make([]byte, legacyPageSize)
+	_, err := it.file.ReadAt(page, int64(id)*legacyPageSize)
+	if err != nil {
+		return nil, err
+	}
+	node, err := BytesToTreeNode(page)
+	if err == nil && node == nil {
+		err = ErrInvalidFile
+	}
+	return node, err
+}
+
+// descend pushes the node of page id and the leftmost path below it.
+func (it *legacyIterator) descend(id uint64) error {
+	for {
+		node, err := it.node(id)
+		if err != nil {
+			return err
+		}
+		it.stack = append(it.stack, iterFrame{node: node})
+		if node.IsLeaf {
+			return nil
+		}
+		id = node.Children[0]
+	}
+}
+
+func (it *legacyIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		it.err = it.descend(0)
+	}
+	for len(it.stack) > 0 && it.err == nil {
+		top := &it.stack[len(it.stack)-1]
+		if top.index >= len(top.node.Datas) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		pair := top.node.Datas[top.index]
+		top.index++
+		if !top.node.IsLeaf {
+			it.err = it.descend(top.node.Children[top.index])
+		}
+		//the old split could store a key twice, the first copy is the
+		//newer one
+		if it.emitted && pair.Key <= it.pair.Key {
+			continue
+		}
+		it.pair = pair
+		it.emitted = true
+		if it.err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *legacyIterator) Key() string {
+	return it.pair.Key
+}
+
+func (it *legacyIterator) Value() string {
+	return it.pair.Value
+}
+
+func (it *legacyIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,191 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeLegacyFile writes a file the way the code before the meta page
+// did, with the root in page 0.
+func writeLegacyFile(t *testing.T, path string, nodes []*Node) {
+	var content []byte
+	for _, node := range nodes {
+		page, err := TreeNodeToBytes(node, legacyPageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, page...)
+	}
+	err := ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "legacy")
+
+	left := &Node{ID: 1, IsLeaf: true}
+	right := &Node{ID: 2, IsLeaf: true}
+	expect := map[string]string{}
+	for i := 10; i < 20; i++ {
+		key := strconv.Itoa(i)
+		left.Datas = append(left.Datas, KVPair{Key: key, Value: "left " + key})
+		expect[key] = "left " + key
+	}
+	for i := 21; i < 30; i++ {
+		key := strconv.Itoa(i)
+		right.Datas = append(right.Datas, KVPair{Key: key, Value: "right " + key})
+		expect[key] = "right " + key
+	}
+	//the old split left the newer copy of 19 in the leaf below the stale
+	//one
+	middle := &Node{ID: 3, IsLeaf: true, Datas: []KVPair{{Key: "195", Value: "middle"}}}
+	root := &Node{ID: 0, Datas: []KVPair{{Key: "19", Value: "stale"}, {Key: "20", Value: "root"}}, Children: []uint64{1, 3, 2}}
+	expect["195"] = "middle"
+	expect["20"] = "root"
+	writeLegacyFile(t, path, []*Node{root, left, right, middle})
+
+	if _, err = Open(path, &Options{ReadOnly: true}); err != ErrLegacyFile {
+		t.Fatal("read only open of a legacy file returned ", err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, db, expect)
+	err = db.Put("30", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect["30"] = "new"
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContent(t, db, expect)
+}
+
+func TestUntrailedUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "untrailed")
+
+	//1024 byte pages held nodes of degree 4 before the trailer, full
+	//leaves of 7 keys below a root
+	const pageSize, degree = 1024, 4
+	left := &Node{ID: 2, IsLeaf: true}
+	right := &Node{ID: 3, IsLeaf: true}
+	expect := map[string]string{}
+	for i := 10; i < 17; i++ {
+		key, rightKey := strconv.Itoa(i), strconv.Itoa(i+8)
+		left.Datas = append(left.Datas, KVPair{Key: key, Value: "v" + key})
+		right.Datas = append(right.Datas, KVPair{Key: rightKey, Value: "v" + rightKey})
+		expect[key], expect[rightKey] = "v"+key, "v"+rightKey
+	}
+	root := &Node{ID: RootPageID, Datas: []KVPair{{Key: "17", Value: "root"}}, Children: []uint64{2, 3}}
+	expect["17"] = "root"
+	content := MetaPage(pageSize, 4, 0, 0, 0)
+	for _, node := range []*Node{root, left, right} {
+		page, err := encodeNode(node, pageSize, degree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, page...)
+	}
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Degree != degree {
+		t.Fatal("read with degree ", db.Degree)
+	}
+	checkContent(t, db, expect)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Degree != DegreeForPageSize(pageSize) || db.TxID == 0 {
+		t.Fatal("not upgraded, degree ", db.Degree, " tx id ", db.TxID)
+	}
+	checkContent(t, db, expect)
+	for i := 0; i < 100; i++ {
+		key := "n" + strconv.Itoa(i)
+		err = db.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = key
+	}
+	BtreeStructureTest(t, db)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContent(t, db, expect)
+}
+
+func TestBlankLegacyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blank")
+
+	//the code before the meta page left a zero filled page for a db that
+	//was opened and never written
+	err = ioutil.WriteFile(path, make([]byte, legacyPageSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContent(t, db, map[string]string{"k": "v"})
+}
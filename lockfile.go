@@ -0,0 +1,188 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The writer holding the lock records itself in the "-lock" sidecar file,
+// so that an open blocked on the lock can tell who holds the db. flock is
+// released when a process dies but the sidecar stays, a holder recorded
+// there whose process is gone is stale.
+
+type LockHolder struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// Alive reports whether the holder process still runs. Holders on other
+// hosts can not be checked and are taken as alive. A process running under
+// the recorded PID that started after StartTime got the PID reused.
+func (holder *LockHolder) Alive() bool {
+	hostname, err := os.Hostname()
+	if err != nil || hostname != holder.Hostname {
+		return true
+	}
+	err = syscall.Kill(holder.PID, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	started, ok := processStart(holder.PID)
+	return !ok || !started.After(holder.StartTime.Add(processStartSlack))
+}
+
+// processStartSlack covers the rounding of processStart, boot time is only
+// given in seconds.
+const processStartSlack = time.Second
+
+// clockTicks is the unit of the start time in /proc/<pid>/stat, USER_HZ is
+// 100 on every linux port.
+const clockTicks = 100
+
+// processStart returns when process pid started, ok is false where /proc
+// does not tell.
+func processStart(pid int) (time.Time, bool) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, false
+	}
+	//the command name may hold spaces, the fields after it start with the
+	//state, field 3, and the start time is field 22
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, false
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	boot, ok := bootTime()
+	if !ok {
+		return time.Time{}, false
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), true
+}
+
+func bootTime() (time.Time, bool) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			secs, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.Unix(secs, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (holder *LockHolder) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", holder.PID, holder.Hostname, holder.StartTime.Format(time.RFC3339))
+}
+
+// LockedError wraps ErrLocked or ErrTimeout with the writer recorded in
+// the sidecar file, Holder is nil if there is none, e.g. when readers hold
+// the lock.
+type LockedError struct {
+	Err    error
+	Holder *LockHolder
+	// Stale is set when the recorded holder is dead, the lock is then held
+	// by another process such as a reader or a child inheriting the file.
+	Stale bool
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return e.Err.Error()
+	}
+	if e.Stale {
+		return fmt.Sprintf("%s, last writer %s is gone", e.Err, e.Holder)
+	}
+	return fmt.Sprintf("%s, held by %s", e.Err, e.Holder)
+}
+
+func (e *LockedError) Unwrap() error {
+	return e.Err
+}
+
+func LockFileName(fileName string) string {
+	return fileName + "-lock"
+}
+
+// ReadLockHolder returns the writer recorded for the db file, nil if none.
+func ReadLockHolder(fileName string) (*LockHolder, error) {
+	content, err := ioutil.ReadFile(LockFileName(fileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	holder := &LockHolder{}
+	err = json.Unmarshal(content, holder)
+	if err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+// WriteLockHolder records the current process as the writer of the db
+// file. The content is renamed into place so readers never see it half
+// written.
+func WriteLockHolder(fileName string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&LockHolder{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		StartTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	tmpName := LockFileName(fileName) + ".tmp"
+	err = ioutil.WriteFile(tmpName, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, LockFileName(fileName))
+}
+
+func RemoveLockHolder(fileName string) error {
+	err := os.Remove(LockFileName(fileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lockedError describes who holds the lock of the db file.
+func lockedError(fileName string, err error) error {
+	holder, readErr := ReadLockHolder(fileName)
+	if readErr != nil || holder == nil {
+		return &LockedError{Err: err}
+	}
+	return &LockedError{
+		Err:    err,
+		Holder: holder,
+		Stale:  !holder.Alive(),
+	}
+}
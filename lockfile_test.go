@@ -0,0 +1,77 @@
+package go_kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockHolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(fileName, &Options{LockTimeout: -1})
+	lockedErr := &LockedError{}
+	if !errors.As(err, &lockedErr) || !errors.Is(err, ErrLocked) {
+		t.Fatal("expect a LockedError, got ", err)
+	}
+	hostname, _ := os.Hostname()
+	if lockedErr.Holder == nil || lockedErr.Holder.PID != os.Getpid() || lockedErr.Holder.Hostname != hostname {
+		t.Fatal("wrong holder ", lockedErr.Holder)
+	}
+	if lockedErr.Stale {
+		t.Fatal("live holder reported stale")
+	}
+
+	//record a holder that has exited while this process keeps the lock
+	cmd := exec.Command("true")
+	err = cmd.Run()
+	if err != nil {
+		t.Skip("can not run a child process: ", err)
+	}
+	content, _ := json.Marshal(&LockHolder{PID: cmd.Process.Pid, Hostname: hostname, StartTime: time.Now()})
+	err = ioutil.WriteFile(LockFileName(fileName), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(fileName, &Options{LockTimeout: -1})
+	if !errors.As(err, &lockedErr) || !lockedErr.Stale {
+		t.Fatal("dead holder not reported stale, got ", err)
+	}
+
+	//record a holder whose PID went to a process started after it, this one
+	if _, ok := processStart(os.Getpid()); ok {
+		content, _ = json.Marshal(&LockHolder{PID: os.Getpid(), Hostname: hostname, StartTime: time.Now().Add(-time.Hour)})
+		err = ioutil.WriteFile(LockFileName(fileName), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Open(fileName, &Options{LockTimeout: -1})
+		if !errors.As(err, &lockedErr) || !lockedErr.Stale {
+			t.Fatal("holder with a reused PID not reported stale, got ", err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := ReadLockHolder(fileName)
+	if err != nil || holder != nil {
+		t.Fatal("lock file left after close ", holder, err)
+	}
+}
@@ -0,0 +1,268 @@
+package go_kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The log archive keeps the pages of every commit, so a backup can be
+// brought forward to any later commit. Each open of the db starts a new
+// segment, named by the first tx id it may hold and its creation time so
+// the names sort in commit order.
+//
+// segment: magic(8) | page size(4) | records
+// record: tx id(8) | commit time(8) | page count(4) | page ids(8 each) | pages | crc32 of the record(4)
+//
+// Pages BulkLoad writes outside of the journal are archived as records of
+// the tx id its commit will get, without the meta page. A commit is
+// complete with the record holding its meta page. The records of a
+// transaction that does not commit are cut off again, a commit that fails
+// after its journal is complete is not: the next open finishes it from the
+// journal and archives it once more, replay skips such a copy.
+
+var logMagic = []byte("KVLOG001")
+
+const (
+	logHeaderSize       = 12
+	logRecordHeaderSize = 20
+)
+
+type logArchive struct {
+	dir         string
+	pageSize    int
+	segmentSize int64
+	file        *os.File
+	size        int64
+	lastTxID    uint64 //of the last Append
+}
+
+// logMark is the end of the archive when a transaction started.
+type logMark struct {
+	file *os.File
+	size int64
+}
+
+// openLogArchive creates dir if needed, the first segment is only created
+// by the first Append.
+func openLogArchive(dir string, pageSize int, segmentSize int64) (*logArchive, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &logArchive{
+		dir:         dir,
+		pageSize:    pageSize,
+		segmentSize: segmentSize,
+	}, nil
+}
+
+// Append adds a record of commit txID. The records of one commit go to
+// the same segment, so that rollback finds them there.
+func (a *logArchive) Append(txID uint64, commitTime int64, ids []uint64, pages [][]byte) error {
+	if a.file == nil || a.size >= a.segmentSize && txID != a.lastTxID {
+		err := a.rotate(txID)
+		if err != nil {
+			return err
+		}
+	}
+	a.lastTxID = txID
+
+	record := make([]byte, logRecordHeaderSize+len(ids)*(8+a.pageSize)+4)
+	binary.BigEndian.PutUint64(record[0:8], txID)
+	binary.BigEndian.PutUint64(record[8:16], uint64(commitTime))
+	binary.BigEndian.PutUint32(record[16:20], uint32(len(ids)))
+	ptr := logRecordHeaderSize
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(record[ptr:], id)
+		ptr += 8
+	}
+	for _, page := range pages {
+		copy(record[ptr:], page)
+		ptr += a.pageSize
+	}
+	binary.BigEndian.PutUint32(record[ptr:], crc32.ChecksumIEEE(record[:ptr]))
+
+	_, err := a.file.WriteAt(record, a.size)
+	if err != nil {
+		a.file.Truncate(a.size) //a torn record would end the segment early
+		return err
+	}
+	a.size += int64(len(record))
+	return nil
+}
+
+func (a *logArchive) mark() logMark {
+	return logMark{file: a.file, size: a.size}
+}
+
+// rollback drops the records appended since mark by a transaction that did
+// not commit.
+func (a *logArchive) rollback(mark logMark) error {
+	if a.file == nil {
+		return nil
+	}
+	size := mark.size
+	if a.file != mark.file { //rotated by the transaction
+		size = logHeaderSize
+	}
+	err := a.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	a.size = size
+	return nil
+}
+
+// appendRecovered archives the commit an open recovered from the journal,
+// which may have failed before or after archiving it.
+func (a *logArchive) appendRecovered(ids []uint64, pages [][]byte) error {
+	for i, id := range ids {
+		if id != MetaPageID {
+			continue
+		}
+		var commitTime int64
+		if t := MetaCommitTime(pages[i]); !t.IsZero() {
+			commitTime = t.UnixNano()
+		}
+		return a.Append(MetaTxID(pages[i]), commitTime, ids, pages)
+	}
+	return nil
+}
+
+func (a *logArchive) rotate(txID uint64) error {
+	if a.file != nil {
+		err := a.file.Sync()
+		if err != nil {
+			return err
+		}
+		err = a.file.Close()
+		if err != nil {
+			return err
+		}
+		a.file = nil
+	}
+
+	name := fmt.Sprintf("%020d-%019d.log", txID, time.Now().UnixNano())
+	file, err := os.OpenFile(filepath.Join(a.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, logHeaderSize)
+	copy(header, logMagic)
+	binary.BigEndian.PutUint32(header[8:12], uint32(a.pageSize))
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = logHeaderSize
+	return nil
+}
+
+func (a *logArchive) Sync() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+func (a *logArchive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// LogRecord is one record of the log archive.
+type LogRecord struct {
+	TxID       uint64
+	CommitTime time.Time
+	IDs        []uint64
+	Pages      [][]byte
+}
+
+// ReadLogArchive calls fn with the records of the segments in dir in
+// commit order, stopping at the first error fn returns. The checksum of
+// every record is verified. A torn record ends its segment, it is the
+// last write of a crashed process.
+func ReadLogArchive(dir string, fn func(*LogRecord) error) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = readLogSegment(name, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLogSegment(name string, fn func(*LogRecord) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	header := make([]byte, logHeaderSize)
+	_, err = io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF { //crashed while creating it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:8], logMagic) {
+		return fmt.Errorf("%s: %w", name, ErrInvalidFile)
+	}
+	pageSize := int(binary.BigEndian.Uint32(header[8:12]))
+
+	for {
+		record := make([]byte, logRecordHeaderSize)
+		_, err = io.ReadFull(r, record)
+		if err != nil {
+			return nil //end of the segment or torn record header
+		}
+		count := int(binary.BigEndian.Uint32(record[16:20]))
+		body := make([]byte, count*(8+pageSize)+4)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return nil
+		}
+		record = append(record, body[:len(body)-4]...)
+		if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(body[len(body)-4:]) {
+			return nil
+		}
+
+		rec := &LogRecord{
+			TxID:       binary.BigEndian.Uint64(record[0:8]),
+			CommitTime: time.Unix(0, int64(binary.BigEndian.Uint64(record[8:16]))),
+			IDs:        make([]uint64, count),
+			Pages:      make([][]byte, count),
+		}
+		pages := record[logRecordHeaderSize+count*8:]
+		for i := 0; i < count; i++ {
+			rec.IDs[i] = binary.BigEndian.Uint64(record[logRecordHeaderSize+i*8:])
+			rec.Pages[i] = pages[i*pageSize : (i+1)*pageSize]
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
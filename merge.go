@@ -0,0 +1,124 @@
+package go_kvstore
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Merge and Increment compute the new value of a key from the stored one in
+// the descent that writes it, see insertNonFull, so a read-modify-write
+// costs one descent and no other writer can come in between. Expired pairs
+// count as absent, the merged pair keeps the expiry of the stored one, so a
+// counter written by PutWithTTL stays a lease.
+
+var (
+	ErrUnknownMergeOperator = errors.New("merge operator is not registered, see Options.MergeOperators")
+	ErrNotANumber           = errors.New("value is not a number")
+)
+
+// MergeOperator combines operand into the value stored under key, found is
+// false if the key has none. An error stops the merge and is returned by
+// it.
+type MergeOperator interface {
+	Merge(key, existing string, found bool, operand string) (string, error)
+}
+
+// MergeFunc adapts a function to MergeOperator.
+type MergeFunc func(key, existing string, found bool, operand string) (string, error)
+
+func (f MergeFunc) Merge(key, existing string, found bool, operand string) (string, error) {
+	return f(key, existing, found, operand)
+}
+
+// addOperator adds the decimal operand to the decimal value, for Increment.
+var addOperator = MergeFunc(func(key, existing string, found bool, operand string) (string, error) {
+	var value int64
+	if found {
+		var err error
+		value, err = strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return "", ErrNotANumber
+		}
+	}
+	delta, err := strconv.ParseInt(operand, 10, 64)
+	if err != nil {
+		return "", ErrNotANumber
+	}
+	return strconv.FormatInt(value+delta, 10), nil
+})
+
+// Merge writes the result of the operator registered as name in
+// Options.MergeOperators applied to the value of key and operand, and
+// returns it.
+func (db *DB) Merge(key, name, operand string) (string, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return "", err
+	}
+	value, err := tx.Merge(key, name, operand)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return value, tx.Commit()
+}
+
+// Increment adds delta to the decimal value of key, a missing key counts as
+// 0, and returns the sum.
+func (db *DB) Increment(key string, delta int64) (int64, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	value, err := tx.Increment(key, delta)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return value, tx.Commit()
+}
+
+func (tx *Tx) Merge(key, name, operand string) (string, error) {
+	op, ok := tx.db.Options.MergeOperators[name]
+	if !ok {
+		return "", ErrUnknownMergeOperator
+	}
+	return tx.merge(key, op, operand)
+}
+
+func (tx *Tx) Increment(key string, delta int64) (int64, error) {
+	value, err := tx.merge(key, addOperator, strconv.FormatInt(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (tx *Tx) merge(key string, op MergeOperator, operand string) (string, error) {
+	if tx.closed {
+		return "", ErrTxClosed
+	}
+	if !tx.writable {
+		return "", ErrTxNotWritable
+	}
+	now := time.Now().UnixNano()
+	var merged string
+	err := tx.db.writePair(KVPair{Key: key}, func(pair *KVPair, old KVPair, found bool) error {
+		if found && old.expired(now) {
+			old, found = KVPair{}, false
+		}
+		value, err := op.Merge(key, old.Value, found, operand)
+		if err != nil {
+			return err
+		}
+		pair.Value = value
+		pair.ExpiresAt = old.ExpiresAt
+		merged = value
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return merged, nil
+}
@@ -0,0 +1,159 @@
+package go_kvstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// union keeps the comma separated set of the operands merged into a key.
+var union = MergeFunc(func(key, existing string, found bool, operand string) (string, error) {
+	if operand == "" {
+		return "", errors.New("empty member")
+	}
+	members := map[string]bool{operand: true}
+	if found {
+		for _, member := range strings.Split(existing, ",") {
+			members[member] = true
+		}
+	}
+	var list []string
+	for member := range members {
+		list = append(list, member)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ","), nil
+})
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "merge")
+	options := &Options{PageSize: 1024, MergeOperators: map[string]MergeOperator{"union": union}}
+
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	//enough counters to merge in internal nodes and across splits
+	expect := map[string]string{}
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := "counter" + strconv.Itoa(i)
+			value, err := db.Increment(key, int64(i))
+			if err != nil || value != int64(round*i) {
+				t.Fatal("increment returned ", value, err)
+			}
+			expect[key] = strconv.Itoa(round * i)
+		}
+	}
+	value, err := db.Increment("counter1", -5)
+	if err != nil || value != -2 {
+		t.Fatal("increment by a negative delta returned ", value, err)
+	}
+	expect["counter1"] = "-2"
+	err = db.Put("text", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect["text"] = "abc"
+	if _, err = db.Increment("text", 1); err != ErrNotANumber {
+		t.Fatal("incremented a text value ", err)
+	}
+
+	for _, member := range []string{"b", "a", "b", "c"} {
+		_, err = db.Merge("set", "union", member)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	merged, err := db.Merge("set", "union", "a")
+	if err != nil || merged != "a,b,c" {
+		t.Fatal("merge returned ", merged, err)
+	}
+	expect["set"] = "a,b,c"
+	if _, err = db.Merge("set", "union", ""); err == nil {
+		t.Fatal("merge ignored the operator error")
+	}
+	if _, err = db.Merge("set", "max", "1"); err != ErrUnknownMergeOperator {
+		t.Fatal("merged with an unknown operator ", err)
+	}
+	for i := 0; i < 40; i++ {
+		_, err = db.Merge("big", "union", strconv.Itoa(1000+i))
+		if err == ErrValueTooLong {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err != ErrValueTooLong {
+		t.Fatal("merged a value too long")
+	}
+	big, err := db.Get("big")
+	if err != nil || len(big) > maxValueSize {
+		t.Fatal("get returned ", big, err)
+	}
+	expect["big"] = big
+	checkContent(t, db, expect)
+
+	//an increment keeps the expiry of the counter
+	err = db.PutWithTTL("lease", "1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := db.Increment("lease", 1)
+	if err != nil || count != 2 {
+		t.Fatal("increment of a counter with a ttl returned ", count, err)
+	}
+	ttl, err := db.TTL("lease")
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatal("ttl after the increment ", ttl, err)
+	}
+	expect["lease"] = "2"
+
+	//a merge in a rolled back transaction is gone
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Increment("counter2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//concurrent increments lose no update
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				_, err := db.Increment("shared", 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expect["shared"] = "400"
+	checkContent(t, db, expect)
+}
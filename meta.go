@@ -0,0 +1,140 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+)
+
+// Page 0 of the file is the meta page, the root of the tree is always in
+// page 1. Files from before the meta page are upgraded on open, see
+// legacy.go.
+//
+// meta page: magic(8) | page size(4) | page nums(8) | tx id(8) | commit time(8) | applied index(8)
+// page nums is the number of pages in use, the file itself is preallocated
+// beyond it. Files written before it was recorded have 0 there and use the
+// file size. tx id counts the commits, commit time is the unix nanoseconds
+// of the last one. applied index is the last raft log entry the commit
+// applied, see RaftNode.
+//
+// The last 8 bytes of every page hold the tx id of the commit that last
+// wrote it, incremental backups copy the pages newer than a given tx id.
+const (
+	MetaPageID = 0
+	RootPageID = 1
+)
+
+var (
+	metaMagic      = []byte("GOKVDB01")
+	ErrInvalidFile = errors.New("not a go_kvstore db file")
+)
+
+const (
+	metaHeaderSize  = 12
+	pageTrailerSize = 8
+)
+
+// ReadPageSize returns the page size stored in the header of file, 0 if
+// the file has not been initialized yet.
+func ReadPageSize(file *os.File) (int, error) {
+	fileSize, err := GetFileSize(file)
+	if err != nil {
+		return 0, err
+	}
+	if fileSize == 0 {
+		return 0, nil
+	}
+	if fileSize < metaHeaderSize {
+		return 0, ErrInvalidFile
+	}
+
+	header := make([]byte, metaHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	if isBlankMeta(header) {
+		return 0, nil
+	}
+	if !bytes.Equal(header[:8], metaMagic) {
+		return 0, ErrInvalidFile
+	}
+	pageSize := int(binary.BigEndian.Uint32(header[8:12]))
+	if pageSize < MinPageSize || pageSize%MinPageSize != 0 {
+		return 0, ErrInvalidFile
+	}
+	return pageSize, nil
+}
+
+// isBlankMeta reports whether page starts with an all zero header, left by
+// a crash while creating the file or by the code before the meta page for
+// a db that was never written. Such a file is created anew.
+func isBlankMeta(page []byte) bool {
+	return bytes.Equal(page[:metaHeaderSize], make([]byte, metaHeaderSize))
+}
+
+func MetaPage(pageSize int, pageNums, txID uint64, commitTime int64, appliedIndex uint64) []byte {
+	page := make([]byte, pageSize)
+	copy(page, metaMagic)
+	binary.BigEndian.PutUint32(page[8:12], uint32(pageSize))
+	binary.BigEndian.PutUint64(page[12:20], pageNums)
+	binary.BigEndian.PutUint64(page[20:28], txID)
+	binary.BigEndian.PutUint64(page[28:36], uint64(commitTime))
+	binary.BigEndian.PutUint64(page[36:44], appliedIndex)
+	StampPage(page, txID)
+	return page
+}
+
+// MetaPageNums returns the page nums recorded in a meta page.
+func MetaPageNums(page []byte) (uint64, error) {
+	if !bytes.Equal(page[:8], metaMagic) {
+		return 0, ErrInvalidFile
+	}
+	return binary.BigEndian.Uint64(page[12:20]), nil
+}
+
+// MetaTxID returns the tx id of the last commit recorded in a meta page.
+func MetaTxID(page []byte) uint64 {
+	return binary.BigEndian.Uint64(page[20:28])
+}
+
+// MetaCommitTime returns the time of the last commit recorded in a meta
+// page, the zero time if unknown.
+func MetaCommitTime(page []byte) time.Time {
+	nanos := int64(binary.BigEndian.Uint64(page[28:36]))
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// MetaAppliedIndex returns the raft log index recorded in a meta page.
+func MetaAppliedIndex(page []byte) uint64 {
+	return binary.BigEndian.Uint64(page[36:44])
+}
+
+// StampPage records txID in the trailer of page.
+func StampPage(page []byte, txID uint64) {
+	binary.BigEndian.PutUint64(page[len(page)-pageTrailerSize:], txID)
+}
+
+// PageTxID returns the tx id of the commit that last wrote page.
+func PageTxID(page []byte) uint64 {
+	return binary.BigEndian.Uint64(page[len(page)-pageTrailerSize:])
+}
+
+// DegreeForPageSize returns the largest minimum degree whose full node
+// still fits in a page next to the trailer, see TreeNodeToBytes for the
+// layout. A full node of degree d holds 2d-1 slots and 2d children.
+func DegreeForPageSize(pageSize int) int {
+	return untrailedDegreeForPageSize(pageSize - pageTrailerSize)
+}
+
+// untrailedDegreeForPageSize is DegreeForPageSize for files written before
+// the trailer. It is one more for the page sizes where the trailer took
+// the space of a slot, such as 1024.
+func untrailedDegreeForPageSize(pageSize int) int {
+	return (pageSize - nodeFieldsSize + slotSize) / (2*slotSize + 2*childSize)
+}
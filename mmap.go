@@ -5,26 +5,146 @@ import (
 	"syscall"
 )
 
-func MMap(file *os.File, prot int) ([]byte, bool, error) {
+// mmapPager reads pages straight from a read only shared mapping of the
+// file and writes them with pwrite, which the mapping sees through the
+// page cache. The mapping may be larger than the file so that growing the
+// file does not always need a remap. When it has to, the mapping doubles
+// and the old one is retired, so pages returned before stay readable until
+// ReleaseRetired unmaps it. The db calls that at the end of every exclusive
+// transaction, when none of its readers hold a page.
+type mmapPager struct {
+	file     *os.File
+	pageSize int
+	fileSize int
+	content  []byte
+	retired  [][]byte
+}
+
+func NewMmapPager(file *os.File, options *Options) (Pager, error) {
 	fileSize, err := GetFileSize(file)
 	if err != nil {
-		return []byte{}, false, err
+		return nil, err
+	}
+	p := &mmapPager{
+		file:     file,
+		pageSize: options.PageSize,
+		fileSize: fileSize - fileSize%options.PageSize,
+	}
+	mmapSize := p.fileSize
+	if options.InitialMmapSize > mmapSize {
+		mmapSize = options.InitialMmapSize
+	}
+	err = p.mmap(mmapSize)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *mmapPager) mmap(size int) error {
+	size += (p.pageSize - size%p.pageSize) % p.pageSize
+	if size == 0 { //an empty file can not be mapped, wait for Allocate
+		return nil
+	}
+	buf, err := syscall.Mmap(int(p.file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
 	}
+	p.content = buf
+	return nil
+}
 
-	firstCreate := false
-	if fileSize == 0 {
-		firstCreate = true
-		_, err := file.WriteAt([]byte{byte(0)}, 1<<12-1)
+// ReleaseRetired unmaps the mappings retired by Allocate, pages read
+// before the last remap must no longer be used.
+func (p *mmapPager) ReleaseRetired() error {
+	for len(p.retired) > 0 {
+		err := syscall.Munmap(p.retired[0])
 		if err != nil {
-			return []byte{}, firstCreate, err
+			return err
 		}
-		fileSize += PageSize
+		p.retired = p.retired[1:]
+	}
+	return nil
+}
+
+func (p *mmapPager) munmap() error {
+	err := p.ReleaseRetired()
+	if err != nil {
+		return err
+	}
+	if p.content == nil {
+		return nil
 	}
-	buf, err := syscall.Mmap(int(file.Fd()), 0, fileSize, prot, syscall.MAP_SHARED)
+	err = syscall.Munmap(p.content)
 	if err != nil {
-		return []byte{}, firstCreate, err
+		return err
 	}
-	return buf, firstCreate, nil
+	p.content = nil
+	return nil
+}
+
+func (p *mmapPager) ReadPage(id uint64) ([]byte, error) {
+	if id >= p.Size() {
+		return nil, ErrPageOutOfRange
+	}
+	offset := int(id) * p.pageSize
+	return p.content[offset : offset+p.pageSize], nil
+}
+
+func (p *mmapPager) WritePage(id uint64, content []byte) error {
+	if id >= p.Size() {
+		return ErrPageOutOfRange
+	}
+	_, err := p.file.WriteAt(content[:p.pageSize], int64(id)*int64(p.pageSize))
+	return err
+}
+
+func (p *mmapPager) Allocate(pageNums uint64) error {
+	if pageNums <= p.Size() {
+		return nil
+	}
+	size := int(pageNums) * p.pageSize
+	err := syscall.Ftruncate(int(p.file.Fd()), int64(size))
+	if err != nil {
+		return err
+	}
+	p.fileSize = size
+	if size <= len(p.content) {
+		return nil
+	}
+
+	mmapSize := len(p.content)
+	if mmapSize == 0 {
+		mmapSize = size
+	}
+	for mmapSize < size {
+		mmapSize *= 2
+	}
+	old := p.content
+	err = p.mmap(mmapSize)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		p.retired = append(p.retired, old)
+	}
+	return nil
+}
+
+func (p *mmapPager) Sync() error {
+	return p.file.Sync()
+}
+
+func (p *mmapPager) Size() uint64 {
+	return uint64(p.fileSize / p.pageSize)
+}
+
+func (p *mmapPager) PageSize() int {
+	return p.pageSize
+}
+
+func (p *mmapPager) Close() error {
+	return p.munmap()
 }
 
 func GetFileSize(file *os.File) (int, error) {
@@ -5,9 +5,13 @@ import (
 )
 
 const (
+	// MinimumDegree is the degree of the tree with the default PageSize,
+	// DB.Degree holds the one of the opened file.
 	MinimumDegree = 14
 )
 
+var ErrKeyNotFound = errors.New("key not exist")
+
 //TODO: change int to int64 or int32
 
 type Node struct {
@@ -19,7 +23,20 @@ type Node struct {
 type KVPair struct {
 	Key   string //length:30
 	Value string //length:100
+	// ExpiresAt is the unix nanoseconds after which the pair reads as
+	// absent, 0 if it never expires.
+	ExpiresAt int64
+	// Version is the tx id of the commit that last wrote the pair, 0 for
+	// keys longer than MaxVersionedKeySize and pairs written before.
+	Version uint64
+	history bool //a kept revision under a historyKey
+}
+
+// expired reports whether the pair has expired at now, in unix nanoseconds.
+func (pair KVPair) expired(now int64) bool {
+	return pair.ExpiresAt != 0 && pair.ExpiresAt <= now
 }
+
 type BTree struct {
 	Root *Node
 }
@@ -29,6 +46,21 @@ func NewNode(isLeaf bool) *Node {
 		IsLeaf: isLeaf,
 	}
 }
+
+// Clone copies the node so that it can be modified without touching the
+// cached one.
+func (node *Node) Clone() *Node {
+	clone := &Node{
+		ID:       node.ID,
+		IsLeaf:   node.IsLeaf,
+		Datas:    make([]KVPair, len(node.Datas)),
+		Children: make([]uint64, len(node.Children)),
+	}
+	copy(clone.Datas, node.Datas)
+	copy(clone.Children, node.Children)
+	return clone
+}
+
 func NewTree() *BTree {
 	node := NewNode(true)
 	return &BTree{
@@ -37,67 +69,87 @@ func NewTree() *BTree {
 }
 
 func Search(db *DB, root *Node, key string) (string, error) {
+	pair, err := SearchPair(db, root, key)
+	return pair.Value, err
+}
+
+// SearchPair is Search returning the whole pair, expired or not.
+func SearchPair(db *DB, root *Node, key string) (KVPair, error) {
 	keyIndex := 0
 	for keyIndex < len(root.Datas) && key > root.Datas[keyIndex].Key {
 		keyIndex++
 	}
 	if keyIndex < len(root.Datas) && root.Datas[keyIndex].Key == key {
-		return root.Datas[keyIndex].Value, nil
+		return root.Datas[keyIndex], nil
 	}
 
 	if root.IsLeaf {
-		return "", errors.New("key not exist")
+		return KVPair{}, ErrKeyNotFound
 	}
-	//todo: perform disk read
-	child, err := db.ReadNodeFromID(root.Children[keyIndex])
+	child, err := db.ViewNodeFromID(root.Children[keyIndex])
 	if err != nil {
-		return "", err
+		return KVPair{}, err
 	}
-	return Search(db, child, key)
+	return SearchPair(db, child, key)
 }
 
 func (btree *BTree) Insert(db *DB, key, value string) error {
+	return btree.InsertPair(db, KVPair{Key: key, Value: value})
+}
+
+// InsertPair is Insert replacing the whole pair of pair.Key.
+func (btree *BTree) InsertPair(db *DB, pair KVPair) error {
+	return btree.insert(db, pair, nil)
+}
+
+// insertCond checks the pair stored under the key being inserted, found
+// is false if there is none. An error stops the insert and is returned,
+// otherwise pair, the one inserted, may be rewritten from old for merges.
+type insertCond func(pair *KVPair, old KVPair, found bool) error
+
+func (btree *BTree) insert(db *DB, pair KVPair, cond insertCond) error {
 	root := btree.Root
 	if root == nil {
-		node := NewNode(true)
-		node.ID = db.CurrentPageNums
-		db.CurrentPageNums++
-		node.Datas = []KVPair{
-			KVPair{
-				Key:   key,
-				Value: value,
-			},
+		if cond != nil {
+			err := cond(&pair, KVPair{}, false)
+			if err != nil {
+				return err
+			}
 		}
+		node := NewNode(true)
+		node.ID = RootPageID
+		node.Datas = []KVPair{pair}
 		btree.Root = node
-		err := db.WriteDirtyPage(0, node)
+		err := db.WriteDirtyPage(RootPageID, node)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 	if len(root.Datas) == 0 { //I do not think this should happen
-		root.Datas = []KVPair{
-			KVPair{
-				Key:   key,
-				Value: value,
-			},
+		if cond != nil {
+			err := cond(&pair, KVPair{}, false)
+			if err != nil {
+				return err
+			}
 		}
-		err := db.WriteDirtyPage(0, root)
+		root.Datas = []KVPair{pair}
+		err := db.WriteDirtyPage(RootPageID, root)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
-	if len(root.Datas) == 2*MinimumDegree-1 {
+	if len(root.Datas) == 2*db.Degree-1 {
 		newRoot := NewNode(false)
-		newRoot.ID = 0
+		newRoot.ID = RootPageID
 		btree.Root = newRoot
 
 		root.ID = db.CurrentPageNums
 		db.CurrentPageNums++
 
 		newRoot.Children = append(newRoot.Children, root.ID)
-		err := db.WriteDirtyPage(0, newRoot)
+		err := db.WriteDirtyPage(RootPageID, newRoot)
 		if err != nil {
 			return err
 		}
@@ -112,12 +164,12 @@ func (btree *BTree) Insert(db *DB, key, value string) error {
 			return err
 		}
 
-		err = InsertNoneFull(db, newRoot, key, value)
+		err = insertNonFull(db, newRoot, pair, cond)
 		if err != nil {
 			return err
 		}
 	} else {
-		err := InsertNoneFull(db, root, key, value)
+		err := insertNonFull(db, root, pair, cond)
 		if err != nil {
 			return err
 		}
@@ -127,14 +179,39 @@ func (btree *BTree) Insert(db *DB, key, value string) error {
 }
 
 func InsertNoneFull(db *DB, root *Node, key, value string) error {
+	return InsertPairNoneFull(db, root, KVPair{Key: key, Value: value})
+}
+
+// InsertPairNoneFull is InsertNoneFull replacing the whole pair of
+// pair.Key.
+func InsertPairNoneFull(db *DB, root *Node, pair KVPair) error {
+	return insertNonFull(db, root, pair, nil)
+}
+
+// insertNonFull checks cond where the descent finds the key, or where it
+// would insert it, so a conditional write costs no extra descent. Splits
+// done on the way stay if cond fails, they do not change the content.
+func insertNonFull(db *DB, root *Node, pair KVPair, cond insertCond) error {
+	key := pair.Key
 	if root.IsLeaf {
 		index := len(root.Datas) - 1
 		for index >= 0 && key < root.Datas[index].Key {
 			index--
 		}
 
-		if index >= 0 && root.Datas[index].Key == key {
-			root.Datas[index].Value = value
+		found := index >= 0 && root.Datas[index].Key == key
+		if cond != nil {
+			var old KVPair
+			if found {
+				old = root.Datas[index]
+			}
+			err := cond(&pair, old, found)
+			if err != nil {
+				return err
+			}
+		}
+		if found {
+			root.Datas[index] = pair
 			err := db.WriteDirtyPage(root.ID, root)
 
 			if err != nil {
@@ -145,13 +222,9 @@ func InsertNoneFull(db *DB, root *Node, key, value string) error {
 
 		root.Datas = append(root.Datas, KVPair{})
 		for i := len(root.Datas) - 1; i >= index+2; i-- {
-			root.Datas[i].Key = root.Datas[i-1].Key
-			root.Datas[i].Value = root.Datas[i-1].Value
-		}
-		root.Datas[index+1] = KVPair{
-			Key:   key,
-			Value: value,
+			root.Datas[i] = root.Datas[i-1]
 		}
+		root.Datas[index+1] = pair
 
 		err := db.WriteDirtyPage(root.ID, root)
 		if err != nil {
@@ -164,7 +237,13 @@ func InsertNoneFull(db *DB, root *Node, key, value string) error {
 			index--
 		}
 		if index >= 0 && root.Datas[index].Key == key {
-			root.Datas[index].Value = value
+			if cond != nil {
+				err := cond(&pair, root.Datas[index], true)
+				if err != nil {
+					return err
+				}
+			}
+			root.Datas[index] = pair
 			err := db.WriteDirtyPage(root.ID, root)
 
 			if err != nil {
@@ -177,10 +256,20 @@ func InsertNoneFull(db *DB, root *Node, key, value string) error {
 		if err != nil {
 			return err
 		}
-		if len(child.Datas) == 2*MinimumDegree-1 {
+		if len(child.Datas) == 2*db.Degree-1 {
 			err := SplitChild(db, root, index)
 			if err != nil {
-				return nil
+				return err
+			}
+			if key == root.Datas[index].Key { //the key itself moved up
+				if cond != nil {
+					err := cond(&pair, root.Datas[index], true)
+					if err != nil {
+						return err
+					}
+				}
+				root.Datas[index] = pair
+				return db.WriteDirtyPage(root.ID, root)
 			}
 			if key > root.Datas[index].Key {
 				index++
@@ -190,7 +279,7 @@ func InsertNoneFull(db *DB, root *Node, key, value string) error {
 		if err != nil {
 			return err
 		}
-		err = InsertNoneFull(db, child, key, value)
+		err = insertNonFull(db, child, pair, cond)
 		if err != nil {
 			return err
 		}
@@ -202,29 +291,23 @@ func SplitChild(db *DB, root *Node, index int) error {
 	if err != nil {
 		return err
 	}
-	keyToBeMoveUp := child.Datas[MinimumDegree-1].Key
-	valueToBeMoveUp := child.Datas[MinimumDegree-1].Value
+	pairToBeMoveUp := child.Datas[db.Degree-1]
 
 	splitedChild := NewNode(child.IsLeaf)
-	splitedChild.Datas = make([]KVPair, MinimumDegree-1)
-	for i := range splitedChild.Datas {
-		splitedChild.Datas[i].Key = ""
-		splitedChild.Datas[i].Value = ""
-	}
+	splitedChild.Datas = make([]KVPair, db.Degree-1)
 	splitedChild.ID = db.CurrentPageNums
 	db.CurrentPageNums++
 	//copy(splitedChild.Datas[:], child.Datas[MinimumDegree:])
 	for i := 0; i < len(splitedChild.Datas); i++ {
-		splitedChild.Datas[i].Key = child.Datas[MinimumDegree+i].Key
-		splitedChild.Datas[i].Value = child.Datas[MinimumDegree+i].Value
+		splitedChild.Datas[i] = child.Datas[db.Degree+i]
 	}
-	child.Datas = child.Datas[:MinimumDegree-1]
+	child.Datas = child.Datas[:db.Degree-1]
 	splitedChild.IsLeaf = child.IsLeaf
 
 	if !child.IsLeaf {
-		splitedChild.Children = make([]uint64, MinimumDegree)
-		copy(splitedChild.Children[:], child.Children[MinimumDegree:])
-		child.Children = child.Children[:MinimumDegree]
+		splitedChild.Children = make([]uint64, db.Degree)
+		copy(splitedChild.Children[:], child.Children[db.Degree:])
+		child.Children = child.Children[:db.Degree]
 	}
 
 	root.Children = append(root.Children, 0) //append a dummy childID
@@ -234,12 +317,10 @@ func SplitChild(db *DB, root *Node, index int) error {
 	root.Datas = append(root.Datas, KVPair{Key: "", Value: ""})
 	//copy(root.Datas[index+1:], root.Datas[index:len(root.Datas)-1])
 	for i := len(root.Datas) - 1; i >= index+1; i-- {
-		root.Datas[i].Key = root.Datas[i-1].Key
-		root.Datas[i].Value = root.Datas[i-1].Value
+		root.Datas[i] = root.Datas[i-1]
 	}
 
-	root.Datas[index].Key = keyToBeMoveUp
-	root.Datas[index].Value = valueToBeMoveUp
+	root.Datas[index] = pairToBeMoveUp
 
 	err = db.WriteDirtyPage(root.ID, root)
 	if err != nil {
@@ -270,14 +351,14 @@ func Tranverse(db *DB, node *Node) ([]KVPair, error) {
 	if node == nil {
 		return []KVPair{}, nil
 	}
-	if node.IsLeaf {
-		return node.Datas, nil
+	if node.IsLeaf { //node is the cached one, callers get their own slice
+		return append([]KVPair{}, node.Datas...), nil
 	}
 
 	var increasingKeys []KVPair
 	increasingKeys = make([]KVPair, 0)
 	for i := 0; i <= len(node.Datas); i++ {
-		child, err := db.ReadNodeFromID(node.Children[i])
+		child, err := db.ViewNodeFromID(node.Children[i])
 		if err != nil {
 			return []KVPair{}, err
 		}
@@ -291,123 +372,223 @@ func Tranverse(db *DB, node *Node) ([]KVPair, error) {
 }
 
 // the deletion starts here
-/*func (tree *BTree) Delete(key string) {
-	TranverseAndDeleteNode(tree.Root, key)
-	if len(tree.Root.Datas)==0{
-		if tree.Root.IsLeaf{
-			tree.Root=nil
-		}else{
-			//TODO: diskread child[0]
-			tree.Root=tree.Root.Children[0]
+func (btree *BTree) Delete(db *DB, key string) error {
+	return btree.delete(db, key, nil)
+}
+
+// deleteCond checks the pair stored under the key being deleted, an error
+// stops the delete and is returned.
+type deleteCond func(stored KVPair) error
+
+func (btree *BTree) delete(db *DB, key string, cond deleteCond) error {
+	root := btree.Root
+	if root == nil {
+		return ErrKeyNotFound
+	}
+	err := deleteFromNode(db, root, key, cond)
+	if len(root.Datas) == 0 && !root.IsLeaf { //root emptied by a merge, also of a delete stopped by cond, its only child becomes the new root
+		child, cerr := db.ReadNodeFromID(root.Children[0])
+		if cerr != nil {
+			return cerr
+		}
+		child.ID = RootPageID //the root always lives in RootPageID, the old child page is left unused
+		btree.Root = child
+		cerr = db.WriteDirtyPage(RootPageID, child)
+		if cerr != nil {
+			return cerr
 		}
-		//TODO: disk delete old root
 	}
+	return err
+}
+
+// DeleteFromNode removes key from the subtree rooted at node. Every node it
+// descends into holds at least db.Degree keys, so deletion never needs
+// to walk back up.
+func DeleteFromNode(db *DB, node *Node, key string) error {
+	return deleteFromNode(db, node, key, nil)
 }
 
-func TranverseAndDeleteNode(node *Node, key string) {
-	childIndex := SearchForChildIndex(node, key)
+// deleteFromNode is DeleteFromNode checking cond on the pair of key where
+// it is found, before anything of it is removed.
+func deleteFromNode(db *DB, node *Node, key string, cond deleteCond) error {
+	index := SearchForChildIndex(node, key)
+	found := index < len(node.Datas) && node.Datas[index].Key == key
+	if found && cond != nil {
+		err := cond(node.Datas[index])
+		if err != nil {
+			return err
+		}
+	}
+
 	if node.IsLeaf {
-		if childIndex == len(node.Datas) || key != node.Datas[childIndex].Key {
-			return //TODO: add a return error (key not found)
-		} else {
-			node.Datas = append(node.Datas[:childIndex], node.Datas[childIndex+1:]...)
-			return
+		if !found {
+			return ErrKeyNotFound
 		}
-	} else {
-		if childIndex < len(node.Datas) && node.Datas[childIndex].Key == key {
-			if len(node.Children[childIndex].Datas) >= MinimumDegree {
-				child := node.Children[childIndex]
-				node.Datas[childIndex].Key = child.Datas[len(child.Datas)-1].Key
-				TranverseAndDeleteNode(child, child.Datas[len(child.Keys)-1].Key)
-				return
-			} else if childIndex+1 < len(node.Children) && len(node.Children[childIndex+1].Datas) >= MinimumDegree {
-				child := node.Children[childIndex+1]
-				node.Datas[childIndex] = child.Datas[0]
-				TranverseAndDeleteNode(child, child.Datas[0].Key)
-				return
-			} else { //merge
-				child := node.Children[childIndex]
-				sibling := &Node{}
-
-				if childIndex+1 < len(node.Children) {
-					sibling = node.Children[childIndex+1]
-					child.Datas = append(child.Datas, node.Datas[childIndex])
-					child.Datas = append(child.Datas, sibling.Datas...)
-					child.Children = append(child.Children, sibling.Children...)
-					node.Datas = append(node.Datas[:childIndex], node.Datas[childIndex+1:]...)
-					node.Children = append(node.Children[:childIndex], node.Children[childIndex+1:]...)
-					//TODO: disk delete sibling
-					TranverseAndDeleteNode(child, key)
-					return
-				} else {
-					sibling = node.Children[childIndex-1]
-					sibling.Datas = append(sibling.Datas, node.Datas[childIndex])
-					sibling.Datas = append(sibling.Datas, child.Datas...)
-					sibling.Children = append(sibling.Children, child.Children...)
-					node.Datas = append(node.Datas[:childIndex-1], node.Datas[childIndex:]...)
-					node.Children = append(node.Children[:childIndex-1], node.Children[childIndex:]...)
-					//TODO: disk delete child
-					TranverseAndDeleteNode(sibling, key)
-					return
-				}
+		node.Datas = append(node.Datas[:index], node.Datas[index+1:]...)
+		return db.WriteDirtyPage(node.ID, node)
+	}
 
+	if found {
+		child, err := db.ReadNodeFromID(node.Children[index])
+		if err != nil {
+			return err
+		}
+		if len(child.Datas) >= db.Degree { //replace with predecessor
+			pred, err := LastPair(db, child)
+			if err != nil {
+				return err
+			}
+			node.Datas[index] = pred
+			err = db.WriteDirtyPage(node.ID, node)
+			if err != nil {
+				return err
 			}
-		} else if len(node.Children[childIndex].Datas) == MinimumDegree-1 {
-			mergeLeft := FillChild(node, childIndex)
+			return DeleteFromNode(db, child, pred.Key)
+		}
 
-			if mergeLeft {
-				TranverseAndDeleteNode(node.Children[childIndex-1], key)
-			} else {
-				TranverseAndDeleteNode(node.Children[childIndex], key)
+		sibling, err := db.ReadNodeFromID(node.Children[index+1])
+		if err != nil {
+			return err
+		}
+		if len(sibling.Datas) >= db.Degree { //replace with successor
+			succ, err := FirstPair(db, sibling)
+			if err != nil {
+				return err
+			}
+			node.Datas[index] = succ
+			err = db.WriteDirtyPage(node.ID, node)
+			if err != nil {
+				return err
 			}
-		} else {
-			TranverseAndDeleteNode(node.Children[childIndex], key)
+			return DeleteFromNode(db, sibling, succ.Key)
+		}
+
+		merged, err := MergeChildren(db, node, index)
+		if err != nil {
+			return err
+		}
+		return DeleteFromNode(db, merged, key) //checked already
+	}
+
+	child, err := db.ReadNodeFromID(node.Children[index])
+	if err != nil {
+		return err
+	}
+	if len(child.Datas) == db.Degree-1 {
+		child, err = FillChild(db, node, index)
+		if err != nil {
+			return err
 		}
 	}
+	return deleteFromNode(db, child, key, cond)
+}
 
+func FirstPair(db *DB, node *Node) (KVPair, error) {
+	for !node.IsLeaf {
+		child, err := db.ReadNodeFromID(node.Children[0])
+		if err != nil {
+			return KVPair{}, err
+		}
+		node = child
+	}
+	return node.Datas[0], nil
 }
 
-//the return value is true if merge left sibling
-func FillChild(parent *Node, childIndex int) bool {
-	child := parent.Children[childIndex]
-	if childIndex+1 < len(parent.Children) && len(parent.Children[childIndex+1].Datas) >= MinimumDegree {
-		sibling := parent.Children[childIndex+1]
-		child.Datas = append(child.Datas, parent.Datas[childIndex])
-		parent.Datas[childIndex] = sibling.Datas[0]
-		sibling.Datas = sibling.Datas[1:]
-		if !child.IsLeaf{
-			child.Children=append(child.Children,sibling.Children[0])
-			sibling.Children=sibling.Children[1:]
-		}
-		return false
-	} else if childIndex-1 >= 0 && len(parent.Children[childIndex-1].Keys) >= MinimumDegree {
-		sibling := parent.Children[childIndex-1]
-		child.Datas = append([]KVPair{parent.Datas[childIndex-1]}, child.Datas...)
-		parent.Datas[childIndex-1] = sibling.Datas[len(sibling.Datas)-1]
-		sibling.Datas = sibling.Datas[:len(sibling.Datas)-1]
-		if !child.IsLeaf{
-			child.Children=append([]*Node{sibling.Children[len(sibling.Children)-1]},child.Children...)
-			sibling.Children=sibling.Children[:len(sibling.Children)-1]
-		}
-		return false
-	} else if childIndex+1 < len(parent.Children) {
-		sibling := parent.Children[childIndex+1]
-		child.Datas = append(child.Datas, parent.Datas[childIndex])
-		child.Datas = append(child.Datas, sibling.Datas...)
+func LastPair(db *DB, node *Node) (KVPair, error) {
+	for !node.IsLeaf {
+		child, err := db.ReadNodeFromID(node.Children[len(node.Children)-1])
+		if err != nil {
+			return KVPair{}, err
+		}
+		node = child
+	}
+	return node.Datas[len(node.Datas)-1], nil
+}
+
+// MergeChildren merges parent.Children[index+1] and the separating key
+// into parent.Children[index] and returns the merged child. The right
+// child's page is left unused.
+func MergeChildren(db *DB, parent *Node, index int) (*Node, error) {
+	child, err := db.ReadNodeFromID(parent.Children[index])
+	if err != nil {
+		return nil, err
+	}
+	sibling, err := db.ReadNodeFromID(parent.Children[index+1])
+	if err != nil {
+		return nil, err
+	}
+
+	child.Datas = append(child.Datas, parent.Datas[index])
+	child.Datas = append(child.Datas, sibling.Datas...)
+	if !child.IsLeaf {
 		child.Children = append(child.Children, sibling.Children...)
-		parent.Datas = append(parent.Datas[:childIndex], parent.Datas[childIndex+1:]...)
-		parent.Children = append(parent.Children[:childIndex+1], parent.Children[childIndex+2:]...)
-		//TODO: disk delete sibling
-		return false
-	} else if childIndex-1 >= 0 {
-		sibling := parent.Children[childIndex-1]
-		sibling.Datas = append(sibling.Datas, parent.Datas[childIndex-1])
-		sibling.Datas = append(sibling.Datas, child.Datas...)
-		sibling.Children = append(sibling.Children, child.Children...)
-		parent.Datas = append(parent.Datas[:childIndex-1], parent.Datas[childIndex:]...)
-		parent.Children = append(parent.Children[:childIndex], parent.Children[childIndex+1:]...)
-		//TODO: disk delete child
-		return true
-	}
-	return false //TODO: throw error should not reach here
-}*/
+	}
+	parent.Datas = append(parent.Datas[:index], parent.Datas[index+1:]...)
+	parent.Children = append(parent.Children[:index+1], parent.Children[index+2:]...)
+
+	err = db.WriteDirtyPage(parent.ID, parent)
+	if err != nil {
+		return nil, err
+	}
+	err = db.WriteDirtyPage(child.ID, child)
+	if err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// FillChild makes sure parent.Children[index] holds at least db.Degree
+// keys, borrowing from a sibling or merging with one, and returns the node
+// the deletion should continue in.
+func FillChild(db *DB, parent *Node, index int) (*Node, error) {
+	child, err := db.ReadNodeFromID(parent.Children[index])
+	if err != nil {
+		return nil, err
+	}
+
+	if index > 0 {
+		sibling, err := db.ReadNodeFromID(parent.Children[index-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(sibling.Datas) >= db.Degree { //borrow from left sibling
+			child.Datas = append([]KVPair{parent.Datas[index-1]}, child.Datas...)
+			parent.Datas[index-1] = sibling.Datas[len(sibling.Datas)-1]
+			sibling.Datas = sibling.Datas[:len(sibling.Datas)-1]
+			if !child.IsLeaf {
+				child.Children = append([]uint64{sibling.Children[len(sibling.Children)-1]}, child.Children...)
+				sibling.Children = sibling.Children[:len(sibling.Children)-1]
+			}
+			return child, WriteNodes(db, parent, sibling, child)
+		}
+	}
+
+	if index < len(parent.Datas) {
+		sibling, err := db.ReadNodeFromID(parent.Children[index+1])
+		if err != nil {
+			return nil, err
+		}
+		if len(sibling.Datas) >= db.Degree { //borrow from right sibling
+			child.Datas = append(child.Datas, parent.Datas[index])
+			parent.Datas[index] = sibling.Datas[0]
+			sibling.Datas = sibling.Datas[1:]
+			if !child.IsLeaf {
+				child.Children = append(child.Children, sibling.Children[0])
+				sibling.Children = sibling.Children[1:]
+			}
+			return child, WriteNodes(db, parent, sibling, child)
+		}
+		return MergeChildren(db, parent, index)
+	}
+	return MergeChildren(db, parent, index-1)
+}
+
+func WriteNodes(db *DB, nodes ...*Node) error {
+	for _, node := range nodes {
+		err := db.WriteDirtyPage(node.ID, node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package go_kvstore
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncEveryCommit fsyncs the journal and the db file in every Commit.
+	SyncEveryCommit SyncPolicy = iota
+	// SyncNever leaves flushing to the OS. A process crash is still
+	// recovered from the journal, a power loss may lose or corrupt the
+	// last commits. DB.Sync flushes by hand.
+	SyncNever
+)
+
+const (
+	MinPageSize = 512
+)
+
+// Options configures Open. The zero value of a field means its default.
+type Options struct {
+	// PageSize is used when the file is created, afterwards the page size
+	// stored in the file header wins.
+	PageSize int
+	// FillFactor is how full BulkLoad and Compact pack the pages they
+	// build, between 0.5 and 1.
+	FillFactor float64
+	ReadOnly   bool
+	// LockTimeout bounds how long Open waits for the file lock before
+	// returning ErrTimeout. 0 waits forever, a negative timeout does not
+	// wait and returns ErrLocked.
+	LockTimeout time.Duration
+	SyncPolicy  SyncPolicy
+	// InitialMmapSize is the least number of bytes the mmap pager maps, so
+	// a growing file does not need to be remapped.
+	InitialMmapSize int
+	// CachePages bounds the number of clean pages kept decoded in memory.
+	CachePages int
+	// NewPager builds the pager of the db file and of its journal,
+	// NewMmapPager by default, NewFilePager for pread/pwrite.
+	NewPager func(file *os.File, options *Options) (Pager, error)
+	// MaxBatchSize is the most Batch calls committed together, a full
+	// batch commits without waiting for MaxBatchDelay.
+	MaxBatchSize int
+	// MaxBatchDelay is how long the first Batch call waits for others to
+	// join before committing.
+	MaxBatchDelay time.Duration
+	// LogArchiveDir, if set, is where every commit appends the pages it
+	// writes, for Restore to replay on top of a backup.
+	LogArchiveDir string
+	// LogSegmentSize is the size in bytes after which the archive starts a
+	// new segment file.
+	LogSegmentSize int64
+	// ChangeLog keeps the Put and Delete calls of every commit in
+	// <file>-changes for Subscribe.
+	ChangeLog bool
+	// ChangeLogRetention is how many bytes of the newest changes the
+	// change log keeps at least, negative to keep all of them. The log is
+	// trimmed once it holds twice as much.
+	ChangeLogRetention int64
+	// ExpirySweepInterval is how often a writable db deletes the keys
+	// whose TTL has passed, negative for never. Expired keys read as
+	// absent either way. Followers never sweep, see NewFollower.
+	ExpirySweepInterval time.Duration
+	// HistoryVersions is how many past revisions of every key writes keep
+	// for History and GetAt, 0 for none. Keys longer than
+	// MaxVersionedKeySize have no history.
+	HistoryVersions int
+	// MergeOperators are the operators Merge can apply, by name.
+	MergeOperators map[string]MergeOperator
+}
+
+var DefaultOptions = &Options{
+	PageSize:   PageSize,
+	FillFactor: 0.9,
+	SyncPolicy: SyncEveryCommit,
+	CachePages: DefaultCachePages,
+	NewPager:   NewMmapPager,
+
+	MaxBatchSize:  1000,
+	MaxBatchDelay: 10 * time.Millisecond,
+
+	LogSegmentSize: 64 << 20,
+
+	ChangeLogRetention: 64 << 20,
+
+	ExpirySweepInterval: time.Second,
+}
+
+var ErrInvalidOptions = errors.New("invalid options")
+
+// withDefaults returns a copy of options with the zero fields filled in.
+func (options *Options) withDefaults() (*Options, error) {
+	resolved := *DefaultOptions
+	if options != nil {
+		resolved = *options
+	}
+	if resolved.PageSize == 0 {
+		resolved.PageSize = DefaultOptions.PageSize
+	}
+	if resolved.FillFactor == 0 {
+		resolved.FillFactor = DefaultOptions.FillFactor
+	}
+	if resolved.CachePages == 0 {
+		resolved.CachePages = DefaultOptions.CachePages
+	}
+	if resolved.NewPager == nil {
+		resolved.NewPager = DefaultOptions.NewPager
+	}
+	if resolved.MaxBatchSize == 0 {
+		resolved.MaxBatchSize = DefaultOptions.MaxBatchSize
+	}
+	if resolved.MaxBatchDelay == 0 {
+		resolved.MaxBatchDelay = DefaultOptions.MaxBatchDelay
+	}
+	if resolved.LogSegmentSize == 0 {
+		resolved.LogSegmentSize = DefaultOptions.LogSegmentSize
+	}
+	if resolved.ChangeLogRetention == 0 {
+		resolved.ChangeLogRetention = DefaultOptions.ChangeLogRetention
+	}
+	if resolved.ExpirySweepInterval == 0 {
+		resolved.ExpirySweepInterval = DefaultOptions.ExpirySweepInterval
+	}
+
+	if resolved.PageSize < MinPageSize || resolved.PageSize%MinPageSize != 0 {
+		return nil, ErrInvalidOptions
+	}
+	if resolved.FillFactor < 0.5 || resolved.FillFactor > 1 {
+		return nil, ErrInvalidOptions
+	}
+	if resolved.CachePages < 0 || resolved.InitialMmapSize < 0 || resolved.MaxBatchSize < 0 || resolved.MaxBatchDelay < 0 || resolved.LogSegmentSize < 0 || resolved.HistoryVersions < 0 {
+		return nil, ErrInvalidOptions
+	}
+	return &resolved, nil
+}
@@ -0,0 +1,133 @@
+package go_kvstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOpenOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	_, err = Open(fileName, &Options{PageSize: 1000})
+	if err != ErrInvalidOptions {
+		t.Fatal("expect ErrInvalidOptions, got ", err)
+	}
+
+	db, err := Open(fileName, &Options{
+		PageSize:        1024,
+		SyncPolicy:      SyncNever,
+		InitialMmapSize: 1 << 20,
+		CachePages:      8,
+		NewPager:        NewMmapPager,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Degree != 3 {
+		t.Fatal("degree ", db.Degree, " with 1024 byte pages")
+	}
+	for i := 0; i < 1000; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		err = db.Delete(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	BtreeStructureTest(t, db)
+	err = db.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(fileName, &Options{LockTimeout: 200 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect ErrTimeout, got ", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(fileName, &Options{ReadOnly: true, PageSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.PageSize != 1024 {
+		t.Fatal("page size ", db.PageSize, " after reopen, expect 1024 from the header")
+	}
+	for i := 1; i < 1000; i += 2 {
+		val, err := db.Get(strconv.Itoa(i))
+		if err != nil || val != strconv.Itoa(i) {
+			t.Fatal("read after reopen error ", i, err)
+		}
+	}
+	err = db.Put("k", "v")
+	if err != ErrReadOnly {
+		t.Fatal("expect ErrReadOnly, got ", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(fileName, []byte("definitely not a db file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(fileName, nil)
+	if err != ErrInvalidFile {
+		t.Fatal("expect ErrInvalidFile, got ", err)
+	}
+}
+
+func TestLockErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = Open(fileName, &Options{LockTimeout: -1})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatal("expect ErrLocked, got ", err)
+	}
+
+	start := time.Now()
+	_, err = Open(fileName, &Options{LockTimeout: 150 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect ErrTimeout, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatal("lock timeout of 150ms took ", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = OpenContext(ctx, fileName, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatal("expect context.DeadlineExceeded, got ", err)
+	}
+}
@@ -0,0 +1,153 @@
+package go_kvstore
+
+import (
+	"errors"
+	"os"
+)
+
+// Pager is the page storage under a DB. Pages are PageSize() bytes and
+// numbered from 0.
+type Pager interface {
+	// ReadPage returns the content of page id. The slice may share memory
+	// with the pager, it must not be modified and is only valid until the
+	// next WritePage of the page, Close, or ReleaseRetired of a pager that
+	// has one.
+	ReadPage(id uint64) ([]byte, error)
+	WritePage(id uint64, content []byte) error
+	// Allocate grows the storage to hold at least pageNums pages.
+	Allocate(pageNums uint64) error
+	Sync() error
+	Size() uint64
+	PageSize() int
+	Close() error
+}
+
+// retiringPager is a Pager that keeps old memory around for the pages it
+// returned, until ReleaseRetired says they are no longer used.
+type retiringPager interface {
+	ReleaseRetired() error
+}
+
+var ErrPageOutOfRange = errors.New("page id out of range")
+
+// filePager reads and writes pages with pread/pwrite, for filesystems
+// where mmap misbehaves.
+type filePager struct {
+	file     *os.File
+	pageSize int
+	pageNums uint64
+}
+
+func NewFilePager(file *os.File, options *Options) (Pager, error) {
+	fileSize, err := GetFileSize(file)
+	if err != nil {
+		return nil, err
+	}
+	return &filePager{
+		file:     file,
+		pageSize: options.PageSize,
+		pageNums: uint64(fileSize / options.PageSize),
+	}, nil
+}
+
+func (p *filePager) ReadPage(id uint64) ([]byte, error) {
+	if id >= p.pageNums {
+		return nil, ErrPageOutOfRange
+	}
+	buf := make([]byte, p.pageSize)
+	_, err := p.file.ReadAt(buf, int64(id)*int64(p.pageSize))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *filePager) WritePage(id uint64, content []byte) error {
+	if id >= p.pageNums {
+		return ErrPageOutOfRange
+	}
+	_, err := p.file.WriteAt(content[:p.pageSize], int64(id)*int64(p.pageSize))
+	return err
+}
+
+func (p *filePager) Allocate(pageNums uint64) error {
+	if pageNums <= p.pageNums {
+		return nil
+	}
+	err := p.file.Truncate(int64(pageNums) * int64(p.pageSize))
+	if err != nil {
+		return err
+	}
+	p.pageNums = pageNums
+	return nil
+}
+
+func (p *filePager) Sync() error {
+	return p.file.Sync()
+}
+
+func (p *filePager) Size() uint64 {
+	return p.pageNums
+}
+
+func (p *filePager) PageSize() int {
+	return p.pageSize
+}
+
+func (p *filePager) Close() error {
+	return nil
+}
+
+// memPager keeps all pages in one heap buffer.
+type memPager struct {
+	pageSize int
+	content  []byte
+}
+
+func NewMemPager(pageSize int) Pager {
+	return &memPager{pageSize: pageSize}
+}
+
+func (p *memPager) ReadPage(id uint64) ([]byte, error) {
+	if id >= p.Size() {
+		return nil, ErrPageOutOfRange
+	}
+	offset := int(id) * p.pageSize
+	return p.content[offset : offset+p.pageSize], nil
+}
+
+func (p *memPager) WritePage(id uint64, content []byte) error {
+	if id >= p.Size() {
+		return ErrPageOutOfRange
+	}
+	offset := int(id) * p.pageSize
+	copy(p.content[offset:offset+p.pageSize], content)
+	return nil
+}
+
+func (p *memPager) Allocate(pageNums uint64) error {
+	if pageNums <= p.Size() {
+		return nil
+	}
+	content := make([]byte, int(pageNums)*p.pageSize)
+	copy(content, p.content)
+	p.content = content
+	return nil
+}
+
+func (p *memPager) Sync() error {
+	return nil
+}
+
+func (p *memPager) Size() uint64 {
+	return uint64(len(p.content) / p.pageSize)
+}
+
+func (p *memPager) PageSize() int {
+	return p.pageSize
+}
+
+func (p *memPager) Close() error {
+	p.content = nil
+	return nil
+}
@@ -0,0 +1,194 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPagers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newPagers := map[string]func(*os.File, *Options) (Pager, error){
+		"mmap": NewMmapPager,
+		"file": NewFilePager,
+		"mem":  func(*os.File, *Options) (Pager, error) { return NewMemPager(PageSize), nil },
+	}
+	for name, newPager := range newPagers {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pager, err := newPager(file, DefaultOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		PagerTest(t, name, pager)
+		file.Close()
+	}
+}
+
+func PagerTest(t *testing.T, name string, pager Pager) {
+	if pager.Size() != 0 {
+		t.Fatal(name, " new pager is not empty")
+	}
+	_, err := pager.ReadPage(0)
+	if err != ErrPageOutOfRange {
+		t.Fatal(name, " expect ErrPageOutOfRange, got ", err)
+	}
+	err = pager.Allocate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := bytes.Repeat([]byte{0x7}, PageSize)
+	err = pager.WritePage(2, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pager.Allocate(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pager.Size() != 10 {
+		t.Fatal(name, " size ", pager.Size(), " after allocate 10")
+	}
+	content, err := pager.ReadPage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, page) {
+		t.Fatal(name, " page lost after allocate")
+	}
+	err = pager.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilePagerReopenAsMmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db := &DB{}
+	err = db.InitWithPager(fileName, NewFilePager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = &DB{}
+	err = db.Init(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(strconv.Itoa(i))
+		if err != nil || val != strconv.Itoa(i) {
+			t.Fatal("read after reopen error ", i, err)
+		}
+	}
+}
+
+func TestGrowSize(t *testing.T) {
+	cases := [][3]int64{
+		{8 << 10, 9 << 10, 16 << 10},
+		{8 << 10, 100 << 10, 128 << 10},
+		{0, 12 << 10, 12 << 10},
+		{1 << 30, 1<<30 + 1, 2 << 30},
+		{2 << 30, 2<<30 + 1, 3 << 30},
+	}
+	for _, c := range cases {
+		if size := GrowSize(c[0], c[1]); size != c[2] {
+			t.Fatal("GrowSize(", c[0], ", ", c[1], ") = ", size, ", expect ", c[2])
+		}
+	}
+}
+
+func TestMmapGrowth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := len(db.Pager.(*mmapPager).content)
+	var page, meta []byte
+
+	for i := 0; i < 2000; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pageNums := db.CurrentPageNums
+	if db.Pager.Size() < pageNums || db.Pager.Size()&(db.Pager.Size()-1) != 0 {
+		t.Fatal("file of ", db.Pager.Size(), " pages is not grown by doubling for ", pageNums, " pages")
+	}
+	p := db.Pager.(*mmapPager)
+	if len(p.content) <= mapped {
+		t.Fatal("mapping never grew")
+	}
+	if len(p.retired) != 0 {
+		t.Fatal(len(p.retired), " old mappings kept after the write transactions ended")
+	}
+
+	page, err = p.ReadPage(MetaPageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta = append([]byte{}, page...)
+	err = p.Allocate(uint64(len(p.content)/p.pageSize) + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.retired) != 1 || !bytes.Equal(page, meta) {
+		t.Fatal("page read before the remap is no longer readable")
+	}
+	err = p.ReleaseRetired()
+	if err != nil || len(p.retired) != 0 {
+		t.Fatal("retired mapping not released ", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.CurrentPageNums != pageNums {
+		t.Fatal("reopened with ", db.CurrentPageNums, " pages in use, expect ", pageNums)
+	}
+}
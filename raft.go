@@ -0,0 +1,1131 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RaftNode runs a DB as the state machine of a raft group. Writes and
+// reads go through the replicated log and are applied on every member in
+// log order, so a majority of the members has to be up. The index of the
+// last applied entry is committed together with it in the meta page.
+//
+// Term, vote, log and membership are kept in <file>-raft, see raftStorage,
+// a restarted node goes on from there. Reads change nothing and are not
+// committed to the DB. A snapshot drops the log up to the applied index of
+// the DB, a follower that needs the entries before gets a full backup of
+// the leader's DB made for it. Membership changes add or remove one member
+// at a time and take effect as soon as they are in the log.
+
+var (
+	ErrNotLeader = errors.New("raft node is not the leader")
+	// ErrProposalDropped is returned when the entry of a call was replaced
+	// by a new leader before it committed.
+	ErrProposalDropped        = errors.New("raft proposal dropped by a leader change")
+	ErrConfigChangeInProgress = errors.New("raft membership change in progress")
+	ErrRaftStopped            = errors.New("raft node is stopped")
+)
+
+type RaftEntryType byte
+
+const (
+	RaftNoop RaftEntryType = iota
+	RaftPut
+	RaftDelete
+	RaftGet
+	RaftAddNode
+	RaftRemoveNode
+	// RaftExpire deletes the expired pair of Key if it still expires at
+	// Value, proposed by the sweeper of the DB.
+	RaftExpire
+)
+
+type RaftEntry struct {
+	Term  uint64
+	Index uint64
+	Type  RaftEntryType
+	Key   string //the node id for membership changes
+	Value string
+}
+
+// RaftConfig tunes a RaftNode, the zero value of a field means its default.
+type RaftConfig struct {
+	// TickInterval is the unit of the timeouts below.
+	TickInterval time.Duration
+	// ElectionTicks is the least number of ticks without a leader before
+	// a follower stands for election, the timeout is randomized up to
+	// twice of it.
+	ElectionTicks int
+	// HeartbeatTicks is how often the leader replicates to its followers.
+	HeartbeatTicks int
+	// SnapshotEntries is how many applied entries trigger a snapshot that
+	// truncates the log.
+	SnapshotEntries uint64
+	// MaxAppendEntries bounds the entries sent in one AppendEntries.
+	MaxAppendEntries int
+}
+
+var DefaultRaftConfig = RaftConfig{
+	TickInterval:     10 * time.Millisecond,
+	ElectionTicks:    10,
+	HeartbeatTicks:   2,
+	SnapshotEntries:  1024,
+	MaxAppendEntries: 64,
+}
+
+func (config RaftConfig) withDefaults() RaftConfig {
+	if config.TickInterval == 0 {
+		config.TickInterval = DefaultRaftConfig.TickInterval
+	}
+	if config.ElectionTicks == 0 {
+		config.ElectionTicks = DefaultRaftConfig.ElectionTicks
+	}
+	if config.HeartbeatTicks == 0 {
+		config.HeartbeatTicks = DefaultRaftConfig.HeartbeatTicks
+	}
+	if config.SnapshotEntries == 0 {
+		config.SnapshotEntries = DefaultRaftConfig.SnapshotEntries
+	}
+	if config.MaxAppendEntries == 0 {
+		config.MaxAppendEntries = DefaultRaftConfig.MaxAppendEntries
+	}
+	return config
+}
+
+type RequestVoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []RaftEntry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse carries the last index of the follower's log on
+// failure, so the leader can skip back.
+type AppendEntriesResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64
+}
+
+// InstallSnapshotRequest carries a full backup of the leader's DB, which
+// has applied the log up to Index.
+type InstallSnapshotRequest struct {
+	Term    uint64
+	Leader  string
+	Index   uint64
+	LogTerm uint64
+	Members []string
+	Data    []byte
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// RaftTransport carries the RPCs of a node to the member to.
+type RaftTransport interface {
+	RequestVote(ctx context.Context, to string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, to string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, to string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+type raftResult struct {
+	value string
+	err   error
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+// raftSnapshot is the last snapshot taken or installed, the log starts
+// right after it.
+type raftSnapshot struct {
+	index   uint64
+	term    uint64
+	members []string
+}
+
+type RaftNode struct {
+	ID        string
+	DB        *DB
+	transport RaftTransport
+	config    RaftConfig
+	storage   *raftStorage
+
+	mu        sync.Mutex
+	role      raftRole
+	term      uint64
+	votedFor  string
+	savedTerm uint64 //term and vote as last saved to storage
+	savedVote string
+	leader    string
+	log       []RaftEntry //log[0] stands for the snapshot, its index and term
+	snapshot  *raftSnapshot
+	members   []string
+
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool
+	waiters     map[uint64]raftWaiter
+
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+	rand             *rand.Rand
+
+	applyMu   sync.Mutex //held while applying entries or installing a snapshot
+	applyCond *sync.Cond
+	stopped   bool
+	stop      chan struct{}
+	done      sync.WaitGroup
+}
+
+// NewRaftNode makes db the state machine of node id. members is the
+// initial membership of the group and the same on all of its first nodes,
+// a node added later by AddNode starts with none. A node restarted on the
+// same db goes on with the state it saved and ignores members. db must be
+// file backed and is only written through the log from now on.
+func NewRaftNode(id string, db *DB, transport RaftTransport, members []string, config RaftConfig) (*RaftNode, error) {
+	if db.File == nil {
+		return nil, errors.New("raft needs a file backed db to install snapshots")
+	}
+	db.mu.Lock()
+	db.replica = true
+	applied := db.AppliedIndex
+	db.mu.Unlock()
+
+	storage, state, err := openRaftStorage(db.FileName, applied)
+	if err != nil {
+		return nil, err
+	}
+	n := &RaftNode{
+		ID:          id,
+		DB:          db,
+		transport:   transport,
+		config:      config.withDefaults(),
+		storage:     storage,
+		commitIndex: applied, //only committed entries are applied
+		lastApplied: applied,
+		waiters:     make(map[uint64]raftWaiter),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano() + int64(len(id)))),
+		stop:        make(chan struct{}),
+	}
+	if state == nil || state.snapshot == nil {
+		n.snapshot = &raftSnapshot{index: applied, members: append([]string{}, members...)}
+		n.log = []RaftEntry{{Index: applied}}
+		err = storage.rewrite(0, "", n.snapshot, nil)
+	} else {
+		n.term, n.votedFor = state.term, state.votedFor
+		n.snapshot = state.snapshot
+		n.log = append([]RaftEntry{{Index: state.snapshot.index, Term: state.snapshot.term}}, state.entries...)
+		if applied < n.firstIndex() || applied > n.lastIndex() {
+			err = errRaftStateBehind
+		}
+	}
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+	n.recomputeMembers()
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionTimer()
+	db.mu.Lock()
+	db.expire = n.expire
+	db.mu.Unlock()
+	return n, nil
+}
+
+// Start runs the timers and the apply loop of the node.
+func (n *RaftNode) Start() {
+	n.done.Add(2)
+	go n.runTicker()
+	go n.runApply()
+}
+
+// Stop stops the node, pending calls return ErrRaftStopped. The DB is
+// left open.
+func (n *RaftNode) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	for index, waiter := range n.waiters {
+		waiter.ch <- raftResult{err: ErrRaftStopped}
+		delete(n.waiters, index)
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.done.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.storage.Close()
+}
+
+// Leader returns the id of the current leader as far as the node knows,
+// empty if unknown.
+func (n *RaftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == raftLeader
+}
+
+// Members returns the current membership.
+func (n *RaftNode) Members() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.members...)
+}
+
+// AppliedIndex returns the last log entry applied to the DB.
+func (n *RaftNode) AppliedIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lastApplied
+}
+
+// Put writes key once the entry is committed and applied on the leader.
+func (n *RaftNode) Put(ctx context.Context, key, value string) error {
+	_, err := n.propose(ctx, RaftEntry{Type: RaftPut, Key: key, Value: value})
+	return err
+}
+
+// Delete removes key, ErrKeyNotFound is returned if it does not exist.
+func (n *RaftNode) Delete(ctx context.Context, key string) error {
+	_, err := n.propose(ctx, RaftEntry{Type: RaftDelete, Key: key})
+	return err
+}
+
+// Get reads key through the log, it sees every write committed before.
+// Reads of the DB itself are only as fresh as the node.
+func (n *RaftNode) Get(ctx context.Context, key string) (string, error) {
+	return n.propose(ctx, RaftEntry{Type: RaftGet, Key: key})
+}
+
+// AddNode adds the node id to the group, it catches up from the leader.
+func (n *RaftNode) AddNode(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, RaftEntry{Type: RaftAddNode, Key: id})
+	return err
+}
+
+// RemoveNode removes the node id from the group.
+func (n *RaftNode) RemoveNode(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, RaftEntry{Type: RaftRemoveNode, Key: id})
+	return err
+}
+
+// expire proposes RaftExpire entries for the expired pairs of the
+// sweeper and waits until they are applied, only the leader does.
+func (n *RaftNode) expire(entries []expiryEntry) (int, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return 0, ErrRaftStopped
+	}
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	proposed := make([]RaftEntry, len(entries))
+	for i, entry := range entries {
+		proposed[i] = RaftEntry{Type: RaftExpire, Key: entry.key, Value: strconv.FormatInt(entry.expiresAt, 10)}
+	}
+	index, err := n.appendEntries(proposed)
+	if err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	ch := make(chan raftResult, 1)
+	n.waiters[index] = raftWaiter{term: n.term, ch: ch} //the entries before apply first
+	n.broadcastAppend()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(2 * n.rpcTimeout())
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		if result.err == ErrKeyNotFound { //rewritten since
+			result.err = nil
+		}
+		return len(entries), result.err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return 0, context.DeadlineExceeded
+	}
+}
+
+func (n *RaftNode) propose(ctx context.Context, entry RaftEntry) (string, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return "", ErrRaftStopped
+	}
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return "", ErrNotLeader
+	}
+	if entry.Type == RaftAddNode || entry.Type == RaftRemoveNode {
+		for _, e := range n.log[n.commitIndex-n.firstIndex()+1:] {
+			if e.Type == RaftAddNode || e.Type == RaftRemoveNode {
+				n.mu.Unlock()
+				return "", ErrConfigChangeInProgress
+			}
+		}
+	}
+	index, err := n.appendEntry(entry)
+	if err != nil {
+		n.mu.Unlock()
+		return "", err
+	}
+	ch := make(chan raftResult, 1)
+	n.waiters[index] = raftWaiter{term: n.term, ch: ch}
+	n.broadcastAppend()
+	n.mu.Unlock()
+
+	select {
+	case result := <-ch:
+		return result.value, result.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// appendEntry appends entry to the leader's log once it is saved, called
+// with n.mu held.
+func (n *RaftNode) appendEntry(entry RaftEntry) (uint64, error) {
+	return n.appendEntries([]RaftEntry{entry})
+}
+
+// appendEntries appends entries with one save and returns the index of
+// the last, called with n.mu held.
+func (n *RaftNode) appendEntries(entries []RaftEntry) (uint64, error) {
+	for i := range entries {
+		entries[i].Term = n.term
+		entries[i].Index = n.lastIndex() + 1 + uint64(i)
+	}
+	err := n.storage.appendEntries(entries)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		n.log = append(n.log, entry)
+		n.applyMembership(entry)
+	}
+	last := entries[len(entries)-1].Index
+	n.matchIndex[n.ID] = last
+	n.advanceCommit()
+	return last, nil
+}
+
+func (n *RaftNode) firstIndex() uint64 {
+	return n.log[0].Index
+}
+
+func (n *RaftNode) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *RaftNode) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+func (n *RaftNode) termAt(index uint64) uint64 {
+	return n.log[index-n.firstIndex()].Term
+}
+
+func (n *RaftNode) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMembership changes the members when a membership entry enters the
+// log.
+func (n *RaftNode) applyMembership(entry RaftEntry) {
+	switch entry.Type {
+	case RaftAddNode:
+		if !n.isMember(entry.Key) {
+			n.members = append(n.members, entry.Key)
+		}
+		if n.role == raftLeader {
+			if _, hit := n.nextIndex[entry.Key]; !hit {
+				n.nextIndex[entry.Key] = n.lastIndex() + 1
+				n.matchIndex[entry.Key] = 0
+			}
+		}
+	case RaftRemoveNode:
+		for i, member := range n.members {
+			if member == entry.Key {
+				n.members = append(n.members[:i:i], n.members[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// recomputeMembers rebuilds the members from the snapshot and the log
+// after the log was truncated.
+func (n *RaftNode) recomputeMembers() {
+	n.members = append([]string{}, n.snapshot.members...)
+	for _, entry := range n.log[1:] {
+		n.applyMembership(entry)
+	}
+}
+
+// membersAt returns the membership as of index.
+func (n *RaftNode) membersAt(index uint64) []string {
+	saved := n.members
+	n.members = append([]string{}, n.snapshot.members...)
+	for _, entry := range n.log[1 : index-n.firstIndex()+1] {
+		n.applyMembership(entry)
+	}
+	members := n.members
+	n.members = saved
+	return members
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.config.ElectionTicks + n.rand.Intn(n.config.ElectionTicks)
+}
+
+func (n *RaftNode) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.role = raftFollower
+	n.leader = leader
+}
+
+// saveState saves term and vote if they changed, before the node answers
+// or asks for votes. Called with n.mu held.
+func (n *RaftNode) saveState() error {
+	if n.term == n.savedTerm && n.votedFor == n.savedVote {
+		return nil
+	}
+	err := n.storage.saveState(n.term, n.votedFor)
+	if err != nil {
+		return err
+	}
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+	return nil
+}
+
+func (n *RaftNode) runTicker() {
+	defer n.done.Done()
+	ticker := time.NewTicker(n.config.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *RaftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == raftLeader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.config.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+		return
+	}
+	n.electionElapsed++
+	if n.electionElapsed >= n.electionTimeout && n.isMember(n.ID) {
+		n.campaign()
+	}
+}
+
+// campaign stands for election in the next term, called with n.mu held.
+func (n *RaftNode) campaign() {
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.ID
+	n.leader = ""
+	n.resetElectionTimer()
+	if n.saveState() != nil { //tried again on the next timeout
+		n.role = raftFollower
+		return
+	}
+
+	term := n.term
+	votes := map[string]bool{n.ID: true}
+	if n.hasQuorum(votes) {
+		n.becomeLeader()
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         term,
+		Candidate:    n.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, member := range n.members {
+		if member == n.ID {
+			continue
+		}
+		go func(member string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout())
+			defer cancel()
+			resp, err := n.transport.RequestVote(ctx, member, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				n.saveState()
+				return
+			}
+			if n.role != raftCandidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			votes[member] = true
+			if n.hasQuorum(votes) {
+				n.becomeLeader()
+			}
+		}(member)
+	}
+}
+
+func (n *RaftNode) rpcTimeout() time.Duration {
+	return time.Duration(n.config.ElectionTicks) * n.config.TickInterval
+}
+
+// hasQuorum reports whether the nodes in set are a majority of the
+// members.
+func (n *RaftNode) hasQuorum(set map[string]bool) bool {
+	count := 0
+	for _, member := range n.members {
+		if set[member] {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *RaftNode) becomeLeader() {
+	n.role = raftLeader
+	n.leader = n.ID
+	n.heartbeatElapsed = 0
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inflight = make(map[string]bool)
+	for _, member := range n.members {
+		n.nextIndex[member] = n.lastIndex() + 1
+		n.matchIndex[member] = 0
+	}
+	_, err := n.appendEntry(RaftEntry{Type: RaftNoop}) //commits the entries of the previous terms
+	if err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.broadcastAppend()
+}
+
+// broadcastAppend replicates to every follower without a pending RPC,
+// called with n.mu held.
+func (n *RaftNode) broadcastAppend() {
+	for _, member := range n.members {
+		if member != n.ID && !n.inflight[member] {
+			n.sendAppend(member)
+		}
+	}
+}
+
+func (n *RaftNode) sendAppend(member string) {
+	if _, hit := n.nextIndex[member]; !hit {
+		n.nextIndex[member] = n.lastIndex() + 1
+	}
+	next := n.nextIndex[member]
+	n.inflight[member] = true
+	term := n.term
+
+	if next <= n.firstIndex() {
+		go n.sendSnapshot(member, term)
+		return
+	}
+
+	entries := n.log[next-n.firstIndex():]
+	if len(entries) > n.config.MaxAppendEntries {
+		entries = entries[:n.config.MaxAppendEntries]
+	}
+	req := &AppendEntriesRequest{
+		Term:         term,
+		Leader:       n.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      append([]RaftEntry{}, entries...),
+		LeaderCommit: n.commitIndex,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout())
+		defer cancel()
+		resp, err := n.transport.AppendEntries(ctx, member, req)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inflight[member] = false
+		if err != nil || n.role != raftLeader || n.term != term {
+			return
+		}
+		if resp.Term > n.term {
+			n.becomeFollower(resp.Term, "")
+			n.saveState()
+			return
+		}
+		if !resp.Success {
+			next := n.nextIndex[member] - 1
+			if resp.LastIndex+1 < next {
+				next = resp.LastIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.nextIndex[member] = next
+			n.sendAppend(member)
+			return
+		}
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[member] {
+			n.matchIndex[member] = match
+		}
+		n.nextIndex[member] = match + 1
+		n.advanceCommit()
+		if n.nextIndex[member] <= n.lastIndex() {
+			n.sendAppend(member)
+		}
+	}()
+}
+
+// sendSnapshot sends member a backup of the DB made for it, the log
+// before its next entry is gone.
+func (n *RaftNode) sendSnapshot(member string, term uint64) {
+	req, err := n.makeSnapshot(term)
+	if err != nil {
+		n.mu.Lock()
+		n.inflight[member] = false
+		n.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.rpcTimeout())
+	defer cancel()
+	resp, err := n.transport.InstallSnapshot(ctx, member, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[member] = false
+	if err != nil || n.role != raftLeader || n.term != req.Term {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		n.saveState()
+		return
+	}
+	if req.Index > n.matchIndex[member] {
+		n.matchIndex[member] = req.Index
+	}
+	n.nextIndex[member] = req.Index + 1
+	n.advanceCommit()
+}
+
+// makeSnapshot backs up the DB, the request goes up to the entry it
+// applied last.
+func (n *RaftNode) makeSnapshot(term uint64) (*InstallSnapshotRequest, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	var buf bytes.Buffer
+	_, err := n.DB.Backup(&buf)
+	if err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := MetaAppliedIndex(data)
+	if index < n.firstIndex() || index > n.lastIndex() {
+		return nil, errRaftStateBehind
+	}
+	return &InstallSnapshotRequest{
+		Term:    term,
+		Leader:  n.ID,
+		Index:   index,
+		LogTerm: n.termAt(index),
+		Members: n.membersAt(index),
+		Data:    data,
+	}, nil
+}
+
+// advanceCommit commits the entries of the current term stored on a
+// majority, called with n.mu held.
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.firstIndex(); index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		stored := make(map[string]bool)
+		for _, member := range n.members {
+			if n.matchIndex[member] >= index {
+				stored[member] = true
+			}
+		}
+		if n.hasQuorum(stored) {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			break
+		}
+	}
+}
+
+// HandleRequestVote answers a RequestVote, the transports call it.
+func (n *RaftNode) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		n.saveState()
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if upToDate {
+		n.votedFor = req.Candidate
+		if n.saveState() != nil {
+			n.votedFor = n.savedVote
+			return resp
+		}
+		n.resetElectionTimer()
+		resp.VoteGranted = true
+	}
+	return resp
+}
+
+// HandleAppendEntries answers an AppendEntries, the transports call it.
+func (n *RaftNode) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return &AppendEntriesResponse{Term: n.term}
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetElectionTimer()
+	resp := &AppendEntriesResponse{Term: n.term, LastIndex: n.lastIndex()}
+	if n.saveState() != nil {
+		return resp
+	}
+
+	entries := req.Entries
+	prevIndex := req.PrevLogIndex
+	if prevIndex < n.firstIndex() { //the start is in our snapshot, committed and equal
+		skip := n.firstIndex() - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prevIndex = n.firstIndex()
+		if len(entries) > 0 && entries[0].Index != prevIndex+1 {
+			return resp
+		}
+	} else {
+		if prevIndex > n.lastIndex() {
+			return resp
+		}
+		if n.termAt(prevIndex) != req.PrevLogTerm {
+			resp.LastIndex = prevIndex - 1
+			return resp
+		}
+	}
+
+	var appended []RaftEntry
+	truncated := false
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		appended = entries[i:]
+		break
+	}
+	if len(appended) > 0 {
+		err := n.storage.appendEntries(appended)
+		if err != nil {
+			return resp
+		}
+		if appended[0].Index <= n.lastIndex() {
+			n.log = n.log[:appended[0].Index-n.firstIndex()]
+			truncated = true
+		}
+		n.log = append(n.log, appended...)
+	}
+	if truncated {
+		n.recomputeMembers()
+	} else {
+		for _, entry := range appended {
+			n.applyMembership(entry)
+		}
+	}
+
+	lastNew := prevIndex + uint64(len(entries))
+	if req.LeaderCommit > n.commitIndex {
+		commit := req.LeaderCommit
+		if commit > lastNew {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.applyCond.Broadcast()
+		}
+	}
+	resp.Success = true
+	resp.LastIndex = n.lastIndex()
+	return resp
+}
+
+// HandleInstallSnapshot answers an InstallSnapshot, the transports call it.
+func (n *RaftNode) HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &InstallSnapshotResponse{Term: n.term}
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetElectionTimer()
+	err := n.saveState()
+	n.mu.Unlock()
+	if err != nil {
+		return &InstallSnapshotResponse{Term: req.Term}
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Index <= n.lastApplied {
+		return resp
+	}
+	snapshot := &raftSnapshot{index: req.Index, term: req.LogTerm, members: req.Members}
+	err = n.storage.saveSnapshot(snapshot) //only counts once the DB is replaced
+	if err != nil {
+		return resp
+	}
+
+	n.mu.Unlock()
+	err = n.DB.installSnapshot(req.Data)
+	n.mu.Lock()
+	if err != nil {
+		return resp
+	}
+	if req.Index <= n.lastIndex() && n.termAt(req.Index) == req.LogTerm {
+		n.log = append([]RaftEntry{{Index: req.Index, Term: req.LogTerm}}, n.log[req.Index-n.firstIndex()+1:]...)
+	} else {
+		n.log = []RaftEntry{{Index: req.Index, Term: req.LogTerm}}
+	}
+	n.snapshot = snapshot
+	n.recomputeMembers()
+	if req.Index > n.commitIndex {
+		n.commitIndex = req.Index
+	}
+	n.lastApplied = req.Index
+	return resp
+}
+
+func (n *RaftNode) runApply() {
+	defer n.done.Done()
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.stopped {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		err := n.applyCommitted()
+		n.applyMu.Unlock()
+		if err != nil { //retried on the next tick
+			select {
+			case <-time.After(n.config.TickInterval):
+			case <-n.stop:
+				return
+			}
+		}
+	}
+}
+
+// applyCommitted applies the committed entries to the DB and takes a
+// snapshot once enough accumulated. Called with n.applyMu held.
+func (n *RaftNode) applyCommitted() error {
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= n.commitIndex || n.stopped {
+			n.mu.Unlock()
+			break
+		}
+		entry := n.log[n.lastApplied+1-n.firstIndex()]
+		n.mu.Unlock()
+
+		result, err := n.applyEntry(entry)
+		if err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		n.lastApplied = entry.Index
+		if waiter, hit := n.waiters[entry.Index]; hit {
+			if waiter.term != entry.Term {
+				result = raftResult{err: ErrProposalDropped}
+			}
+			waiter.ch <- result
+			delete(n.waiters, entry.Index)
+		}
+		if entry.Type == RaftRemoveNode && entry.Key == n.ID && n.role == raftLeader {
+			n.becomeFollower(n.term, "") //removed itself, the rest elects a new leader
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	due := n.lastApplied-n.snapshot.index >= n.config.SnapshotEntries
+	n.mu.Unlock()
+	if due {
+		return n.takeSnapshot()
+	}
+	return nil
+}
+
+// applyEntry runs entry against the DB and records it as applied in the
+// same commit. Entries that change nothing in the DB, reads, membership
+// changes and failed writes, are not committed, after a restart they are
+// applied again, to no one. The error is set if the commit failed and entry
+// has to be applied again, the result holds the outcome for the caller.
+func (n *RaftNode) applyEntry(entry RaftEntry) (raftResult, error) {
+	switch entry.Type {
+	case RaftGet:
+		value, err := n.DB.Get(entry.Key)
+		return raftResult{value: value, err: err}, nil
+	case RaftPut, RaftDelete, RaftExpire:
+	default:
+		return raftResult{}, nil
+	}
+	tx, err := n.DB.begin(true, true)
+	if err != nil {
+		return raftResult{}, err
+	}
+	var result raftResult
+	switch entry.Type {
+	case RaftPut:
+		result.err = tx.Put(entry.Key, entry.Value)
+	case RaftDelete:
+		result.err = tx.Delete(entry.Key)
+	case RaftExpire:
+		var expiresAt int64
+		expiresAt, result.err = strconv.ParseInt(entry.Value, 10, 64)
+		if result.err == nil {
+			result.err = n.DB.expirePair(entry.Key, expiresAt)
+		}
+	}
+	if result.err != nil { //a failed write changes nothing, on every member
+		tx.Rollback()
+		return result, nil
+	}
+	applied := n.DB.AppliedIndex
+	n.DB.AppliedIndex = entry.Index
+	err = n.DB.Commit()
+	if err != nil {
+		n.DB.AppliedIndex = applied
+		tx.discard()
+		tx.close()
+		return raftResult{}, err
+	}
+	tx.close()
+	return result, nil
+}
+
+// takeSnapshot drops the log up to the last entry committed to the DB,
+// the DB itself is the snapshot. Called with n.applyMu held.
+func (n *RaftNode) takeSnapshot() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.DB.AppliedIndex
+	if index <= n.firstIndex() {
+		return nil
+	}
+	snapshot := &raftSnapshot{
+		index:   index,
+		term:    n.termAt(index),
+		members: n.membersAt(index),
+	}
+	log := append([]RaftEntry{{Index: index, Term: snapshot.term}}, n.log[index-n.firstIndex()+1:]...)
+	err := n.storage.rewrite(n.term, n.votedFor, snapshot, log[1:])
+	if err != nil {
+		return err
+	}
+	n.log = log
+	n.snapshot = snapshot
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+	return nil
+}
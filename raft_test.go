@@ -0,0 +1,387 @@
+package go_kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testRaftConfig = RaftConfig{
+	TickInterval:    2 * time.Millisecond,
+	SnapshotEntries: 50,
+}
+
+func waitForLeader(t *testing.T, nodes []*RaftNode) *RaftNode {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func waitForApplied(t *testing.T, nodes []*RaftNode, index uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for node.AppliedIndex() < index {
+			if time.Now().After(deadline) {
+				t.Fatal("node ", node.ID, " applied ", node.AppliedIndex(), ", expect ", index)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// raftPut retries a Put on the current leader until it succeeds.
+func raftPut(t *testing.T, nodes []*RaftNode, key, value string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := waitForLeader(t, nodes)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := leader.Put(ctx, key, value)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	t.Fatal("put of ", key, " did not commit")
+}
+
+func TestRaft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	net := NewRaftNetwork()
+	startNode := func(id string, members []string) *RaftNode {
+		db, err := Open(filepath.Join(dir, id), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := NewRaftNode(id, db, net.Transport(id), members, testRaftConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.Add(node)
+		node.Start()
+		return node
+	}
+	members := []string{"a", "b", "c"}
+	var nodes []*RaftNode
+	for _, id := range members {
+		nodes = append(nodes, startNode(id, members))
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+			node.DB.Close()
+		}
+	}()
+
+	leader := waitForLeader(t, nodes)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		err = leader.Put(ctx, strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = leader.Delete(ctx, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader.Delete(ctx, "0") != ErrKeyNotFound {
+		t.Fatal("delete of a missing key succeeded")
+	}
+	value, err := leader.Get(ctx, "1")
+	if err != nil || value != "1" {
+		t.Fatal("get returned ", value, err)
+	}
+	for _, node := range nodes {
+		if node != leader && node.Put(ctx, "x", "y") != ErrNotLeader {
+			t.Fatal("follower accepted a put")
+		}
+		if node.DB.Put("x", "y") != ErrReadOnly {
+			t.Fatal("db of a node accepted a direct write")
+		}
+	}
+	waitForApplied(t, nodes, leader.AppliedIndex())
+	expect := dumpDB(t, leader.DB)
+	for _, node := range nodes {
+		checkContent(t, node.DB, expect)
+	}
+
+	// the old leader is cut off, the others elect a new one and go on
+	net.Disconnect(leader.ID)
+	var rest []*RaftNode
+	for _, node := range nodes {
+		if node != leader {
+			rest = append(rest, node)
+		}
+	}
+	for i := 100; i < 200; i++ {
+		raftPut(t, rest, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	ctx2, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	if leader.Put(ctx2, "lost", "write") == nil {
+		t.Fatal("a put without a majority committed")
+	}
+	cancel()
+	net.Connect(leader.ID)
+	newLeader := waitForLeader(t, rest)
+	raftPut(t, nodes, "after", "reconnect")
+	waitForApplied(t, nodes, newLeader.AppliedIndex())
+	expect = dumpDB(t, newLeader.DB)
+	if _, hit := expect["lost"]; hit {
+		t.Fatal("write of the cut off leader was applied")
+	}
+	for _, node := range nodes {
+		checkContent(t, node.DB, expect)
+	}
+
+	// a new node catches up from a snapshot, another one leaves
+	nodes = append(nodes, startNode("d", nil))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = waitForLeader(t, nodes).AddNode(ctx, "d")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	raftPut(t, nodes, "with", "d")
+	leader = waitForLeader(t, nodes)
+	waitForApplied(t, nodes, leader.AppliedIndex())
+	checkContent(t, nodes[3].DB, dumpDB(t, leader.DB))
+
+	var leaving *RaftNode
+	for _, node := range nodes {
+		if node != leader {
+			leaving = node
+			break
+		}
+	}
+	err = leader.RemoveNode(ctx, leaving.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.Disconnect(leaving.ID)
+	if len(leader.Members()) != 3 {
+		t.Fatal("members after the removal ", leader.Members())
+	}
+	raftPut(t, nodes, "without", leaving.ID)
+	for _, node := range nodes {
+		if node != leaving {
+			waitForApplied(t, []*RaftNode{node}, leader.AppliedIndex())
+			checkContent(t, node.DB, dumpDB(t, leader.DB))
+		}
+	}
+
+	// the applied index survives a reopen
+	leaving.Stop()
+	applied := leaving.DB.AppliedIndex
+	path := leaving.DB.FileName
+	leaving.DB.Close()
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.AppliedIndex != applied {
+		t.Fatal("applied index ", db.AppliedIndex, ", expect ", applied)
+	}
+	db.Close()
+	for i, node := range nodes {
+		if node == leaving {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a")
+
+	net := NewRaftNetwork()
+	open := func(members []string) *RaftNode {
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := NewRaftNode("a", db, net.Transport("a"), members, testRaftConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	restart := func(node *RaftNode) *RaftNode {
+		node.Stop()
+		node.DB.Close()
+		return open(nil)
+	}
+
+	node := open([]string{"a", "b", "c"})
+	resp := node.HandleRequestVote(&RequestVoteRequest{Term: 5, Candidate: "b"})
+	if !resp.VoteGranted {
+		t.Fatal("vote not granted")
+	}
+	entries := []RaftEntry{
+		{Term: 5, Index: 1, Type: RaftPut, Key: "k", Value: "v"},
+		{Term: 5, Index: 2, Type: RaftAddNode, Key: "d"},
+	}
+	ack := node.HandleAppendEntries(&AppendEntriesRequest{Term: 5, Leader: "b", Entries: entries})
+	if !ack.Success {
+		t.Fatal("entries not appended")
+	}
+
+	// the vote, the acknowledged entries and the membership survive
+	node = restart(node)
+	if node.HandleRequestVote(&RequestVoteRequest{Term: 5, Candidate: "c", LastLogIndex: 9, LastLogTerm: 5}).VoteGranted {
+		t.Fatal("voted twice in term 5")
+	}
+	if node.lastIndex() != 2 || node.termAt(2) != 5 {
+		t.Fatal("log after restart ends at ", node.lastIndex())
+	}
+	if len(node.Members()) != 4 {
+		t.Fatal("members after restart ", node.Members())
+	}
+
+	// a conflicting leader of a later term replaces the uncommitted entries
+	ack = node.HandleAppendEntries(&AppendEntriesRequest{
+		Term:         6,
+		Leader:       "c",
+		PrevLogIndex: 1,
+		PrevLogTerm:  5,
+		Entries:      []RaftEntry{{Term: 6, Index: 2, Type: RaftNoop}, {Term: 6, Index: 3, Type: RaftPut, Key: "k2", Value: "v2"}},
+		LeaderCommit: 3,
+	})
+	if !ack.Success {
+		t.Fatal("entries of term 6 not appended")
+	}
+	waitApplied := func(index uint64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for node.DB.AppliedIndex < index {
+			if time.Now().After(deadline) {
+				t.Fatal("applied ", node.DB.AppliedIndex, ", expect ", index)
+			}
+			node.applyMu.Lock()
+			err := node.applyCommitted()
+			node.applyMu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitApplied(3)
+	node.applyMu.Lock()
+	err = node.takeSnapshot()
+	node.applyMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node = restart(node)
+	defer func() {
+		node.Stop()
+		node.DB.Close()
+	}()
+	if node.firstIndex() != 3 || node.termAt(3) != 6 || node.AppliedIndex() != 3 {
+		t.Fatal("snapshot after restart at ", node.firstIndex(), ", applied ", node.AppliedIndex())
+	}
+	if len(node.Members()) != 3 {
+		t.Fatal("members after the conflicting entry ", node.Members())
+	}
+	value, err := node.DB.Get("k")
+	if err != nil || value != "v" {
+		t.Fatal("get returned ", value, err)
+	}
+	if node.HandleRequestVote(&RequestVoteRequest{Term: 6, Candidate: "b", LastLogIndex: 9, LastLogTerm: 6}).VoteGranted == false {
+		t.Fatal("vote in a new term not granted")
+	}
+}
+
+func TestRaftExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same expiring pairs on every member, written before they joined
+	options := &Options{ExpirySweepInterval: 10 * time.Millisecond}
+	db, err := Open(filepath.Join(dir, "a"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = db.PutWithTTL(strconv.Itoa(i), "v", 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net := NewRaftNetwork()
+	members := []string{"a", "b", "c"}
+	var nodes []*RaftNode
+	for _, id := range members {
+		path := filepath.Join(dir, id)
+		err = ioutil.WriteFile(path, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(path, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := NewRaftNode(id, db, net.Transport(id), members, testRaftConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.Add(node)
+		node.Start()
+		nodes = append(nodes, node)
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+			node.DB.Close()
+		}
+	}()
+
+	// the leader's sweeper deletes them through the log, on every member
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for i := 0; i < 20; i++ {
+			for stored(t, node.DB, strconv.Itoa(i)) {
+				if time.Now().After(deadline) {
+					t.Fatal("expired key ", i, " left on ", node.ID)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package go_kvstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrUnreachable = errors.New("raft node is unreachable")
+
+// RaftNetwork connects raft nodes in the same process, for tests. Nodes
+// can be cut off from the others to simulate failures.
+type RaftNetwork struct {
+	mu           sync.Mutex
+	nodes        map[string]*RaftNode
+	disconnected map[string]bool
+}
+
+func NewRaftNetwork() *RaftNetwork {
+	return &RaftNetwork{
+		nodes:        make(map[string]*RaftNode),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Add makes node reachable under its id.
+func (net *RaftNetwork) Add(node *RaftNode) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[node.ID] = node
+}
+
+// Remove makes the node id unreachable for good.
+func (net *RaftNetwork) Remove(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.nodes, id)
+}
+
+// Disconnect drops all RPCs from and to the node id.
+func (net *RaftNetwork) Disconnect(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.disconnected[id] = true
+}
+
+func (net *RaftNetwork) Connect(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.disconnected, id)
+}
+
+// Transport returns the transport of the node from.
+func (net *RaftNetwork) Transport(from string) RaftTransport {
+	return &raftNetTransport{net: net, from: from}
+}
+
+func (net *RaftNetwork) route(ctx context.Context, from, to string) (*RaftNode, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	node := net.nodes[to]
+	if node == nil || net.disconnected[from] || net.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return node, nil
+}
+
+type raftNetTransport struct {
+	net  *RaftNetwork
+	from string
+}
+
+func (t *raftNetTransport) RequestVote(ctx context.Context, to string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	node, err := t.net.route(ctx, t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleRequestVote(req), nil
+}
+
+func (t *raftNetTransport) AppendEntries(ctx context.Context, to string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	node, err := t.net.route(ctx, t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppendEntries(req), nil
+}
+
+func (t *raftNetTransport) InstallSnapshot(ctx context.Context, to string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	node, err := t.net.route(ctx, t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleInstallSnapshot(req), nil
+}
@@ -0,0 +1,297 @@
+package go_kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// raftStorage keeps the term, the vote and the log of a RaftNode in
+// <file>-raft. Every change is synced before the node answers an RPC or
+// counts an entry as stored, so a restarted node neither votes twice in a
+// term nor forgets an entry it acknowledged.
+//
+// record: type(1) | payload length(4) | payload | crc32 of the record(4)
+// state: term(8) | vote length(2) | vote
+// entries: entries of term(8) | index(8) | type(1) | key length(2) | key | value length(2) | value
+// snapshot: index(8) | term(8) | members of id length(2) | id
+//
+// An entry replaces the one at its index and the ones after it. A snapshot
+// drops the log up to its index, the members are the membership as of
+// there. The snapshot of an InstallSnapshot is recorded before the DB is
+// replaced and only counts once the DB has applied its index, so one cut
+// off by a crash is forgotten. Taking a snapshot rewrites the file.
+
+var errRaftStateBehind = errors.New("raft log is behind the applied index of the db")
+
+const (
+	raftStateRecord byte = iota + 1
+	raftEntriesRecord
+	raftSnapshotRecord
+)
+
+const raftRecordHeaderSize = 5
+
+type raftStorage struct {
+	fileName string
+	file     *os.File
+	size     int64
+}
+
+// raftState is what openRaftStorage read back, the log after the
+// snapshot. The file starts with a snapshot, nil if it was cut off.
+type raftState struct {
+	term     uint64
+	votedFor string
+	snapshot *raftSnapshot
+	entries  []RaftEntry
+}
+
+// openRaftStorage opens the raft file of fileName and replays it for a db
+// that applied the log up to applied. The state is nil for a new file.
+func openRaftStorage(fileName string, applied uint64) (*raftStorage, *raftState, error) {
+	file, err := os.OpenFile(fileName+"-raft", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &raftStorage{fileName: fileName + "-raft", file: file}
+	var state *raftState
+	for {
+		kind, payload, next, err := s.readRecord(s.size)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if payload == nil {
+			break
+		}
+		if state == nil {
+			state = &raftState{}
+		}
+		state.replay(kind, payload, applied)
+		s.size = next
+	}
+	err = file.Truncate(s.size) //a torn record of a crash
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return s, state, nil
+}
+
+func (state *raftState) replay(kind byte, payload []byte, applied uint64) {
+	switch kind {
+	case raftStateRecord:
+		state.term = binary.BigEndian.Uint64(payload[0:8])
+		state.votedFor = string(payload[10 : 10+int(binary.BigEndian.Uint16(payload[8:10]))])
+	case raftEntriesRecord:
+		if state.snapshot == nil {
+			return
+		}
+		for _, entry := range decodeRaftEntries(payload) {
+			if entry.Index <= state.snapshot.index {
+				continue
+			}
+			position := entry.Index - state.snapshot.index - 1
+			if position > uint64(len(state.entries)) {
+				break
+			}
+			state.entries = append(state.entries[:position], entry)
+		}
+	case raftSnapshotRecord:
+		snapshot := decodeRaftSnapshot(payload)
+		if state.snapshot == nil {
+			state.snapshot = snapshot
+			return
+		}
+		if snapshot.index > applied || snapshot.index <= state.snapshot.index {
+			return
+		}
+		kept := uint64(0)
+		if snapshot.index-state.snapshot.index <= uint64(len(state.entries)) {
+			position := snapshot.index - state.snapshot.index - 1
+			if state.entries[position].Term == snapshot.term {
+				kept = position + 1
+			}
+		}
+		if kept > 0 {
+			state.entries = append([]RaftEntry{}, state.entries[kept:]...)
+		} else {
+			state.entries = nil
+		}
+		state.snapshot = snapshot
+	}
+}
+
+func (s *raftStorage) saveState(term uint64, votedFor string) error {
+	return s.append(raftStateRecord, encodeRaftState(term, votedFor))
+}
+
+func (s *raftStorage) appendEntries(entries []RaftEntry) error {
+	return s.append(raftEntriesRecord, encodeRaftEntries(entries))
+}
+
+func (s *raftStorage) saveSnapshot(snapshot *raftSnapshot) error {
+	return s.append(raftSnapshotRecord, encodeRaftSnapshot(snapshot))
+}
+
+// rewrite replaces the file by one holding only the given state.
+func (s *raftStorage) rewrite(term uint64, votedFor string, snapshot *raftSnapshot, entries []RaftEntry) error {
+	var buf []byte
+	buf = append(buf, encodeRaftRecord(raftStateRecord, encodeRaftState(term, votedFor))...)
+	buf = append(buf, encodeRaftRecord(raftSnapshotRecord, encodeRaftSnapshot(snapshot))...)
+	if len(entries) > 0 {
+		buf = append(buf, encodeRaftRecord(raftEntriesRecord, encodeRaftEntries(entries))...)
+	}
+
+	tmpName := s.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, s.fileName)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	s.file.Close()
+	s.file = tmp
+	s.size = int64(len(buf))
+	return nil
+}
+
+func (s *raftStorage) append(kind byte, payload []byte) error {
+	record := encodeRaftRecord(kind, payload)
+	_, err := s.file.WriteAt(record, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *raftStorage) Close() error {
+	return s.file.Close()
+}
+
+// readRecord returns the record at offset and the offset of the next one,
+// a nil payload if there is no complete record there.
+func (s *raftStorage) readRecord(offset int64) (byte, []byte, int64, error) {
+	header := make([]byte, raftRecordHeaderSize)
+	_, err := s.file.ReadAt(header, offset)
+	if err == io.EOF {
+		return 0, nil, offset, nil
+	}
+	if err != nil {
+		return 0, nil, offset, err
+	}
+	payloadSize := int(binary.BigEndian.Uint32(header[1:5]))
+	body := make([]byte, payloadSize+4)
+	_, err = s.file.ReadAt(body, offset+raftRecordHeaderSize)
+	if err == io.EOF {
+		return 0, nil, offset, nil
+	}
+	if err != nil {
+		return 0, nil, offset, err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header)
+	checksum.Write(body[:payloadSize])
+	if checksum.Sum32() != binary.BigEndian.Uint32(body[payloadSize:]) {
+		return 0, nil, offset, nil
+	}
+	return header[0], body[:payloadSize], offset + raftRecordHeaderSize + int64(payloadSize) + 4, nil
+}
+
+func encodeRaftRecord(kind byte, payload []byte) []byte {
+	record := make([]byte, raftRecordHeaderSize+len(payload)+4)
+	record[0] = kind
+	binary.BigEndian.PutUint32(record[1:5], uint32(len(payload)))
+	copy(record[raftRecordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[raftRecordHeaderSize+len(payload):], crc32.ChecksumIEEE(record[:raftRecordHeaderSize+len(payload)]))
+	return record
+}
+
+func encodeRaftState(term uint64, votedFor string) []byte {
+	payload := make([]byte, 10+len(votedFor))
+	binary.BigEndian.PutUint64(payload[0:8], term)
+	binary.BigEndian.PutUint16(payload[8:10], uint16(len(votedFor)))
+	copy(payload[10:], votedFor)
+	return payload
+}
+
+func encodeRaftEntries(entries []RaftEntry) []byte {
+	var payload []byte
+	for _, entry := range entries {
+		buf := make([]byte, 21+len(entry.Key)+len(entry.Value))
+		binary.BigEndian.PutUint64(buf[0:8], entry.Term)
+		binary.BigEndian.PutUint64(buf[8:16], entry.Index)
+		buf[16] = byte(entry.Type)
+		binary.BigEndian.PutUint16(buf[17:19], uint16(len(entry.Key)))
+		ptr := 19 + copy(buf[19:], entry.Key)
+		binary.BigEndian.PutUint16(buf[ptr:], uint16(len(entry.Value)))
+		copy(buf[ptr+2:], entry.Value)
+		payload = append(payload, buf...)
+	}
+	return payload
+}
+
+func decodeRaftEntries(payload []byte) []RaftEntry {
+	var entries []RaftEntry
+	for len(payload) > 0 {
+		entry := RaftEntry{
+			Term:  binary.BigEndian.Uint64(payload[0:8]),
+			Index: binary.BigEndian.Uint64(payload[8:16]),
+			Type:  RaftEntryType(payload[16]),
+		}
+		keyLen := int(binary.BigEndian.Uint16(payload[17:19]))
+		entry.Key = string(payload[19 : 19+keyLen])
+		payload = payload[19+keyLen:]
+		valueLen := int(binary.BigEndian.Uint16(payload[0:2]))
+		entry.Value = string(payload[2 : 2+valueLen])
+		payload = payload[2+valueLen:]
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func encodeRaftSnapshot(snapshot *raftSnapshot) []byte {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[0:8], snapshot.index)
+	binary.BigEndian.PutUint64(payload[8:16], snapshot.term)
+	for _, member := range snapshot.members {
+		buf := make([]byte, 2+len(member))
+		binary.BigEndian.PutUint16(buf, uint16(len(member)))
+		copy(buf[2:], member)
+		payload = append(payload, buf...)
+	}
+	return payload
+}
+
+func decodeRaftSnapshot(payload []byte) *raftSnapshot {
+	snapshot := &raftSnapshot{
+		index:   binary.BigEndian.Uint64(payload[0:8]),
+		term:    binary.BigEndian.Uint64(payload[8:16]),
+		members: []string{},
+	}
+	payload = payload[16:]
+	for len(payload) > 0 {
+		idLen := int(binary.BigEndian.Uint16(payload[0:2]))
+		snapshot.members = append(snapshot.members, string(payload[2:2+idLen]))
+		payload = payload[2+idLen:]
+	}
+	return snapshot
+}
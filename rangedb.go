@@ -0,0 +1,814 @@
+package go_kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RangedDB partitions the keys over DB files by key range, each shard owns
+// the keys from its Start up to its End. Unlike ShardedDB a range scan only
+// visits the shards covering the range, one after the other.
+//
+// A shard whose pairs take more than SplitSize bytes is split at the middle
+// into two new files, two neighbors whose pairs add up to less than
+// MergeSize are merged into one. Both build the new files by BulkLoad
+// and swap them in by rewriting the manifest RANGES, so a crash leaves
+// either the old or the new shards, never a mix. Files of a crashed split
+// or merge are removed on the next open.
+//
+// The sizes of the shards are measured on open and kept up to date by Put
+// and Delete, expired pairs count until a split or merge rebuilds their
+// shard. Reads and writes go on while the new files are built, the writes
+// to the replaced shards are noted and copied again right before the
+// manifest is swapped, the only time the store is locked.
+//
+// The kept revisions of the keys go with them, a new file goes on with the
+// newest tx id of the shards it replaces, so the versions stay ordered.
+
+var ErrInvalidRangeOptions = errors.New("invalid range options")
+
+const (
+	rangeManifest    = "RANGES"
+	rangeShardPrefix = "range-"
+)
+
+// RangeShard is the key range [Start, End) stored in the file Name. An
+// empty End is the end of the key space.
+type RangeShard struct {
+	Name  string
+	Start string
+	End   string
+}
+
+func (shard RangeShard) contains(key string) bool {
+	return key >= shard.Start && (shard.End == "" || key < shard.End)
+}
+
+// RangeOptions configures OpenRanged. The zero value of a field means its
+// default.
+type RangeOptions struct {
+	// Options configures the shard files.
+	Options *Options
+	// SplitSize is the size in bytes of the keys and values of a shard
+	// above which it is split.
+	SplitSize int64
+	// MergeSize is the size of two neighbors below which they are merged,
+	// at most half of SplitSize.
+	MergeSize int64
+	// CheckInterval is how often the shards are checked for merges, a
+	// write beyond SplitSize triggers a check right away.
+	CheckInterval time.Duration
+}
+
+var DefaultRangeOptions = &RangeOptions{
+	SplitSize:     64 << 20,
+	MergeSize:     16 << 20,
+	CheckInterval: time.Minute,
+}
+
+func (options *RangeOptions) withDefaults() (*RangeOptions, error) {
+	resolved := *DefaultRangeOptions
+	if options != nil {
+		resolved = *options
+	}
+	if resolved.SplitSize == 0 {
+		resolved.SplitSize = DefaultRangeOptions.SplitSize
+	}
+	if resolved.MergeSize == 0 {
+		resolved.MergeSize = resolved.SplitSize / 4
+	}
+	if resolved.CheckInterval == 0 {
+		resolved.CheckInterval = DefaultRangeOptions.CheckInterval
+	}
+	if resolved.SplitSize < 0 || resolved.MergeSize < 0 || resolved.MergeSize > resolved.SplitSize/2 || resolved.CheckInterval < 0 {
+		return nil, ErrInvalidRangeOptions
+	}
+	return &resolved, nil
+}
+
+type rangeManifestContent struct {
+	Next   uint64 //number of the next shard file
+	Shards []RangeShard
+}
+
+// rangeRebuild is the shards a running split or merge replaces and the
+// keys written to them meanwhile.
+type rangeRebuild struct {
+	sources map[*DB]bool
+
+	mu    sync.Mutex
+	dirty map[string]bool
+}
+
+type RangedDB struct {
+	Dir     string
+	Options *RangeOptions
+
+	rebalanceMu sync.Mutex   //held by Rebalance, one at a time
+	mu          sync.RWMutex //held exclusively to swap the shards
+	manifest    rangeManifestContent
+	shards      []*DB
+	// sizes are the bytes of the pairs of the shards, updated atomically.
+	sizes   []int64
+	rebuild *rangeRebuild
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// OpenRanged opens the range partitioned store in dir, a new one starts
+// with a single shard owning all keys.
+func OpenRanged(dir string, options *RangeOptions) (*RangedDB, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &RangedDB{
+		Dir:     dir,
+		Options: options,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, rangeManifest))
+	if os.IsNotExist(err) {
+		s.manifest = rangeManifestContent{Next: 1, Shards: []RangeShard{{Name: rangeShardPrefix + "0"}}}
+		err = s.writeManifest(s.manifest)
+	} else if err == nil {
+		err = json.Unmarshal(content, &s.manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.removeOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shard := range s.manifest.Shards {
+		db, err := Open(filepath.Join(dir, shard.Name), options.Options)
+		if err != nil {
+			s.closeShards()
+			return nil, err
+		}
+		s.shards = append(s.shards, db)
+	}
+	s.sizes = make([]int64, len(s.shards))
+	for i, db := range s.shards {
+		s.sizes[i], err = dataSize(db)
+		if err != nil {
+			s.closeShards()
+			return nil, err
+		}
+	}
+	s.trigger <- struct{}{} //splits or merges what the options ask for
+	s.done.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *RangedDB) writeManifest(manifest rangeManifestContent) error {
+	content, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, rangeManifest), content)
+}
+
+// removeOrphans removes the shard files the manifest does not list, left
+// by a crashed split or merge.
+func (s *RangedDB) removeOrphans() error {
+	listed := make(map[string]bool)
+	for _, shard := range s.manifest.Shards {
+		listed[shard.Name] = true
+	}
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), rangeShardPrefix) {
+			continue
+		}
+		number := strings.SplitN(strings.TrimPrefix(info.Name(), rangeShardPrefix), "-", 2)[0]
+		if !listed[rangeShardPrefix+number] {
+			err = os.Remove(filepath.Join(s.Dir, info.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// find returns the index of the shard owning key, called with s.mu held.
+func (s *RangedDB) find(key string) int {
+	shards := s.manifest.Shards
+	return sort.Search(len(shards)-1, func(i int) bool {
+		return key < shards[i].End
+	})
+}
+
+// Shards returns the shards in key order.
+func (s *RangedDB) Shards() []RangeShard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]RangeShard{}, s.manifest.Shards...)
+}
+
+// Shard returns the db of the shard owning key.
+func (s *RangedDB) Shard(key string) *DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[s.find(key)]
+}
+
+func (s *RangedDB) Get(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[s.find(key)].Get(key)
+}
+
+func (s *RangedDB) Put(key, value string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.find(key)
+	s.written(key, s.shards[i])
+	delta, err := writeSized(s.shards[i], KVPair{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	size := atomic.AddInt64(&s.sizes[i], delta)
+	if size > s.Options.SplitSize {
+		select {
+		case s.trigger <- struct{}{}:
+		default: //already triggered
+		}
+	}
+	return nil
+}
+
+// Delete removes key, ErrKeyNotFound is returned if it does not exist.
+func (s *RangedDB) Delete(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.find(key)
+	s.written(key, s.shards[i])
+	delta, err := deleteSized(s.shards[i], key)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.sizes[i], delta)
+	return nil
+}
+
+// written notes a write of key to db for a running split or merge that
+// replaces db, called with s.mu held.
+func (s *RangedDB) written(key string, db *DB) {
+	r := s.rebuild
+	if r == nil || !r.sources[db] {
+		return
+	}
+	r.mu.Lock()
+	r.dirty[key] = true
+	r.mu.Unlock()
+}
+
+// writeSized writes pair to db and returns by how many bytes the pairs of
+// db grew.
+func writeSized(db *DB, pair KVPair) (int64, error) {
+	delta := int64(len(pair.Key) + len(pair.Value))
+	err := db.Update(func(tx *Tx) error {
+		return tx.db.writePair(pair, func(written *KVPair, old KVPair, found bool) error {
+			if found {
+				delta -= int64(len(old.Key) + len(old.Value))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return delta, nil
+}
+
+// deleteSized deletes key from db and returns by how many bytes the pairs
+// of db grew, an expired key is not found.
+func deleteSized(db *DB, key string) (int64, error) {
+	var delta int64
+	err := db.Update(func(tx *Tx) error {
+		pair, err := tx.db.readPair(key)
+		if err == nil && pair.expired(time.Now().UnixNano()) {
+			err = ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		delta = -int64(len(pair.Key) + len(pair.Value))
+		return tx.db.removePair(pair)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return delta, nil
+}
+
+// dataSize returns the bytes of the pairs in db, expired ones included.
+func dataSize(db *DB) (int64, error) {
+	scanner := &batchScanner{db: db}
+	var size int64
+	for scanner.Next() {
+		size += int64(len(scanner.pair.Key) + len(scanner.pair.Value))
+	}
+	return size, scanner.err
+}
+
+// batchScanner reads the pairs of db in key order from a key on, expired
+// ones included, and the kept revisions if withHistory. It reads
+// migrateBatchSize pairs per transaction, so the writers of db get in
+// between.
+type batchScanner struct {
+	db          *DB
+	from        string
+	withHistory bool
+	done        bool
+	pairs       []KVPair
+	pair        KVPair
+	err         error
+}
+
+func (b *batchScanner) Next() bool {
+	for len(b.pairs) == 0 {
+		if b.done || b.err != nil {
+			return false
+		}
+		b.fill()
+	}
+	b.pair, b.pairs = b.pairs[0], b.pairs[1:]
+	return true
+}
+
+func (b *batchScanner) fill() {
+	it, err := b.db.Iterator()
+	if err != nil {
+		b.err = err
+		return
+	}
+	defer it.Close()
+	it.withExpired = true
+	it.withHistory = b.withHistory
+	it.Seek(b.from)
+	for len(b.pairs) < migrateBatchSize && it.Next() {
+		b.pairs = append(b.pairs, it.Pair())
+	}
+	b.err = it.Err()
+	if len(b.pairs) < migrateBatchSize {
+		b.done = true
+	} else {
+		b.from = b.pairs[len(b.pairs)-1].Key + "\x00" //the first key after it
+	}
+}
+
+func (s *RangedDB) run() {
+	defer s.done.Done()
+	ticker := time.NewTicker(s.Options.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.trigger:
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		s.Rebalance() //a failed check is retried on the next one
+	}
+}
+
+// Rebalance splits the shards over SplitSize and merges the neighbors
+// under MergeSize, it runs in the background by itself.
+func (s *RangedDB) Rebalance() error {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	if s.shards == nil {
+		return errors.New("ranged db is closed")
+	}
+
+	for i := 0; i < len(s.shards); {
+		split := false
+		if atomic.LoadInt64(&s.sizes[i]) > s.Options.SplitSize {
+			var err error
+			split, err = s.split(i)
+			if err != nil {
+				return err
+			}
+		}
+		if !split { //halves are checked again
+			i++
+		}
+	}
+	for i := 0; i+1 < len(s.shards); {
+		if atomic.LoadInt64(&s.sizes[i])+atomic.LoadInt64(&s.sizes[i+1]) >= s.Options.MergeSize {
+			i++
+			continue
+		}
+		err := s.merge(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split replaces shard i by two halves of about the same data size, it
+// returns false if the shard has a single key. Called with s.rebalanceMu
+// held, like merge and replace.
+func (s *RangedDB) split(i int) (bool, error) {
+	total := atomic.LoadInt64(&s.sizes[i])
+	scanner := &batchScanner{db: s.shards[i]}
+	var middle string
+	var size int64
+	first := true
+	for scanner.Next() {
+		if !first && size >= total/2 {
+			middle = scanner.pair.Key
+			break
+		}
+		first = false
+		size += int64(len(scanner.pair.Key) + len(scanner.pair.Value))
+	}
+	if scanner.err != nil {
+		return false, scanner.err
+	}
+	if middle == "" {
+		return false, nil
+	}
+
+	shard := s.manifest.Shards[i]
+	left := RangeShard{Start: shard.Start, End: middle}
+	right := RangeShard{Start: middle, End: shard.End}
+	return true, s.replace(i, 1, []RangeShard{left, right})
+}
+
+// merge replaces shard i and its right neighbor by one shard.
+func (s *RangedDB) merge(i int) error {
+	merged := RangeShard{
+		Start: s.manifest.Shards[i].Start,
+		End:   s.manifest.Shards[i+1].End,
+	}
+	return s.replace(i, 2, []RangeShard{merged})
+}
+
+// replace builds new files for the ranges of shards, which cover the n
+// shards from i, from their content and swaps them in. The store is only
+// locked for the swap, the writes to the n shards meanwhile are copied
+// again right before it.
+func (s *RangedDB) replace(i, n int, shards []RangeShard) error {
+	manifest := rangeManifestContent{Next: s.manifest.Next}
+	old := s.manifest.Shards[i : i+n]
+	oldDBs := s.shards[i : i+n]
+	rebuild := &rangeRebuild{sources: make(map[*DB]bool), dirty: make(map[string]bool)}
+	for _, db := range oldDBs {
+		rebuild.sources[db] = true
+	}
+	s.mu.Lock()
+	s.rebuild = rebuild
+	s.mu.Unlock()
+
+	var dbs []*DB
+	sizes := make([]int64, len(shards))
+	cleanup := func() {
+		s.mu.Lock()
+		s.rebuild = nil
+		s.mu.Unlock()
+		for j, db := range dbs {
+			db.Close()
+			path := filepath.Join(s.Dir, shards[j].Name)
+			removeFiles(path, path+"-journal", path+"-changes")
+		}
+	}
+	for j := range shards {
+		shards[j].Name = rangeShardPrefix + strconv.FormatUint(manifest.Next, 10)
+		manifest.Next++
+		db, size, err := s.build(shards[j], oldDBs)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		dbs = append(dbs, db)
+		sizes[j] = size
+	}
+	manifest.Shards = append(manifest.Shards, s.manifest.Shards[:i]...)
+	manifest.Shards = append(manifest.Shards, shards...)
+	manifest.Shards = append(manifest.Shards, s.manifest.Shards[i+n:]...)
+
+	s.mu.Lock()
+	s.rebuild = nil
+	err := rebuild.copyDirty(old, oldDBs, shards, dbs, sizes)
+	if err == nil {
+		err = s.writeManifest(manifest)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		cleanup()
+		return err
+	}
+	s.manifest = manifest
+	s.shards = append(append(append([]*DB{}, s.shards[:i]...), dbs...), s.shards[i+n:]...)
+	s.sizes = append(append(append([]int64{}, s.sizes[:i]...), sizes...), s.sizes[i+n:]...)
+	s.mu.Unlock()
+
+	for j, db := range oldDBs {
+		err = db.Close()
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(s.Dir, old[j].Name)
+		err = removeFiles(path, path+"-journal", path+"-changes")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDirty copies the keys written to the old shards during a rebuild to
+// the new ones again, with their kept revisions, or deletes them there if
+// they are gone, and adds the difference to sizes. Called with the store
+// locked.
+func (r *rangeRebuild) copyDirty(old []RangeShard, oldDBs []*DB, shards []RangeShard, dbs []*DB, sizes []int64) error {
+	for key := range r.dirty {
+		source := 0
+		for !old[source].contains(key) {
+			source++
+		}
+		target := 0
+		for !shards[target].contains(key) {
+			target++
+		}
+		pairs, err := readKeyPairs(oldDBs[source], key)
+		if err != nil {
+			return err
+		}
+		err = dbs[target].Update(func(tx *Tx) error {
+			delta, err := tx.db.installKey(key, pairs)
+			sizes[target] += delta
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build bulk loads the pairs of sources within the range of shard, with
+// their kept revisions, into a new file and returns their size. The file
+// goes on with the newest tx id of the sources, so the next writes get
+// newer versions than the ones loaded.
+func (s *RangedDB) build(shard RangeShard, sources []*DB) (*DB, int64, error) {
+	db, err := Open(filepath.Join(s.Dir, shard.Name), s.Options.Options)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &rangeSource{}
+	revisionsFrom := shard.Start
+	if len(revisionsFrom) > MaxVersionedKeySize { //a prefix sorts no later
+		revisionsFrom = revisionsFrom[:MaxVersionedKeySize]
+	}
+	for _, source := range sources {
+		tx, err := source.Begin(false)
+		if err != nil {
+			db.Close()
+			return nil, 0, err
+		}
+		if tx.db.TxID > db.TxID {
+			db.TxID = tx.db.TxID
+		}
+		tx.Rollback()
+		r.parts = append(r.parts,
+			&rangePart{scanner: &batchScanner{db: source, from: shard.Start}, shard: shard},
+			&rangePart{scanner: &batchScanner{db: source, from: historyKey(revisionsFrom, 0), withHistory: true}, shard: shard, history: true})
+	}
+	err = db.BulkLoad(r)
+	if err != nil {
+		db.Close()
+		return nil, 0, err
+	}
+	return db, r.size, nil
+}
+
+// rangePart reads the pairs of a scanner within shard, only the kept
+// revisions if history, sorted by the key they belong to, else only the
+// others.
+type rangePart struct {
+	scanner *batchScanner
+	shard   RangeShard
+	history bool
+	ok      bool //the scanner is on the next pair of the part
+}
+
+func (p *rangePart) advance() {
+	p.ok = false
+	for p.scanner.Next() {
+		pair := p.scanner.pair
+		if pair.history != p.history {
+			continue
+		}
+		key := pairKey(pair)
+		if p.shard.End != "" && key >= p.shard.End {
+			return
+		}
+		if p.shard.contains(key) {
+			p.ok = true
+			return
+		}
+	}
+}
+
+// rangeSource feeds BulkLoad the pairs of its parts merged in key order.
+// The parts of different sources hold different keys.
+type rangeSource struct {
+	parts   []*rangePart
+	started bool
+	pair    KVPair
+	size    int64 //bytes of the pairs so far, revisions not counted
+}
+
+func (r *rangeSource) Next() bool {
+	if !r.started {
+		r.started = true
+		for _, part := range r.parts {
+			part.advance()
+		}
+	}
+	var next *rangePart
+	for _, part := range r.parts {
+		if part.ok && (next == nil || part.scanner.pair.Key < next.scanner.pair.Key) {
+			next = part
+		}
+	}
+	if next == nil || r.Err() != nil {
+		return false
+	}
+	r.pair = next.scanner.pair
+	if !r.pair.history {
+		r.size += int64(len(r.pair.Key) + len(r.pair.Value))
+	}
+	next.advance()
+	return true
+}
+
+func (r *rangeSource) Key() string {
+	return r.pair.Key
+}
+
+func (r *rangeSource) Value() string {
+	return r.pair.Value
+}
+
+func (r *rangeSource) Pair() KVPair {
+	return r.pair
+}
+
+func (r *rangeSource) Err() error {
+	for _, part := range r.parts {
+		if part.scanner.err != nil {
+			return part.scanner.err
+		}
+	}
+	return nil
+}
+
+// Iterator returns an iterator over all keys in key order. It locks one
+// shard at a time, splits and merges wait until it is closed.
+func (s *RangedDB) Iterator() (*RangeIterator, error) {
+	s.mu.RLock()
+	if s.shards == nil {
+		s.mu.RUnlock()
+		return nil, errors.New("ranged db is closed")
+	}
+	return &RangeIterator{s: s}, nil
+}
+
+// RangeIterator walks the shards of a RangedDB in key order.
+type RangeIterator struct {
+	s      *RangedDB
+	shard  int
+	it     *Iterator
+	pair   KVPair
+	err    error
+	closed bool
+}
+
+// Seek positions the iterator so that the following Next returns the
+// first key greater than or equal to key.
+func (r *RangeIterator) Seek(key string) {
+	r.closeShard()
+	r.shard = r.s.find(key)
+	r.err = r.openShard()
+	if r.err == nil {
+		r.it.Seek(key)
+	}
+}
+
+func (r *RangeIterator) openShard() error {
+	it, err := r.s.shards[r.shard].Iterator()
+	if err != nil {
+		return err
+	}
+	r.it = it
+	return nil
+}
+
+func (r *RangeIterator) closeShard() {
+	if r.it != nil {
+		r.it.Close()
+		r.it = nil
+	}
+}
+
+func (r *RangeIterator) Next() bool {
+	for r.err == nil && !r.closed && r.shard < len(r.s.shards) {
+		if r.it == nil {
+			r.err = r.openShard()
+			continue
+		}
+		if r.it.Next() {
+			r.pair = KVPair{Key: r.it.Key(), Value: r.it.Value()}
+			return true
+		}
+		r.err = r.it.Err()
+		r.closeShard()
+		r.shard++
+	}
+	return false
+}
+
+func (r *RangeIterator) Key() string {
+	return r.pair.Key
+}
+
+func (r *RangeIterator) Value() string {
+	return r.pair.Value
+}
+
+func (r *RangeIterator) Err() error {
+	return r.err
+}
+
+func (r *RangeIterator) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closeShard()
+	r.closed = true
+	r.s.mu.RUnlock()
+	return nil
+}
+
+func (s *RangedDB) closeShards() error {
+	var firstErr error
+	for _, db := range s.shards {
+		err := db.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close stops the background checks and closes all shards, after a
+// running Rebalance.
+func (s *RangedDB) Close() error {
+	s.rebalanceMu.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.rebalanceMu.Unlock()
+	s.done.Wait() //the background check finishes its Rebalance first
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shards == nil {
+		return nil
+	}
+	err := s.closeShards()
+	s.shards = nil
+	return err
+}
@@ -0,0 +1,256 @@
+package go_kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkRanges checks that the shards of s cover the key space in order and
+// hold only their own keys.
+func checkRanges(t *testing.T, s *RangedDB) {
+	shards := s.Shards()
+	if shards[0].Start != "" || shards[len(shards)-1].End != "" {
+		t.Fatal("shards do not cover the key space ", shards)
+	}
+	for i, shard := range shards {
+		if i > 0 && shards[i-1].End != shard.Start {
+			t.Fatal("shards ", shards[i-1], " and ", shard, " are not neighbors")
+		}
+		for key := range dumpDB(t, s.shards[i]) {
+			if !shard.contains(key) {
+				t.Fatal("key ", key, " in shard ", shard)
+			}
+		}
+	}
+}
+
+func TestRangedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RangeOptions{
+		Options:       &Options{PageSize: 1024},
+		SplitSize:     8 << 10,
+		CheckInterval: time.Hour,
+	}
+	s, err := OpenRanged(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%05d", i)
+		err = s.Put(key, "value of "+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = "value of " + key
+	}
+	err = s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Shards()) < 4 {
+		t.Fatal("split into ", len(s.Shards()), " shards")
+	}
+	for _, db := range s.shards {
+		size, err := dataSize(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > options.SplitSize {
+			t.Fatal("shard of ", size, " bytes not split")
+		}
+	}
+	checkRanges(t, s)
+	for key, value := range expect {
+		got, err := s.Get(key)
+		if err != nil || got != value {
+			t.Fatal("get ", key, " returned ", got, err)
+		}
+	}
+	it, err := s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+	it, err = s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("01500")
+	for i := 1500; i < 3000; i++ {
+		if !it.Next() || it.Key() != fmt.Sprintf("%05d", i) {
+			t.Fatal("seek returned ", it.Key(), ", expect ", i)
+		}
+	}
+	if it.Next() {
+		t.Fatal("scan returned ", it.Key(), " after the last key")
+	}
+	it.Close()
+
+	// emptied shards are merged into their neighbors
+	shards := len(s.Shards())
+	for i := 100; i < 2900; i++ {
+		key := fmt.Sprintf("%05d", i)
+		err = s.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expect, key)
+	}
+	err = s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Shards()) >= shards {
+		t.Fatal(len(s.Shards()), " shards after the deletes, ", shards, " before")
+	}
+	checkRanges(t, s)
+
+	// the shards survive a reopen, files of a crashed split are removed
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, rangeShardPrefix+"999")
+	for _, path := range []string{orphan, orphan + "-journal"} {
+		err = ioutil.WriteFile(path, []byte("left"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = OpenRanged(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = os.Stat(orphan + "-journal"); !os.IsNotExist(err) {
+		t.Fatal("orphan shard file left")
+	}
+	checkRanges(t, s)
+	it, err = s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+
+	// writes beyond SplitSize split in the background
+	shards = len(s.Shards())
+	for i := 3000; i < 5000; i++ {
+		err = s.Put(fmt.Sprintf("%05d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Shards()) <= shards {
+		if time.Now().After(deadline) {
+			t.Fatal("no split in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRangedRebalanceWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RangeOptions{
+		Options:       &Options{PageSize: 1024},
+		SplitSize:     8 << 10,
+		CheckInterval: time.Hour,
+	}
+	s, err := OpenRanged(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expect := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%05d", i)
+		err = s.Put(key, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = "old"
+	}
+
+	// writes go on while the shards are split, none of them is lost
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for round := 0; ; round++ {
+			for i := 0; i < 3000; i += 53 {
+				key := fmt.Sprintf("%05d", i+round%53)
+				var err error
+				if round%3 == 2 {
+					err = s.Delete(key)
+					if err == ErrKeyNotFound {
+						err = nil
+					}
+					delete(expect, key)
+				} else {
+					err = s.Put(key, fmt.Sprint("new", round))
+					expect[key] = fmt.Sprint("new", round)
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+		}
+	}()
+	err = s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Shards()) < 2 {
+		t.Fatal("split into ", len(s.Shards()), " shards")
+	}
+	checkRanges(t, s)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%05d", i)
+		value, err := s.Get(key)
+		if value != expect[key] || (err == nil) != (expect[key] != "") {
+			t.Fatal("key ", key, " reads ", value, err, ", expect ", expect[key])
+		}
+	}
+
+	// the sizes kept by the writes are the sizes of the shards
+	for i, db := range s.shards {
+		size, err := dataSize(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.sizes[i] != size {
+			t.Fatal("shard ", i, " is ", size, " bytes, tracked ", s.sizes[i])
+		}
+	}
+	it, err := s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+}
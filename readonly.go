@@ -0,0 +1,104 @@
+package go_kvstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// A read only db holds the shared lock of the file only while it has read
+// transactions, a writer of another process commits in between. The first
+// read transaction takes the lock and brings the db up to the last commit,
+// the following ones share it until the last of them ends.
+
+// enterRead starts a read transaction of db, called with db.mu held.
+func (db *DB) enterRead() error {
+	if !db.Options.ReadOnly || db.File == nil {
+		return nil
+	}
+	db.readMu.Lock()
+	defer db.readMu.Unlock()
+	if db.readers == 0 {
+		err := syscall.Flock(int(db.File.Fd()), syscall.LOCK_SH) //a commit is short, wait for it
+		if err != nil {
+			return err
+		}
+		err = db.refresh()
+		if err != nil {
+			db.FileUnLock()
+			return err
+		}
+	}
+	db.readers++
+	return nil
+}
+
+func (db *DB) leaveRead() {
+	if !db.Options.ReadOnly || db.File == nil {
+		return
+	}
+	db.readMu.Lock()
+	defer db.readMu.Unlock()
+	db.readers--
+	if db.readers == 0 {
+		db.FileUnLock()
+	}
+}
+
+// refresh moves db to the file as the writer left it, the new file if it
+// was compacted in place. Nothing is reloaded if no commit happened since.
+func (db *DB) refresh() error {
+	file := db.File
+	replaced, err := db.fileReplaced()
+	if err != nil {
+		return err
+	}
+	if replaced {
+		file, err = os.Open(db.FileName)
+		if err != nil {
+			return err
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	closeNew := func() {
+		if file != db.File {
+			file.Close()
+		}
+	}
+
+	ids, pages, err := db.hotJournal(db.Options)
+	if err != nil {
+		closeNew()
+		return err
+	}
+	_, overlaid := db.Pager.(*overlayPager)
+	if !replaced && ids == nil && !overlaid {
+		meta := make([]byte, db.PageSize)
+		_, err = file.ReadAt(meta, int64(MetaPageID)*int64(db.PageSize))
+		if err != nil {
+			return err
+		}
+		if MetaTxID(meta) == db.TxID {
+			return nil
+		}
+	}
+
+	pager, err := db.Options.NewPager(file, db.Options)
+	if err != nil {
+		closeNew()
+		return err
+	}
+	if ids != nil {
+		pager = NewOverlayPager(pager, ids, pages)
+	}
+	db.Pager.Close()
+	db.Pager = pager
+	if replaced {
+		db.File.Close() //releases the lock of the old file
+		db.File = file
+	}
+	return db.reloadMeta()
+}
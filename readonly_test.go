@@ -0,0 +1,240 @@
+package go_kvstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConcurrentReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	_, err = Open(fileName, &Options{ReadOnly: true})
+	if err == nil {
+		t.Fatal("read only open creates a missing file")
+	}
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readers := make([]*DB, 3)
+	for i := range readers {
+		readers[i], err = Open(fileName, &Options{ReadOnly: true, LockTimeout: 200 * time.Millisecond})
+		if err != nil {
+			t.Fatal("reader ", i, " can not open while the writer runs: ", err)
+		}
+	}
+	_, err = Open(fileName, &Options{LockTimeout: 200 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("second writer opened, got ", err)
+	}
+
+	done := make(chan error)
+	for _, reader := range readers {
+		go func(reader *DB) {
+			for i := 0; i < 300; i++ {
+				val, err := reader.Get(strconv.Itoa(i))
+				if err == nil && val != strconv.Itoa(i) {
+					err = ErrKeyNotFound
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(reader)
+	}
+	for _, reader := range readers {
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+	}
+}
+
+func TestReadersFollowWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Put("k", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for i := 1; i < 300; i++ {
+		err = db.Put("k", strconv.Itoa(i))
+		if err == nil {
+			err = db.Put(strconv.Itoa(i), "v")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := reader.Get("k")
+		if err != nil || val != strconv.Itoa(i) {
+			t.Fatal("reader does not see commit ", i, ", got ", val, err)
+		}
+	}
+
+	//a read transaction sees one commit, the writer waits for it to end
+	tx, err := reader.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := reader.Begin(false)
+	if err != nil {
+		t.Fatal("read transactions of one db do not run together: ", err)
+	}
+	other.Rollback()
+	done := make(chan error)
+	go func() {
+		done <- db.Put("k", "last")
+	}()
+	select {
+	case err = <-done:
+		t.Fatal("commit during a read transaction of another db, got ", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	val, err := tx.Get("k")
+	if err != nil || val != "299" {
+		t.Fatal("read transaction sees ", val, err)
+	}
+	tx.Rollback()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("k", "compacted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = reader.Get("k")
+	if err != nil || val != "compacted" {
+		t.Fatal("reader does not follow the compacted file, got ", val, err)
+	}
+	val, err = reader.Get("7")
+	if err != nil || val != "v" {
+		t.Fatal("reader lost a key after compaction, got ", val, err)
+	}
+}
+
+func TestReadOnlyHotJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "db")
+
+	db, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("k", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//crash right after the journal is synced, before the db file is written
+	injector := NewFaultInjector(0)
+	db = &DB{}
+	err = db.InitWithPager(fileName, injector.Wrap(NewFilePager))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = tx.Put(strconv.Itoa(i), "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Put("k", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := db.PageCache.Dirty()
+	ops := 1 + 1 + len(ids) + 1 + 1 //allocate, id page, pages, header, sync of the journal
+	if db.CurrentPageNums > db.Pager.Size() {
+		ops++ //Extend
+	}
+	if db.CurrentPageNums != db.MetaPageNums {
+		ops++ //meta page
+	}
+	injector.FailAfter(ops)
+	if tx.Commit() != ErrInjectedFault {
+		t.Fatal("commit did not crash")
+	}
+	injector.Crash()
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		reader, err := Open(fileName, &Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := reader.Get("k")
+		if err != nil || val != "new" {
+			t.Fatal("reader does not see the journaled commit ", val, err)
+		}
+		err = reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = Open(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	val, err := db.Get("k")
+	if err != nil || val != "new" {
+		t.Fatal("writer does not recover the journaled commit ", val, err)
+	}
+}
@@ -0,0 +1,383 @@
+package go_kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Replication ships the pages of every commit of a primary to followers.
+// Followers pull: they ask for the commits after the last one they have
+// and the primary answers with the page deltas it still keeps, or with a
+// full snapshot if the follower fell too far behind. Bulk loads and in
+// place compactions write pages no delta describes, followers catch up
+// from a snapshot after them.
+
+var (
+	ErrPrimaryClosed = errors.New("primary is closed")
+	// ErrPageSizeMismatch is returned by a follower whose page size is not
+	// the one of its primary.
+	ErrPageSizeMismatch = errors.New("page size of the primary differs from the follower")
+)
+
+const (
+	// DefaultMaxDeltas is how many commits a primary keeps for followers.
+	DefaultMaxDeltas = 1024
+	// replicationPollWait is how long a fetch waits for a new commit.
+	replicationPollWait = time.Second
+	// replicationRetryInterval is how long a follower waits after a
+	// failed fetch.
+	replicationRetryInterval = 100 * time.Millisecond
+)
+
+// Delta holds the pages written by the commit TxID, the meta page
+// included.
+type Delta struct {
+	TxID  uint64
+	IDs   []uint64
+	Pages [][]byte
+}
+
+type ReplicationRequest struct {
+	// FromTxID is the first commit the follower is missing.
+	FromTxID uint64
+	// Wait bounds how long the primary waits for FromTxID to commit.
+	Wait time.Duration
+}
+
+// ReplicationResponse holds either the deltas from the requested commit
+// on, or a snapshot, a full backup as of SnapshotTxID. Both are empty if
+// no commit happened during the wait.
+type ReplicationResponse struct {
+	Deltas       []Delta
+	Snapshot     []byte
+	SnapshotTxID uint64
+}
+
+// Transport carries the fetches of a follower to the primary.
+type Transport interface {
+	Fetch(ctx context.Context, req *ReplicationRequest) (*ReplicationResponse, error)
+}
+
+// Primary keeps the deltas of the latest commits of db for followers.
+type Primary struct {
+	db        *DB
+	maxDeltas int
+
+	mu      sync.Mutex
+	deltas  []Delta //consecutive commits from firstTx on
+	firstTx uint64
+	notify  chan struct{} //closed and replaced on every commit
+	closed  bool
+}
+
+// NewPrimary starts keeping the deltas of db, maxDeltas of them, 0 for
+// DefaultMaxDeltas.
+func NewPrimary(db *DB, maxDeltas int) (*Primary, error) {
+	if maxDeltas <= 0 {
+		maxDeltas = DefaultMaxDeltas
+	}
+	p := &Primary{
+		db:        db,
+		maxDeltas: maxDeltas,
+		notify:    make(chan struct{}),
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.onCommit != nil {
+		return nil, errors.New("db already has a primary")
+	}
+	p.firstTx = db.TxID + 1
+	db.onCommit = p.committed
+	return p, nil
+}
+
+// committed is db.onCommit, called with db.mu held.
+func (p *Primary) committed(txID uint64, ids []uint64, pages [][]byte, complete bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !complete { //older commits can only be caught up from a snapshot
+		p.deltas = nil
+		p.firstTx = txID + 1
+	} else {
+		p.deltas = append(p.deltas, Delta{TxID: txID, IDs: ids, Pages: pages})
+		if len(p.deltas) > p.maxDeltas {
+			p.deltas = append([]Delta{}, p.deltas[len(p.deltas)-p.maxDeltas:]...)
+		}
+		if len(p.deltas) > 0 {
+			p.firstTx = p.deltas[0].TxID
+		}
+	}
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// Serve answers a fetch of a follower, the transports call it on the
+// primary side.
+func (p *Primary) Serve(ctx context.Context, req *ReplicationRequest) (*ReplicationResponse, error) {
+	var timeout <-chan time.Time
+	if req.Wait > 0 {
+		timer := time.NewTimer(req.Wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPrimaryClosed
+		}
+		if req.FromTxID < p.firstTx {
+			p.mu.Unlock()
+			return p.snapshot()
+		}
+		next := p.firstTx + uint64(len(p.deltas))
+		if req.FromTxID < next {
+			deltas := append([]Delta{}, p.deltas[req.FromTxID-p.firstTx:]...)
+			p.mu.Unlock()
+			return &ReplicationResponse{Deltas: deltas}, nil
+		}
+		notify := p.notify
+		p.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-timeout:
+			return &ReplicationResponse{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *Primary) snapshot() (*ReplicationResponse, error) {
+	var buf bytes.Buffer
+	info, err := p.db.Backup(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicationResponse{Snapshot: buf.Bytes(), SnapshotTxID: info.TxID}, nil
+}
+
+// Close stops keeping deltas, pending and later fetches fail.
+func (p *Primary) Close() {
+	p.db.mu.Lock()
+	p.db.onCommit = nil
+	p.db.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.deltas = nil
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// LoopbackTransport calls a primary in the same process.
+type LoopbackTransport struct {
+	Primary *Primary
+}
+
+func (t *LoopbackTransport) Fetch(ctx context.Context, req *ReplicationRequest) (*ReplicationResponse, error) {
+	return t.Primary.Serve(ctx, req)
+}
+
+// Follower keeps its db a copy of a primary. The db serves reads, writable
+// transactions return ErrReadOnly.
+type Follower struct {
+	DB        *DB
+	transport Transport
+}
+
+// NewFollower opens the db at path as a follower fetching through
+// transport, Run starts following. The follower runs no expiry sweeper,
+// the deletes of the primary's sweeper come with its commits.
+func NewFollower(path string, transport Transport, options *Options) (*Follower, error) {
+	var followerOptions Options
+	if options != nil {
+		followerOptions = *options
+	}
+	followerOptions.ExpirySweepInterval = -1
+	db, err := Open(path, &followerOptions)
+	if err != nil {
+		return nil, err
+	}
+	if db.Options.ReadOnly {
+		db.Close()
+		return nil, ErrReadOnly
+	}
+	db.replica = true
+	return &Follower{DB: db, transport: transport}, nil
+}
+
+// TxID returns the last commit of the primary the follower has.
+func (f *Follower) TxID() uint64 {
+	f.DB.mu.Lock()
+	defer f.DB.mu.Unlock()
+	return f.DB.TxID
+}
+
+// Run applies the commits of the primary until ctx is done. Failed
+// fetches are retried, a primary with another page size ends it with
+// ErrPageSizeMismatch.
+func (f *Follower) Run(ctx context.Context) error {
+	for {
+		err := f.CatchUp(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == ErrPageSizeMismatch {
+			return err
+		}
+		if err != nil {
+			timer := time.NewTimer(replicationRetryInterval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// CatchUp does one fetch and applies its answer.
+func (f *Follower) CatchUp(ctx context.Context) error {
+	resp, err := f.transport.Fetch(ctx, &ReplicationRequest{
+		FromTxID: f.TxID() + 1,
+		Wait:     replicationPollWait,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Snapshot != nil {
+		return f.DB.installSnapshot(resp.Snapshot)
+	}
+	for _, delta := range resp.Deltas {
+		err = f.DB.applyDelta(delta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the db of the follower.
+func (f *Follower) Close() error {
+	return f.DB.Close()
+}
+
+// applyDelta writes the pages of the next commit of the primary through
+// the journal, like Commit does.
+func (db *DB) applyDelta(delta Delta) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.releaseRetired()
+	if delta.TxID != db.TxID+1 {
+		return errors.New("replication delta out of order")
+	}
+	for _, page := range delta.Pages {
+		if len(page) != db.PageSize {
+			return ErrPageSizeMismatch
+		}
+	}
+
+	for _, id := range delta.IDs {
+		if id+1 > db.CurrentPageNums {
+			db.CurrentPageNums = id + 1
+		}
+	}
+	if db.CurrentPageNums > db.Pager.Size() {
+		err := db.Extend()
+		if err != nil {
+			return err
+		}
+	}
+	err := db.lockForCommit()
+	if err != nil {
+		return err
+	}
+	defer db.unlockForCommit()
+	if db.Journal != nil {
+		err = WriteJournal(db.Journal, delta.IDs, delta.Pages)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.Journal)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.preserveForBackups(delta.IDs)
+	if err != nil {
+		return err
+	}
+	for i, id := range delta.IDs {
+		err = db.Pager.WritePage(id, delta.Pages[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = db.sync(db.Pager)
+	if err != nil {
+		return err
+	}
+	if db.Journal != nil {
+		err = ClearJournal(db.Journal)
+		if err != nil {
+			return err
+		}
+		err = db.sync(db.Journal)
+		if err != nil {
+			return err
+		}
+	}
+	return db.reloadMeta()
+}
+
+// installSnapshot replaces the db file with a full backup of the primary.
+func (db *DB) installSnapshot(snapshot []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.backups) > 0 {
+		return ErrBackupInProgress
+	}
+	if len(snapshot) < metaHeaderSize || !bytes.Equal(snapshot[:8], metaMagic) {
+		return ErrInvalidFile
+	}
+	if int(binary.BigEndian.Uint32(snapshot[8:12])) != db.PageSize {
+		return ErrPageSizeMismatch
+	}
+
+	path := db.FileName + ".snapshot"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(snapshot)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = db.swapFile(path)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// reloadMeta drops the cache and rereads the meta page after the file was
+// written behind the tree's back.
+func (db *DB) reloadMeta() error {
+	db.PageCache.Clear()
+	return db.readMeta()
+}
@@ -0,0 +1,163 @@
+package go_kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func waitForTxID(t *testing.T, f *Follower, txID uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for f.TxID() != txID {
+		if time.Now().After(deadline) {
+			t.Fatal("follower at tx ", f.TxID(), ", expect ", txID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "primary"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Put("before", "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := NewPrimary(db, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	transport := &LoopbackTransport{Primary: primary}
+
+	followerPath := filepath.Join(dir, "follower")
+	follower, err := NewFollower(followerPath, transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- follower.Run(ctx) }()
+
+	for i := 0; i < 500; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForTxID(t, follower, db.TxID)
+	checkContent(t, follower.DB, dumpDB(t, db))
+	if follower.DB.Put("x", "y") != ErrReadOnly {
+		t.Fatal("follower accepted a write")
+	}
+	if follower.DB.sweepStop != nil {
+		t.Fatal("follower runs an expiry sweeper")
+	}
+
+	// behind by more than the kept deltas, caught up from a snapshot
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i += 3 {
+		err = db.Delete(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = follower.CatchUp(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follower.TxID() != db.TxID {
+		t.Fatal("follower at tx ", follower.TxID(), " after snapshot, expect ", db.TxID)
+	}
+	checkContent(t, follower.DB, dumpDB(t, db))
+
+	// restarted follower goes on from its own tx id
+	err = follower.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err = NewFollower(followerPath, transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go follower.Run(ctx)
+
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 1005; i++ {
+		err = db.Put(strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForTxID(t, follower, db.TxID)
+	checkContent(t, follower.DB, dumpDB(t, db))
+}
+
+func TestReplicationPageSizeMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "primary"), &Options{PageSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	primary, err := NewPrimary(db, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	transport := &LoopbackTransport{Primary: primary}
+	err = db.Put("k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err := NewFollower(filepath.Join(dir, "follower"), transport, &Options{PageSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	err = follower.CatchUp(context.Background()) //a delta
+	if err != ErrPageSizeMismatch {
+		t.Fatal("expect ErrPageSizeMismatch from a delta, got ", err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Put(strconv.Itoa(i), "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = follower.Run(context.Background()) //a snapshot
+	if err != ErrPageSizeMismatch {
+		t.Fatal("expect ErrPageSizeMismatch from a snapshot, got ", err)
+	}
+	if follower.TxID() != 0 {
+		t.Fatal("follower applied commits of another page size")
+	}
+}
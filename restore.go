@@ -0,0 +1,252 @@
+package go_kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrBackupTooNew     = errors.New("full backup is past the restore target")
+	ErrTargetNotReached = errors.New("backups and logs end before the restore target")
+	errRestoreDone      = errors.New("restore target reached")
+)
+
+// RestoreOptions lists what Restore rebuilds the db from.
+type RestoreOptions struct {
+	FullBackup string
+	// Incrementals are applied in order, each must start at or before the
+	// tx id reached by the previous ones.
+	Incrementals []string
+	// LogArchiveDir is the Options.LogArchiveDir of the db, replayed after
+	// the backups. It can not be replayed across a CompactInPlace.
+	LogArchiveDir string
+	// TargetTxID is the commit to restore, 0 goes as far as the backups
+	// and logs do.
+	TargetTxID uint64
+	// TargetTime, if set, restores the last commit at or before it.
+	TargetTime time.Time
+}
+
+// RestoreInfo describes the commit a restored db is at.
+type RestoreInfo struct {
+	TxID         uint64
+	CommitTime   time.Time
+	Incrementals int //incremental backups applied
+	LogRecords   int //log records replayed
+}
+
+// restorer brings a copy of the full backup forward, it tracks the commit
+// the copy is at.
+type restorer struct {
+	options  *RestoreOptions
+	file     *os.File
+	pageSize int
+	pageNums uint64
+	info     RestoreInfo
+}
+
+// Restore rebuilds the db as of options.TargetTxID or options.TargetTime
+// into a new file at dstPath. The checksums of incremental backups and log
+// records are verified, and the restored tree is read through before it
+// is renamed to dstPath.
+func Restore(dstPath string, options *RestoreOptions) (RestoreInfo, error) {
+	if _, err := os.Stat(dstPath); err == nil {
+		return RestoreInfo{}, fmt.Errorf("restore to %s: %w", dstPath, os.ErrExist)
+	}
+	tmpPath := dstPath + ".restore"
+	r := &restorer{options: options}
+	err := r.run(tmpPath)
+	if err == nil {
+		err = verifyRestored(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return RestoreInfo{}, err
+	}
+	return r.info, nil
+}
+
+func (r *restorer) run(tmpPath string) error {
+	err := copyFile(r.options.FullBackup, tmpPath)
+	if err != nil {
+		return err
+	}
+	r.file, err = os.OpenFile(tmpPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer r.file.Close()
+
+	r.pageSize, err = ReadPageSize(r.file)
+	if err != nil {
+		return err
+	}
+	if r.pageSize == 0 {
+		return ErrInvalidFile
+	}
+	meta := make([]byte, r.pageSize)
+	_, err = r.file.ReadAt(meta, int64(MetaPageID)*int64(r.pageSize))
+	if err != nil {
+		return err
+	}
+	err = r.setMeta(meta)
+	if err != nil {
+		return err
+	}
+	if r.beyond(r.info.TxID, r.info.CommitTime) {
+		return ErrBackupTooNew
+	}
+
+	for _, path := range r.options.Incrementals {
+		done, err := r.applyIncremental(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if done {
+			break
+		}
+	}
+	if r.options.LogArchiveDir != "" {
+		err = ReadLogArchive(r.options.LogArchiveDir, r.replay)
+		if err != nil && err != errRestoreDone {
+			return err
+		}
+	}
+	if r.options.TargetTxID != 0 && r.info.TxID != r.options.TargetTxID {
+		return ErrTargetNotReached
+	}
+
+	err = r.file.Truncate(int64(r.pageNums) * int64(r.pageSize))
+	if err != nil {
+		return err
+	}
+	return r.file.Sync()
+}
+
+// beyond reports whether the commit txID at commitTime is past the target.
+func (r *restorer) beyond(txID uint64, commitTime time.Time) bool {
+	if r.options.TargetTxID != 0 && txID > r.options.TargetTxID {
+		return true
+	}
+	return !r.options.TargetTime.IsZero() && commitTime.After(r.options.TargetTime)
+}
+
+func (r *restorer) setMeta(meta []byte) error {
+	pageNums, err := MetaPageNums(meta)
+	if err != nil {
+		return err
+	}
+	r.pageNums = pageNums
+	r.info.TxID = MetaTxID(meta)
+	r.info.CommitTime = MetaCommitTime(meta)
+	return nil
+}
+
+// applyIncremental returns true if the backup is past the target, the
+// later ones are then skipped as well.
+func (r *restorer) applyIncremental(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, ids, pages, err := ReadIncrementalBackup(file)
+	if err != nil {
+		return false, err
+	}
+	if info.SinceTxID > r.info.TxID || r.info.TxID > info.TxID {
+		return false, ErrBackupGap
+	}
+	var meta []byte
+	for i, id := range ids {
+		if id == MetaPageID {
+			meta = pages[i]
+		}
+	}
+	if meta == nil || len(meta) != r.pageSize {
+		return false, ErrInvalidBackup
+	}
+	if r.beyond(info.TxID, MetaCommitTime(meta)) {
+		return true, nil
+	}
+
+	err = writePages(r.file, ids, pages)
+	if err != nil {
+		return false, err
+	}
+	r.info.Incrementals++
+	return false, r.setMeta(meta)
+}
+
+func (r *restorer) replay(rec *LogRecord) error {
+	if rec.TxID <= r.info.TxID {
+		return nil //already in the backups
+	}
+	if r.beyond(rec.TxID, rec.CommitTime) {
+		return errRestoreDone
+	}
+	if rec.TxID != r.info.TxID+1 {
+		return ErrBackupGap
+	}
+	if len(rec.Pages) > 0 && len(rec.Pages[0]) != r.pageSize {
+		return ErrInvalidBackup
+	}
+
+	err := writePages(r.file, rec.IDs, rec.Pages)
+	if err != nil {
+		return err
+	}
+	r.info.LogRecords++
+	for i, id := range rec.IDs {
+		if id == MetaPageID { //the commit is complete
+			return r.setMeta(rec.Pages[i])
+		}
+	}
+	return nil
+}
+
+// verifyRestored reads every pair of the restored file in order.
+func verifyRestored(path string) error {
+	db, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	it, err := db.Iterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	var last string
+	for first := true; it.Next(); first = false {
+		if !first && it.Key() <= last {
+			return fmt.Errorf("restored tree out of order at %q: %w", it.Key(), ErrInvalidFile)
+		}
+		last = it.Key()
+	}
+	return it.Err()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package go_kvstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	db, err := Open(path("db"), &Options{LogArchiveDir: path("logs"), LogSegmentSize: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	empty, err := db.BackupTo(path("empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BulkLoad(&sliceIterator{pairs: sortedPairs(2000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := db.BackupTo(path("full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		err = db.Put("a"+strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	incFile, err := os.Create(path("inc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.IncrementalBackup(incFile, full.TxID)
+	incFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots := make(map[uint64]map[string]string)
+	var times []time.Time
+	for i := 0; i < 200; i++ {
+		err = db.Delete(sortedPairs(2000)[i*7].Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Put("b"+strconv.Itoa(i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			snapshots[db.TxID] = dumpDB(t, db)
+			time.Sleep(time.Millisecond)
+			times = append(times, time.Now())
+			time.Sleep(time.Millisecond)
+		}
+	}
+	latest := dumpDB(t, db)
+
+	restore := func(name string, options *RestoreOptions) (*DB, RestoreInfo) {
+		info, err := Restore(path(name), options)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		restored, err := Open(path(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return restored, info
+	}
+
+	restored, info := restore("latest", &RestoreOptions{
+		FullBackup:    path("full"),
+		Incrementals:  []string{path("inc")},
+		LogArchiveDir: path("logs"),
+	})
+	if info.TxID != db.TxID || info.Incrementals != 1 {
+		t.Fatalf("restored %+v, db at tx %d", info, db.TxID)
+	}
+	checkContent(t, restored, latest)
+	restored.Close()
+
+	restored, info = restore("from-empty", &RestoreOptions{
+		FullBackup:    path("empty"),
+		LogArchiveDir: path("logs"),
+	})
+	if info.TxID != db.TxID || info.LogRecords == 0 || empty.TxID != 0 {
+		t.Fatalf("restored %+v from empty backup at tx %d", info, empty.TxID)
+	}
+	checkContent(t, restored, latest)
+	restored.Close()
+
+	i := 0
+	for txID, snapshot := range snapshots {
+		restored, info = restore("tx"+strconv.Itoa(i), &RestoreOptions{
+			FullBackup:    path("full"),
+			Incrementals:  []string{path("inc")},
+			LogArchiveDir: path("logs"),
+			TargetTxID:    txID,
+		})
+		if info.TxID != txID {
+			t.Fatal("restored tx ", info.TxID, ", expect ", txID)
+		}
+		checkContent(t, restored, snapshot)
+		restored.Close()
+		i++
+	}
+
+	for i, target := range times {
+		restored, info = restore("time"+strconv.Itoa(i), &RestoreOptions{
+			FullBackup:    path("full"),
+			LogArchiveDir: path("logs"),
+			TargetTime:    target,
+		})
+		if info.CommitTime.After(target) {
+			t.Fatal("restored commit at ", info.CommitTime, " after target ", target)
+		}
+		checkContent(t, restored, snapshots[info.TxID])
+		restored.Close()
+	}
+
+	_, err = Restore(path("far"), &RestoreOptions{FullBackup: path("full"), LogArchiveDir: path("logs"), TargetTxID: db.TxID + 1})
+	if err != ErrTargetNotReached {
+		t.Fatal("expect ErrTargetNotReached, got ", err)
+	}
+	late, err := db.BackupTo(path("late"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(path("too-new"), &RestoreOptions{FullBackup: path("late"), TargetTxID: late.TxID - 1})
+	if err != ErrBackupTooNew {
+		t.Fatal("expect ErrBackupTooNew, got ", err)
+	}
+	_, err = Restore(path("gap"), &RestoreOptions{FullBackup: path("empty"), Incrementals: []string{path("inc")}})
+	if !errors.Is(err, ErrBackupGap) {
+		t.Fatal("expect ErrBackupGap, got ", err)
+	}
+	_, err = Restore(path("latest"), &RestoreOptions{FullBackup: path("full")})
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatal("expect os.ErrExist, got ", err)
+	}
+
+	content, err := ioutil.ReadFile(path("inc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)/3]++
+	err = ioutil.WriteFile(path("inc"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(path("corrupted"), &RestoreOptions{FullBackup: path("full"), Incrementals: []string{path("inc")}})
+	if !errors.Is(err, ErrInvalidBackup) {
+		t.Fatal("expect ErrInvalidBackup, got ", err)
+	}
+	if _, err = os.Stat(path("corrupted.restore")); !os.IsNotExist(err) {
+		t.Fatal("failed restore left its temporary file")
+	}
+}
+
+func TestRestoreRecoveredCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	db, err := Open(path("db"), &Options{LogArchiveDir: path("logs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("k", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.BackupTo(path("full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//crash right after the journal is synced, before the commit reaches
+	//the archive
+	injector := NewFaultInjector(0)
+	db = &DB{}
+	err = db.InitWithPager(path("db"), injector.Wrap(NewFilePager))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put("k", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := db.PageCache.Dirty()
+	injector.FailAfter(1 + 1 + len(ids) + 1 + 1 + 1) //journal of the pages and the meta page
+	if tx.Commit() != ErrInjectedFault {
+		t.Fatal("commit did not crash")
+	}
+	injector.Crash()
+	db.Close()
+
+	db, err = Open(path("db"), &Options{LogArchiveDir: path("logs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	info, err := Restore(path("restored"), &RestoreOptions{FullBackup: path("full"), LogArchiveDir: path("logs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TxID != db.TxID {
+		t.Fatal("restored tx ", info.TxID, ", the recovered commit is ", db.TxID)
+	}
+	restored, err := Open(path("restored"), &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	val, err := restored.Get("k")
+	if err != nil || val != "new" {
+		t.Fatal("restored ", val, err)
+	}
+}
+
+func TestRestoreAcrossCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	db, err := Open(path("db"), &Options{LogArchiveDir: path("logs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.BackupTo(path("full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = db.Put(strconv.Itoa(i), "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("after", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(path("restored"), &RestoreOptions{FullBackup: path("full"), LogArchiveDir: path("logs")})
+	if !errors.Is(err, ErrBackupGap) {
+		t.Fatal("expect ErrBackupGap across the compaction, got ", err)
+	}
+
+	_, err = db.BackupTo(path("compacted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("later", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Restore(path("restored"), &RestoreOptions{FullBackup: path("compacted"), LogArchiveDir: path("logs")})
+	if err != nil || info.TxID != db.TxID {
+		t.Fatal("restore from a backup after the compaction ", info.TxID, err)
+	}
+}
@@ -0,0 +1,679 @@
+package go_kvstore
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ShardedDB spreads the keys over several DB files in one directory, each
+// with its own lock, by a consistent-hash ring. Adding or removing a shard
+// only moves the keys between it and its neighbors on the ring.
+//
+// The shard names are kept in the manifest file SHARDS of the directory.
+// A migration copies the keys to their new shard before the manifest
+// changes and deletes them from the old one after, a key is only seen in
+// the shard that owns it, so the leftovers of an interrupted migration are
+// ignored. The next migration drops them before it copies anything, a
+// leftover would come back once its shard owns it again. A key moves with
+// its kept revisions and versions, the tx id of its new shard is raised to
+// its newest version.
+//
+// Gets and writes go on during a migration. The keys are copied in batches
+// and the writes to keys that move are noted, the store is only locked to
+// copy those again and swap the ring.
+
+var (
+	ErrShardExists   = errors.New("shard already exists")
+	ErrShardNotFound = errors.New("shard not found")
+	ErrLastShard     = errors.New("cannot remove the last shard")
+)
+
+const (
+	shardManifest = "SHARDS"
+	// shardVirtualNodes is how many points a shard has on the ring.
+	shardVirtualNodes = 128
+	// migrateBatchSize is how many keys a migration moves per commit.
+	migrateBatchSize = 1024
+)
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+type hashRing []ringPoint
+
+// hashKey is FNV-1a with the finalizer of splitmix64, FNV alone spreads
+// keys differing only in their last bytes poorly.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func newHashRing(names []string) hashRing {
+	ring := make(hashRing, 0, len(names)*shardVirtualNodes)
+	for shard, name := range names {
+		for i := 0; i < shardVirtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(name + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// owner returns the shard of the first point at or after the hash of key.
+func (ring hashRing) owner(key string) int {
+	hash := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].shard
+}
+
+type ShardedDB struct {
+	Dir     string
+	Options *Options
+
+	migrateMu sync.Mutex   //held by migrations, one at a time
+	mu        sync.RWMutex //held exclusively to swap the ring
+	names     []string
+	shards    []*DB
+	ring      hashRing
+	migration *shardMigration
+}
+
+// shardMigration is the ring a running migration moves to and the keys
+// written meanwhile that it moves.
+type shardMigration struct {
+	shards []*DB
+	ring   hashRing
+
+	mu    sync.Mutex
+	dirty map[string]bool
+}
+
+// OpenSharded opens the sharded store in dir. A new store is created with
+// shards shards, an existing one keeps the shards of its manifest.
+func OpenSharded(dir string, shards int, options *Options) (*ShardedDB, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &ShardedDB{Dir: dir, Options: options}
+	names, err := readManifest(filepath.Join(dir, shardManifest))
+	if os.IsNotExist(err) {
+		if shards < 1 {
+			return nil, errors.New("a sharded db needs at least one shard")
+		}
+		for i := 0; i < shards; i++ {
+			names = append(names, "shard-"+strconv.Itoa(i))
+		}
+		err = writeManifest(filepath.Join(dir, shardManifest), names)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		db, err := Open(filepath.Join(dir, name), options)
+		if err != nil {
+			s.closeShards()
+			return nil, err
+		}
+		s.names = append(s.names, name)
+		s.shards = append(s.shards, db)
+	}
+	s.ring = newHashRing(s.names)
+	return s, nil
+}
+
+func readManifest(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			names = append(names, scanner.Text())
+		}
+	}
+	return names, scanner.Err()
+}
+
+func writeManifest(path string, names []string) error {
+	return writeFileAtomic(path, []byte(strings.Join(names, "\n")+"\n"))
+}
+
+// writeFileAtomic replaces the file at path with content, a crash leaves
+// either the old or the new content.
+func writeFileAtomic(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, content, 0644)
+	if err == nil {
+		err = syncFile(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncFile(filepath.Dir(path)) //makes the rename durable
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func validShardName(name string) bool {
+	return name != "" && name != shardManifest && !strings.ContainsAny(name, "/\\#") &&
+		!strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".tmp")
+}
+
+// Shards returns the names of the shards.
+func (s *ShardedDB) Shards() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.names...)
+}
+
+// Shard returns the db of the shard owning key. Writes to it during
+// AddShard or RemoveShard may be lost, use Put and Delete.
+func (s *ShardedDB) Shard(key string) *DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[s.ring.owner(key)]
+}
+
+func (s *ShardedDB) Get(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[s.ring.owner(key)].Get(key)
+}
+
+func (s *ShardedDB) Put(key, value string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.shards[s.ring.owner(key)]
+	s.written(key, db)
+	return db.Put(key, value)
+}
+
+// Delete removes key, ErrKeyNotFound is returned if it does not exist.
+func (s *ShardedDB) Delete(key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db := s.shards[s.ring.owner(key)]
+	s.written(key, db)
+	return db.Delete(key)
+}
+
+// written notes a write of key to db for a running migration that moves
+// it, called with s.mu held.
+func (s *ShardedDB) written(key string, db *DB) {
+	m := s.migration
+	if m == nil || m.shards[m.ring.owner(key)] == db {
+		return
+	}
+	m.mu.Lock()
+	m.dirty[key] = true
+	m.mu.Unlock()
+}
+
+// Iterator returns an iterator over the keys of all shards in key order.
+// Every shard and the shard set are locked until it is closed.
+func (s *ShardedDB) Iterator() (*MergedIterator, error) {
+	s.mu.RLock()
+	ring := s.ring
+	it, err := newMergedIterator(s.shards, func(shard int, key string) bool {
+		return ring.owner(key) == shard
+	})
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, err
+	}
+	it.release = s.mu.RUnlock
+	return it, nil
+}
+
+// AddShard creates the shard name and moves the keys it owns to it.
+func (s *ShardedDB) AddShard(name string) error {
+	if !validShardName(name) {
+		return errors.New("invalid shard name " + strconv.Quote(name))
+	}
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	s.mu.RLock()
+	oldNames, oldShards := s.names, s.shards
+	s.mu.RUnlock()
+	for _, existing := range oldNames {
+		if existing == name {
+			return ErrShardExists
+		}
+	}
+
+	path := filepath.Join(s.Dir, name)
+	err := removeFiles(path, path+"-journal", path+"-changes") //left by an interrupted AddShard
+	if err != nil {
+		return err
+	}
+	db, err := Open(path, s.Options)
+	if err != nil {
+		return err
+	}
+	names := append(append([]string{}, oldNames...), name)
+	shards := append(append([]*DB{}, oldShards...), db)
+
+	sources := make([]int, len(oldShards))
+	for i := range sources {
+		sources[i] = i
+	}
+	err = s.migrate(sources, names, shards)
+	if err != nil {
+		db.Close()
+		removeFiles(path, path+"-journal", path+"-changes")
+		return err
+	}
+	return dropForeign(shards, newHashRing(names))
+}
+
+// RemoveShard moves the keys of the shard name to the remaining shards
+// and deletes its file.
+func (s *ShardedDB) RemoveShard(name string) error {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	s.mu.RLock()
+	oldNames, oldShards := s.names, s.shards
+	s.mu.RUnlock()
+	index := -1
+	for i, existing := range oldNames {
+		if existing == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrShardNotFound
+	}
+	if len(oldNames) == 1 {
+		return ErrLastShard
+	}
+
+	names := append(append([]string{}, oldNames[:index]...), oldNames[index+1:]...)
+	shards := append(append([]*DB{}, oldShards[:index]...), oldShards[index+1:]...)
+	err := s.migrate([]int{index}, names, shards)
+	if err != nil {
+		return err
+	}
+	err = oldShards[index].Close()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, name)
+	return removeFiles(path, path+"-journal", path+"-changes")
+}
+
+// migrate copies the keys of the sources, indexes into the current
+// shards, that the ring of names gives to another shard, and makes names
+// the shards of the store. Called with s.migrateMu held.
+func (s *ShardedDB) migrate(sources []int, names []string, shards []*DB) error {
+	old, oldRing := s.shards, s.ring
+	err := dropForeign(old, oldRing)
+	if err != nil {
+		return err
+	}
+	m := &shardMigration{shards: shards, ring: newHashRing(names), dirty: make(map[string]bool)}
+	s.mu.Lock()
+	s.migration = m
+	s.mu.Unlock()
+
+	err = copyMoved(old, oldRing, sources, shards, m.ring)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.migration = nil
+	if err == nil {
+		err = m.copyDirty(old, oldRing)
+	}
+	if err == nil {
+		err = writeManifest(filepath.Join(s.Dir, shardManifest), names)
+	}
+	if err != nil {
+		return err
+	}
+	s.names, s.shards, s.ring = names, shards, m.ring
+	return nil
+}
+
+// copyDirty copies the keys written during the migration to their new
+// shard again, or deletes them there if they are gone. Called with the
+// store locked.
+func (m *shardMigration) copyDirty(old []*DB, oldRing hashRing) error {
+	bySource := make(map[int][]string)
+	for key := range m.dirty {
+		source := oldRing.owner(key)
+		bySource[source] = append(bySource[source], key)
+	}
+	for source, keys := range bySource {
+		err := moveKeys(old[source], keys, m.shards, m.ring)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanShard calls fn with the pairs of db in key order, kept revisions
+// included, migrateBatchSize at a time. Each batch is read in its own
+// transaction, so the writers of db are not held up for the whole scan.
+func scanShard(db *DB, fn func(pairs []KVPair) error) error {
+	var last string
+	for started := false; ; started = true {
+		it, err := db.Iterator()
+		if err != nil {
+			return err
+		}
+		it.withHistory = true
+		if started {
+			it.Seek(last + "\x00") //the first key after last
+		}
+		var pairs []KVPair
+		for len(pairs) < migrateBatchSize && it.Next() {
+			pairs = append(pairs, it.Pair())
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return err
+		}
+		if len(pairs) > 0 {
+			err = fn(pairs)
+			if err != nil {
+				return err
+			}
+		}
+		if len(pairs) < migrateBatchSize {
+			return nil
+		}
+		last = pairs[len(pairs)-1].Key
+	}
+}
+
+// batchKeys returns the keys the pairs belong to for which keep is true,
+// each once.
+func batchKeys(pairs []KVPair, keep func(key string) bool) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		key := pairKey(pair)
+		if !seen[key] && keep(key) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// copyMoved copies the keys of the sources, indexes into old, that ring
+// gives to another shard of shards. Keys old does not assign to their
+// source are leftovers and skipped.
+func copyMoved(old []*DB, oldRing hashRing, sources []int, shards []*DB, ring hashRing) error {
+	for _, source := range sources {
+		err := scanShard(old[source], func(pairs []KVPair) error {
+			moved := batchKeys(pairs, func(key string) bool {
+				return oldRing.owner(key) == source && shards[ring.owner(key)] != old[source]
+			})
+			return moveKeys(old[source], moved, shards, ring)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropForeign deletes the keys ring does not assign to the shard they are
+// in, with their kept revisions.
+func dropForeign(shards []*DB, ring hashRing) error {
+	for shard, db := range shards {
+		err := scanShard(db, func(pairs []KVPair) error {
+			foreign := batchKeys(pairs, func(key string) bool {
+				return ring.owner(key) != shard
+			})
+			if len(foreign) == 0 {
+				return nil
+			}
+			return db.Update(func(tx *Tx) error {
+				for _, key := range foreign {
+					_, err := tx.db.installKey(key, nil)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveKeys copies the pairs of keys in source, with their kept revisions
+// and versions, to the owners ring gives them in shards, one commit per
+// shard. Keys gone from source are deleted there.
+func moveKeys(source *DB, keys []string, shards []*DB, ring hashRing) error {
+	byOwner := make(map[int]map[string][]KVPair)
+	tx, err := source.Begin(false)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		pairs, err := tx.db.keyPairs(key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		owner := ring.owner(key)
+		if byOwner[owner] == nil {
+			byOwner[owner] = make(map[string][]KVPair)
+		}
+		byOwner[owner][key] = pairs
+	}
+	tx.Rollback()
+
+	for owner, keyPairs := range byOwner {
+		err := shards[owner].Update(func(tx *Tx) error {
+			for key, pairs := range keyPairs {
+				_, err := tx.db.installKey(key, pairs)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDB) closeShards() error {
+	var firstErr error
+	for _, db := range s.shards {
+		err := db.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes all shards, after a running migration.
+func (s *ShardedDB) Close() error {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeShards()
+	s.shards = nil
+	return err
+}
+
+// MergedIterator walks the keys of several dbs in key order, like
+// Iterator does for one.
+type MergedIterator struct {
+	its     []*Iterator
+	owns    func(shard int, key string) bool
+	heap    mergeHeap
+	started bool
+	pair    KVPair
+	err     error
+	release func()
+}
+
+type mergeHeap struct {
+	its    []*Iterator
+	shards []int
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.shards)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	return h.its[h.shards[i]].Key() < h.its[h.shards[j]].Key()
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.shards[i], h.shards[j] = h.shards[j], h.shards[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.shards = append(h.shards, x.(int))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	shard := h.shards[len(h.shards)-1]
+	h.shards = h.shards[:len(h.shards)-1]
+	return shard
+}
+
+// newMergedIterator opens an iterator on every db, owns tells whether a
+// key of a shard is visible.
+func newMergedIterator(dbs []*DB, owns func(shard int, key string) bool) (*MergedIterator, error) {
+	m := &MergedIterator{owns: owns}
+	for _, db := range dbs {
+		it, err := db.Iterator()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.its = append(m.its, it)
+	}
+	m.heap.its = m.its
+	return m, nil
+}
+
+// advance moves the iterator of shard to its next visible key and puts it
+// back on the heap.
+func (m *MergedIterator) advance(shard int) {
+	it := m.its[shard]
+	for it.Next() {
+		if m.owns(shard, it.Key()) {
+			heap.Push(&m.heap, shard)
+			return
+		}
+	}
+	if it.Err() != nil && m.err == nil {
+		m.err = it.Err()
+	}
+}
+
+// Seek positions the iterator so that the following Next returns the
+// first key greater than or equal to key.
+func (m *MergedIterator) Seek(key string) {
+	m.heap.shards = m.heap.shards[:0]
+	m.started = true
+	for shard, it := range m.its {
+		it.Seek(key)
+		m.advance(shard)
+	}
+}
+
+func (m *MergedIterator) Next() bool {
+	if !m.started {
+		m.started = true
+		for shard := range m.its {
+			m.advance(shard)
+		}
+	}
+	if m.err != nil || m.heap.Len() == 0 {
+		return false
+	}
+	shard := heap.Pop(&m.heap).(int)
+	it := m.its[shard]
+	m.pair = KVPair{Key: it.Key(), Value: it.Value()}
+	m.advance(shard)
+	return m.err == nil
+}
+
+func (m *MergedIterator) Key() string {
+	return m.pair.Key
+}
+
+func (m *MergedIterator) Value() string {
+	return m.pair.Value
+}
+
+func (m *MergedIterator) Err() error {
+	return m.err
+}
+
+// Close closes the iterators of all dbs.
+func (m *MergedIterator) Close() error {
+	var firstErr error
+	for _, it := range m.its {
+		err := it.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.its = nil
+	if m.release != nil {
+		m.release()
+		m.release = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,304 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+type scanner interface {
+	Next() bool
+	Key() string
+	Value() string
+	Err() error
+	Close() error
+}
+
+// checkScan checks that it returns exactly expect in key order.
+func checkScan(t *testing.T, it scanner, expect map[string]string) {
+	var keys []string
+	for it.Next() {
+		if expect[it.Key()] != it.Value() {
+			t.Fatal("scan returned ", it.Key(), "=", it.Value(), ", expect ", expect[it.Key()])
+		}
+		keys = append(keys, it.Key())
+	}
+	err := it.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	if len(keys) != len(expect) || !sort.StringsAreSorted(keys) {
+		t.Fatal("scan returned ", len(keys), " keys, expect ", len(expect), " in order")
+	}
+}
+
+func TestShardedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSharded(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		err = s.Put(key, "v"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = "v" + key
+	}
+	for i := 0; i < 3000; i += 7 {
+		err = s.Delete(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expect, strconv.Itoa(i))
+	}
+	if s.Delete("0") != ErrKeyNotFound {
+		t.Fatal("delete of a missing key succeeded")
+	}
+	for i, db := range s.shards {
+		if len(dumpDB(t, db)) < len(expect)/6 {
+			t.Fatal("shard ", s.names[i], " holds ", len(dumpDB(t, db)), " of ", len(expect), " keys")
+		}
+	}
+	it, err := s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+
+	// a new shard takes its keys from the others, nothing else moves
+	before := make(map[string]*DB)
+	for key := range expect {
+		before[key] = s.Shard(key)
+	}
+	err = s.AddShard("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AddShard("extra") != ErrShardExists {
+		t.Fatal("added a shard twice")
+	}
+	moved := 0
+	for key, value := range expect {
+		owner := s.Shard(key)
+		if owner != before[key] {
+			if owner != s.shards[3] {
+				t.Fatal("key ", key, " moved between old shards")
+			}
+			moved++
+		}
+		got, err := s.Get(key)
+		if err != nil || got != value {
+			t.Fatal("get ", key, " returned ", got, err)
+		}
+	}
+	if moved == 0 || moved > len(expect)/2 {
+		t.Fatal(moved, " of ", len(expect), " keys moved to the new shard")
+	}
+	total := 0
+	for _, db := range s.shards {
+		total += len(dumpDB(t, db))
+	}
+	if total != len(expect) {
+		t.Fatal("shards hold ", total, " keys, expect ", len(expect))
+	}
+
+	// the shards survive a reopen
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSharded(dir, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.Shards()) != 4 {
+		t.Fatal("shards after reopen ", s.Shards())
+	}
+	it, err = s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+
+	for _, name := range []string{"shard-0", "extra", "shard-2"} {
+		err = s.RemoveShard(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatal("file of the removed shard ", name, " left")
+		}
+	}
+	if s.RemoveShard("shard-1") != ErrLastShard {
+		t.Fatal("removed the last shard")
+	}
+	checkContent(t, s.shards[0], expect)
+	it, err = s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("5")
+	if !it.Next() || it.Key() != "5" {
+		t.Fatal("seek returned ", it.Key())
+	}
+	it.Close()
+}
+
+func TestShardMigrationLeftovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSharded(dir, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 200; i++ {
+		err = s.Put(strconv.Itoa(i), "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := make(map[string]*DB)
+	for i := 0; i < 200; i++ {
+		before[strconv.Itoa(i)] = s.Shard(strconv.Itoa(i))
+	}
+	err = s.AddShard("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an AddShard cut off before it dropped a moved key from its old shard
+	var moved string
+	for key, db := range before {
+		if s.Shard(key) != db {
+			moved = key
+			break
+		}
+	}
+	err = before[moved].Put(moved, "leftover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RemoveShard("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Get(moved); err != ErrKeyNotFound {
+		t.Fatal("deleted key came back as ", value, err)
+	}
+}
+
+func TestShardMigrationWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSharded(dir, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expect := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		err = s.Put(key, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = "old"
+	}
+
+	// writes go on while the shards change, none of them is lost
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for round := 0; ; round++ {
+			for i := 0; i < 5000; i += 97 {
+				key := strconv.Itoa(i + round%97)
+				var err error
+				if round%3 == 2 {
+					err = s.Delete(key)
+					if err == ErrKeyNotFound {
+						err = nil
+					}
+					delete(expect, key)
+				} else {
+					err = s.Put(key, "new"+strconv.Itoa(round))
+					expect[key] = "new" + strconv.Itoa(round)
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+		}
+	}()
+	err = s.AddShard("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RemoveShard("shard-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i, db := range s.shards {
+		content := dumpDB(t, db)
+		for key := range content {
+			if s.ring.owner(key) != i {
+				t.Fatal("key ", key, " left in shard ", s.names[i])
+			}
+		}
+		total += len(content)
+	}
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		value, err := s.Get(key)
+		if value != expect[key] || (err == nil) != (expect[key] != "") {
+			t.Fatal("key ", key, " reads ", value, err, ", expect ", expect[key])
+		}
+	}
+	if total != len(expect) {
+		t.Fatal("shards hold ", total, " keys, expect ", len(expect))
+	}
+	it, err := s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+}
@@ -0,0 +1,93 @@
+package go_kvstore
+
+// Store is the key value interface shared by the file backed DB and the
+// in-memory one returned by NewMemDB.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	Iterator() (*Iterator, error)
+	Begin(writable bool) (*Tx, error)
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+
+// NewMemDB returns a DB whose pages live on the heap instead of a file.
+// It runs the same B-tree code and is meant for tests.
+func NewMemDB() *DB {
+	options, _ := (*Options)(nil).withDefaults()
+	db := &DB{}
+	db.initPager(NewMemPager(options.PageSize), nil, options) //never fails for memory pages
+	return db
+}
+
+func (db *DB) Get(key string) (string, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	return tx.Get(key)
+}
+
+func (db *DB) Put(key, value string) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	err = tx.Put(key, value)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes key from the tree, ErrKeyNotFound is returned if it does
+// not exist.
+func (db *DB) Delete(key string) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(key)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update runs fn in a write transaction, committed if fn returns nil and
+// rolled back otherwise.
+func (db *DB) Update(fn func(*Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //releases the db if fn panics, no-op after Commit
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Iterator returns an iterator over the whole tree inside its own read
+// transaction. The db is locked until the iterator is closed.
+func (db *DB) Iterator() (*Iterator, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	it, err := tx.Iterator()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	it.ownTx = true
+	return it, nil
+}
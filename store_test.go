@@ -0,0 +1,189 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	StoreTest(t, NewMemDB())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := &DB{}
+	err = db.Init(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	StoreTest(t, db)
+}
+
+func StoreTest(t *testing.T, store Store) {
+	defer store.Close()
+
+	_, err := store.Get("missing")
+	if err != ErrKeyNotFound {
+		t.Fatal("expect ErrKeyNotFound on empty store, got ", err)
+	}
+
+	keys := make([]string, 0)
+	for i := 0; i < 2000; i++ {
+		key := strconv.Itoa(i * 7919 % 2000)
+		keys = append(keys, key)
+		err = store.Put(key, "v"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(keys)
+	IteratorTest(t, store, keys)
+
+	for i := 0; i < 2000; i += 3 {
+		err = store.Delete(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal("delete error ", i, err)
+		}
+	}
+	remain := make([]string, 0)
+	for _, key := range keys {
+		i, _ := strconv.Atoi(key)
+		_, err := store.Get(key)
+		if i%3 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatal("deleted key still readable ", key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		remain = append(remain, key)
+	}
+	IteratorTest(t, store, remain)
+
+	err = store.Delete("0")
+	if err != ErrKeyNotFound {
+		t.Fatal("expect ErrKeyNotFound deleting missing key, got ", err)
+	}
+
+	tx, err := store.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put("new", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Delete("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := tx.Get("new")
+	if err != nil || val != "value" {
+		t.Fatal("tx can not read its own write")
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get("new")
+	if err != ErrKeyNotFound {
+		t.Fatal("rolled back write is visible")
+	}
+	val, err = store.Get("1")
+	if err != nil || val != "v1" {
+		t.Fatal("rolled back delete is visible")
+	}
+
+	for _, key := range remain {
+		err = store.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	IteratorTest(t, store, []string{})
+
+	tx, err = store.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put("k", "v")
+	if err != ErrTxNotWritable {
+		t.Fatal("expect ErrTxNotWritable, got ", err)
+	}
+	tx.Rollback()
+}
+
+func IteratorTest(t *testing.T, store Store, keys []string) {
+	it, err := store.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	i := 0
+	for it.Next() {
+		if i >= len(keys) || it.Key() != keys[i] || it.Value() != "v"+keys[i] {
+			t.Fatal("iterator out of order at ", i, it.Key())
+		}
+		i++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if i != len(keys) {
+		t.Fatal("iterator returned ", i, " keys, expect ", len(keys))
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+	it.Seek(keys[len(keys)/2])
+	if !it.Next() || it.Key() != keys[len(keys)/2] {
+		t.Fatal("seek to existing key error")
+	}
+	it.Seek(keys[len(keys)/2] + "\x00")
+	if len(keys)/2+1 < len(keys) && (!it.Next() || it.Key() != keys[len(keys)/2+1]) {
+		t.Fatal("seek to missing key error")
+	}
+}
+
+func TestRandomOperations(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		db := NewMemDB()
+		expect := make(map[string]string)
+		for i := 0; i < 3000; i++ {
+			key := strconv.Itoa(r.Intn(700))
+			if r.Intn(3) == 0 {
+				_, exist := expect[key]
+				err := db.Delete(key)
+				if exist != (err == nil) {
+					t.Fatal("delete error ", key, err)
+				}
+				delete(expect, key)
+				continue
+			}
+			err := db.Put(key, strconv.Itoa(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect[key] = strconv.Itoa(i)
+		}
+		BtreeStructureTest(t, db)
+		if !EqualContent(ReadAll(t, db), expect) {
+			t.Fatal("content mismatch with seed ", seed)
+		}
+	}
+}
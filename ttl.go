@@ -0,0 +1,314 @@
+package go_kvstore
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+// Pairs written by PutWithTTL carry their expiry time. Reads, iterators
+// and deletes treat an expired pair as absent, a sweeper goroutine of
+// every writable db deletes them for good in batches.
+//
+// The sweeper keeps the expiring keys in a heap ordered by expiry, filled
+// by the writes and, once after opening, by a scan of the tree that only
+// locks the db for expiryScanChunk pairs at a time. An entry whose key was
+// rewritten since is dropped when it comes up.
+//
+// A db written by a RaftNode cannot delete on its own, its sweeper
+// proposes RaftExpire entries for the expired pairs instead. They delete
+// the pair on every member if it still has the expiry of the entry, so
+// the members agree whatever their clocks say.
+
+var ErrValueTooLong = errors.New("value too long")
+
+const (
+	// expiryFlag marks a value length followed by an expiry, see
+	// TreeNodeToBytes.
+	expiryFlag = 0x8000
+	// MaxExpiringValueSize is the longest value PutWithTTL stores, the
+	// rest of the value slot holds the expiry.
+	MaxExpiringValueSize = maxValueSize - 8
+	// expiryScanChunk is how many pairs the initial scan reads per lock.
+	expiryScanChunk = 4096
+	// expirySweepBatch is how many keys the sweeper deletes per commit.
+	expirySweepBatch = 1024
+)
+
+type expiryEntry struct {
+	expiresAt int64
+	key       string
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].expiresAt < h[j].expiresAt
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// PutWithTTL writes key so that it reads as absent once ttl has passed.
+// The value can be at most MaxExpiringValueSize long.
+func (db *DB) PutWithTTL(key, value string, ttl time.Duration) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	err = tx.PutWithTTL(key, value, ttl)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tx *Tx) PutWithTTL(key, value string, ttl time.Duration) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	if expiresAt == 0 { //0 means no expiry
+		expiresAt = -1
+	}
+	return tx.db.WritePair(KVPair{Key: key, Value: value, ExpiresAt: expiresAt})
+}
+
+// TTL returns how long key has left before it expires, 0 if it does not
+// expire.
+func (db *DB) TTL(key string) (time.Duration, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	pair, err := db.readPair(key)
+	now := time.Now().UnixNano()
+	if err == nil && pair.expired(now) {
+		err = ErrKeyNotFound
+	}
+	if err != nil || pair.ExpiresAt == 0 {
+		return 0, err
+	}
+	return time.Duration(pair.ExpiresAt - now), nil
+}
+
+// trackExpiry remembers a written pair for the sweeper, called with db.mu
+// held.
+func (db *DB) trackExpiry(pair KVPair) {
+	if pair.ExpiresAt != 0 && db.sweepStop != nil {
+		heap.Push(&db.expiries, expiryEntry{expiresAt: pair.ExpiresAt, key: pair.Key})
+	}
+}
+
+// startSweeper runs the sweeper of a writable db until Close.
+func (db *DB) startSweeper(interval time.Duration) {
+	db.sweepStop = make(chan struct{})
+	db.expiryScanPending = true
+	db.sweepDone.Add(1)
+	go db.runSweeper(interval)
+}
+
+func (db *DB) runSweeper(interval time.Duration) {
+	defer db.sweepDone.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.sweepStop:
+			return
+		}
+		db.sweep() //failures are retried on the next tick
+	}
+}
+
+func (db *DB) stopSweeper() {
+	if db.sweepStop != nil {
+		close(db.sweepStop)
+		db.sweepDone.Wait()
+		db.sweepStop = nil
+	}
+}
+
+// sweep deletes the expired pairs, after scanning the tree for them if it
+// was not scanned since the db file was opened or replaced.
+func (db *DB) sweep() error {
+	db.mu.Lock()
+	pending := db.expiryScanPending
+	db.mu.Unlock()
+	if pending {
+		err := db.scanExpiries()
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		deleted, err := db.sweepBatch()
+		if err != nil || deleted < expirySweepBatch {
+			return err
+		}
+	}
+}
+
+// scanExpiries adds every expiring pair of the tree to the heap.
+func (db *DB) scanExpiries() error {
+	var after string
+	for {
+		tx, err := db.Begin(false)
+		if err != nil {
+			return err
+		}
+		it, err := NewIterator(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		it.withExpired = true
+		if after != "" {
+			it.Seek(after)
+		}
+		count := 0
+		for count < expiryScanChunk && it.Next() {
+			if it.Key() == after && after != "" {
+				continue
+			}
+			pair := it.Pair()
+			if pair.ExpiresAt != 0 {
+				heap.Push(&db.expiries, expiryEntry{expiresAt: pair.ExpiresAt, key: pair.Key})
+			}
+			after = pair.Key
+			count++
+		}
+		err = it.Err()
+		if err == nil && count < expiryScanChunk {
+			db.expiryScanPending = false
+		}
+		tx.Rollback()
+		if err != nil || count < expiryScanChunk {
+			return err
+		}
+	}
+}
+
+// sweepBatch deletes up to expirySweepBatch expired pairs in one commit.
+func (db *DB) sweepBatch() (int, error) {
+	db.mu.RLock()
+	expire := db.expire
+	db.mu.RUnlock()
+	if expire != nil {
+		return db.proposeExpiries(expire)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano()
+	var popped []expiryEntry
+	deleted := 0
+	for err == nil && len(db.expiries) > 0 && db.expiries[0].expiresAt <= now && deleted < expirySweepBatch {
+		entry := heap.Pop(&db.expiries).(expiryEntry)
+		popped = append(popped, entry)
+		var pair KVPair
+		pair, err = db.readPair(entry.key)
+		if err == ErrKeyNotFound {
+			err = nil
+			continue
+		}
+		if err != nil || pair.ExpiresAt != entry.expiresAt { //rewritten since
+			continue
+		}
+		err = db.removePair(pair)
+		if err == nil {
+			deleted++
+		}
+	}
+	if err == nil && deleted == 0 {
+		return 0, tx.Rollback()
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		db.mu.Lock()
+		for _, entry := range popped {
+			heap.Push(&db.expiries, entry)
+		}
+		db.mu.Unlock()
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// proposeExpiries hands up to expirySweepBatch expired pairs to expire.
+func (db *DB) proposeExpiries(expire func(entries []expiryEntry) (int, error)) (int, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano()
+	var popped, expired []expiryEntry
+	for err == nil && len(db.expiries) > 0 && db.expiries[0].expiresAt <= now && len(expired) < expirySweepBatch {
+		entry := heap.Pop(&db.expiries).(expiryEntry)
+		popped = append(popped, entry)
+		var pair KVPair
+		pair, err = db.readPair(entry.key)
+		if err == ErrKeyNotFound {
+			err = nil
+			continue
+		}
+		if err == nil && pair.ExpiresAt == entry.expiresAt {
+			expired = append(expired, entry)
+		}
+	}
+	tx.Rollback()
+	deleted := 0
+	if err == nil && len(expired) > 0 {
+		deleted, err = expire(expired)
+	}
+	if err != nil { //tried again by the next sweep, on a follower once it leads
+		db.mu.Lock()
+		for _, entry := range popped {
+			heap.Push(&db.expiries, entry)
+		}
+		db.mu.Unlock()
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// expirePair deletes key if it is stored with the expiry expiresAt, for a
+// RaftExpire entry.
+func (db *DB) expirePair(key string, expiresAt int64) error {
+	pair, err := db.readPair(key)
+	if err != nil {
+		return err
+	}
+	if pair.ExpiresAt != expiresAt { //rewritten since it was proposed
+		return ErrKeyNotFound
+	}
+	return db.removePair(pair)
+}
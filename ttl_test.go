@@ -0,0 +1,165 @@
+package go_kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stored reports whether key is still in the tree, expired or not.
+func stored(t *testing.T, db *DB, key string) bool {
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = db.readPair(key)
+	if err != nil && err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ttl")
+	options := &Options{PageSize: 1024, ExpirySweepInterval: -1}
+
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 200; i += 2 {
+		err = db.PutWithTTL(strconv.Itoa(i), "long "+strconv.Itoa(i), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		err = db.PutWithTTL(strconv.Itoa(i), "short "+strconv.Itoa(i), 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiry := time.Now().Add(200 * time.Millisecond)
+	value, err := db.Get("198")
+	if err != nil || value != "short 198" {
+		t.Fatal("get returned ", value, err)
+	}
+	err = db.Put("forever", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.PutWithTTL("big", strings.Repeat("x", MaxExpiringValueSize+1), time.Hour) != ErrValueTooLong {
+		t.Fatal("stored a value too long for an expiry")
+	}
+	for _, size := range []int{maxValueSize + 1, 40000} {
+		if db.Put("big", strings.Repeat("x", size)) != ErrValueTooLong {
+			t.Fatal("stored a value of ", size, " bytes")
+		}
+	}
+	err = db.Put("full", strings.Repeat("x", maxValueSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err = db.Get("forever"); err != nil || value != "value" {
+		t.Fatal("neighbor of the long values reads ", value, err)
+	}
+	err = db.Delete("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := db.TTL("1")
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatal("ttl returned ", ttl, err)
+	}
+	ttl, err = db.TTL("forever")
+	if err != nil || ttl != 0 {
+		t.Fatal("ttl of a key without expiry returned ", ttl, err)
+	}
+
+	// a plain put drops the expiry
+	err = db.Put("2", "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(expiry))
+	expect := map[string]string{"forever": "value", "2": "kept"}
+	for i := 1; i < 200; i += 2 {
+		expect[strconv.Itoa(i)] = "long " + strconv.Itoa(i)
+	}
+	checkContent(t, db, expect)
+	it, err := db.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, it, expect)
+	if db.Delete("0") != ErrKeyNotFound {
+		t.Fatal("deleted an expired key")
+	}
+	if !stored(t, db, "0") {
+		t.Fatal("expired key removed without a sweeper")
+	}
+
+	// the expiry survives a compaction and a reopen, the sweeper finds the
+	// expired keys by scanning the tree
+	_, err = db.CompactInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, err = db.TTL("1")
+	if err != nil || ttl <= 59*time.Minute {
+		t.Fatal("ttl after compaction returned ", ttl, err)
+	}
+	err = db.PutWithTTL("0", "again", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.ExpirySweepInterval = 10 * time.Millisecond
+	db, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.PutWithTTL("new", "value", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for stored(t, db, "0") || stored(t, db, "new") {
+		if time.Now().After(deadline) {
+			t.Fatal("expired keys not swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkContent(t, db, expect)
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err = tx.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.withExpired = true
+	count := 0
+	for it.Next() {
+		count++
+	}
+	tx.Rollback()
+	if count != len(expect) {
+		t.Fatal("sweeper left ", count, " keys, expect ", len(expect))
+	}
+}
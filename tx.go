@@ -0,0 +1,198 @@
+package go_kvstore
+
+import (
+	"errors"
+)
+
+var (
+	ErrTxClosed      = errors.New("transaction already committed or rolled back")
+	ErrTxNotWritable = errors.New("transaction is read only")
+)
+
+// Tx holds the db lock from Begin until Commit or Rollback, shared by read
+// transactions. Writes are kept in the dirty pages and only reach the file
+// on Commit.
+type Tx struct {
+	db        *DB
+	writable  bool
+	exclusive bool //holds the db lock exclusively
+	pageNums  uint64
+	closed    bool
+	// changeLogSize and archiveMark are where the change log and the log
+	// archive are cut back to if the transaction does not commit.
+	changeLogSize int64
+	archiveMark   logMark
+}
+
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.begin(writable, false)
+}
+
+// begin with replicated set starts a writable transaction on a replica,
+// for the replication that owns it.
+func (db *DB) begin(writable, replicated bool) (*Tx, error) {
+	tx := &Tx{db: db, writable: writable, exclusive: writable}
+	err := tx.start(replicated)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// beginExclusive starts a read transaction that keeps the other read
+// transactions out as well, for callers that change the db under them.
+func (db *DB) beginExclusive() (*Tx, error) {
+	tx := &Tx{db: db, exclusive: true}
+	err := tx.start(false)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *Tx) start(replicated bool) error {
+	db := tx.db
+	tx.lock()
+	if db.Pager == nil {
+		tx.unlock()
+		return errors.New("db is not opened")
+	}
+	if db.failed {
+		tx.unlock()
+		return ErrCommitFailed
+	}
+	if tx.writable && (db.Options.ReadOnly || db.replica && !replicated) {
+		tx.unlock()
+		return ErrReadOnly
+	}
+	if !tx.writable {
+		err := db.enterRead()
+		if err != nil {
+			tx.unlock()
+			return err
+		}
+	}
+	tx.pageNums = db.CurrentPageNums
+	if db.changeLog != nil {
+		tx.changeLogSize = db.changeLog.size
+	}
+	if db.archive != nil {
+		tx.archiveMark = db.archive.mark()
+	}
+	return nil
+}
+
+func (tx *Tx) lock() {
+	if tx.exclusive {
+		tx.db.mu.Lock()
+	} else {
+		tx.db.mu.RLock()
+	}
+}
+
+func (tx *Tx) unlock() {
+	if tx.exclusive {
+		tx.db.mu.Unlock()
+	} else {
+		tx.db.mu.RUnlock()
+	}
+}
+
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.closed {
+		return "", ErrTxClosed
+	}
+	return tx.db.Read(key)
+}
+
+func (tx *Tx) Put(key, value string) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.db.Write(key, value)
+}
+
+func (tx *Tx) Delete(key string) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.db.Remove(key)
+}
+
+// Iterator returns an iterator that is only valid until the transaction
+// ends.
+func (tx *Tx) Iterator() (*Iterator, error) {
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	return NewIterator(tx)
+}
+
+func (tx *Tx) Commit() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return tx.Rollback()
+	}
+	defer tx.close()
+
+	err := tx.db.Commit()
+	if err != nil {
+		tx.discard()
+		return err
+	}
+	return nil
+}
+
+func (tx *Tx) Rollback() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if tx.writable {
+		tx.discard()
+	}
+	tx.close()
+	return nil
+}
+
+// discard drops the writes of tx.
+func (tx *Tx) discard() {
+	db := tx.db
+	db.PageCache.DiscardDirty()
+	db.CurrentPageNums = tx.pageNums
+	db.pendingEvents = nil
+	db.unjournaled = false
+	if db.archive != nil && !db.failed { //records of BulkLoad, a failed db finishes its commit on the next open
+		err := db.archive.rollback(tx.archiveMark)
+		if err != nil {
+			db.failed = true
+		}
+	}
+	if db.changeLog != nil {
+		db.pendingChanges = nil
+		if db.changeLog.size != tx.changeLogSize && !db.failed { //a failed db is cut back by the next open
+			err := db.changeLog.Truncate(tx.changeLogSize)
+			if err != nil { //the records would be followed, leave them to the next open
+				db.failed = true
+			}
+		}
+	}
+}
+
+func (tx *Tx) close() {
+	tx.closed = true
+	if !tx.writable {
+		tx.db.leaveRead()
+	}
+	if tx.exclusive {
+		tx.db.releaseRetired()
+	}
+	tx.unlock()
+}
@@ -0,0 +1,164 @@
+package go_kvstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// WatchEvent is a committed change of a watched key. Revision is the tx id
+// of the commit. PrevValue is the value before the change, if HadPrev.
+type WatchEvent struct {
+	Op        ChangeOp
+	Key       string
+	Value     string
+	PrevValue string
+	HadPrev   bool
+	Revision  uint64
+}
+
+// watcher queues the events of its keys, so that a slow reader does not
+// hold up Commit.
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan WatchEvent
+	closed chan struct{} //closed by DB.Close
+
+	mu     sync.Mutex
+	queue  []WatchEvent
+	signal chan struct{}
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// Watch returns a channel of the events of key, fired after their commit.
+// The channel is closed when ctx is done or the db is closed.
+func (db *DB) Watch(ctx context.Context, key string) (<-chan WatchEvent, error) {
+	return db.watch(ctx, key, false)
+}
+
+// WatchPrefix is Watch for every key starting with prefix.
+func (db *DB) WatchPrefix(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	return db.watch(ctx, prefix, true)
+}
+
+func (db *DB) watch(ctx context.Context, key string, prefix bool) (<-chan WatchEvent, error) {
+	w := &watcher{
+		key:    key,
+		prefix: prefix,
+		ch:     make(chan WatchEvent),
+		closed: make(chan struct{}),
+		signal: make(chan struct{}, 1),
+	}
+	db.mu.Lock()
+	if db.Pager == nil {
+		db.mu.Unlock()
+		return nil, errors.New("db is not opened")
+	}
+	db.watchers = append(db.watchers, w)
+	db.mu.Unlock()
+
+	go db.runWatcher(ctx, w)
+	return w.ch, nil
+}
+
+func (db *DB) runWatcher(ctx context.Context, w *watcher) {
+	defer close(w.ch)
+	defer db.removeWatcher(w)
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, event := range queue {
+			select {
+			case w.ch <- event:
+			case <-ctx.Done():
+				return
+			case <-w.closed:
+				return
+			}
+		}
+
+		select {
+		case <-w.signal:
+		case <-ctx.Done():
+			return
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (db *DB) removeWatcher(w *watcher) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, running := range db.watchers {
+		if running == w {
+			db.watchers = append(db.watchers[:i], db.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// watched reports whether a watcher wants the changes of key. Called with
+// db.mu held.
+func (db *DB) watched(key string) bool {
+	for _, w := range db.watchers {
+		if w.matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordWatchEvent remembers a change of a watched key for the next
+// Commit, prev is the value before it.
+func (db *DB) recordWatchEvent(op ChangeOp, key, value, prev string, hadPrev bool) {
+	db.pendingEvents = append(db.pendingEvents, WatchEvent{
+		Op:        op,
+		Key:       key,
+		Value:     value,
+		PrevValue: prev,
+		HadPrev:   hadPrev,
+	})
+}
+
+// publishWatchEvents hands the events of the commit txID to the watchers.
+// Called with db.mu held.
+func (db *DB) publishWatchEvents(txID uint64) {
+	for _, event := range db.pendingEvents {
+		event.Revision = txID
+		for _, w := range db.watchers {
+			if !w.matches(event.Key) {
+				continue
+			}
+			w.mu.Lock()
+			w.queue = append(w.queue, event)
+			w.mu.Unlock()
+			select {
+			case w.signal <- struct{}{}:
+			default: //already signaled
+			}
+		}
+	}
+	db.pendingEvents = nil
+}
+
+// closeWatchers ends all watches, called by Close.
+func (db *DB) closeWatchers() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, w := range db.watchers {
+		close(w.closed)
+	}
+	db.watchers = nil
+}
@@ -0,0 +1,99 @@
+package go_kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, ch <-chan WatchEvent, n int) []WatchEvent {
+	var events []WatchEvent
+	for len(events) < n {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatal("watch closed after ", len(events), " events")
+			}
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout after ", len(events), " events")
+		}
+	}
+	return events
+}
+
+func TestWatch(t *testing.T) {
+	db := NewMemDB()
+	err := db.Put("config/a", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prefix, err := db.WatchPrefix(ctx, "config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Watch(context.Background(), "config/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Put("config/a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("other", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Put("config/b", "rolled back")
+	tx.Rollback()
+	err = db.Update(func(tx *Tx) error {
+		err := tx.Put("config/b", "2")
+		if err != nil {
+			return err
+		}
+		return tx.Delete("config/a")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := db.TxID
+
+	expect := []WatchEvent{
+		{Op: ChangePut, Key: "config/a", Value: "1", PrevValue: "0", HadPrev: true, Revision: revision - 2},
+		{Op: ChangePut, Key: "config/b", Value: "2", Revision: revision},
+		{Op: ChangeDelete, Key: "config/a", PrevValue: "1", HadPrev: true, Revision: revision},
+	}
+	for i, event := range receiveEvents(t, prefix, len(expect)) {
+		if event != expect[i] {
+			t.Fatalf("prefix event %d is %+v, expect %+v", i, event, expect[i])
+		}
+	}
+	if event := receiveEvents(t, key, 1)[0]; event != expect[1] {
+		t.Fatalf("key event is %+v, expect %+v", event, expect[1])
+	}
+
+	cancel()
+	for range prefix { //closed once the context is done
+	}
+	// a canceled watch is unregistered and does not block commits
+	for i := 0; i < 10; i++ {
+		err = db.Put("config/a", "after cancel")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.watchers) != 1 {
+		t.Fatal(len(db.watchers), " watchers left, expect 1")
+	}
+
+	db.Close()
+	for range key { //closed by Close
+	}
+}